@@ -14,6 +14,7 @@ import (
 	"github.com/Sesame2/gotun/internal/logger"
 	"github.com/Sesame2/gotun/internal/proxy"
 	"github.com/Sesame2/gotun/internal/router"
+	"github.com/Sesame2/gotun/internal/sshconfig"
 	"github.com/Sesame2/gotun/internal/sysproxy"
 	"github.com/Sesame2/gotun/internal/tun"
 	"github.com/spf13/cobra"
@@ -23,16 +24,18 @@ var (
 	Version    = "dev"
 	cfg        = config.NewConfig()
 	aliasFlags []string
+
+	sshConfigFile string
 )
 
 // rootCmd 代表不带任何子命令时的基础命令
 var rootCmd = &cobra.Command{
-	Use:     "gotun [user@host]",
+	Use:     "gotun [user@]host [[user@]host ...]",
 	Version: Version,
 	Short:   "基于SSH的轻量级HTTP代理工具",
 	Long: `gotun 是一个通过SSH隧道实现HTTP代理的命令行工具。
 它可以帮助您安全地访问内网资源或将远程主机作为网络出口。`,
-	Args: cobra.ExactArgs(1),
+	Args: cobra.MinimumNArgs(1),
 	RunE: func(cmd *cobra.Command, args []string) error {
 		// 自动开启 TUN 模式: 如果指定了 Global, Route 或 NAT
 		if cfg.TunGlobal || len(cfg.TunRoute) > 0 || len(aliasFlags) > 0 {
@@ -57,17 +60,24 @@ var rootCmd = &cobra.Command{
 			return nil
 		}
 
-		// 从参数填充SSH用户和服务器
-		user, host, err := parseSSHTarget(args[0])
-		if err != nil {
-			return err
+		// 从参数和 ~/.ssh/config 填充SSH用户和服务器。
+		// 给出多个目标时，每个目标使用一份独立的配置副本作为 SSH 上游
+		loadSSHConfig()
+		base := *cfg
+		upstreams := []*config.Config{cfg}
+		for range args[1:] {
+			c := base
+			upstreams = append(upstreams, &c)
 		}
-		cfg.SSHUser = user
-		cfg.SSHServer = host
-
-		// 组合服务器地址和端口
-		if cfg.SSHServer != "" && !strings.Contains(cfg.SSHServer, ":") {
-			cfg.SSHServer = fmt.Sprintf("%s:%s", cfg.SSHServer, cfg.SSHPort)
+		for i, target := range args {
+			if err := resolveSSHTarget(cmd, upstreams[i], target); err != nil {
+				return err
+			}
+		}
+		if len(upstreams) > 1 {
+			for _, c := range upstreams {
+				cfg.SSHServers = append(cfg.SSHServers, c.SSHServer)
+			}
 		}
 
 		// 解析 alias 参数到 Config
@@ -120,8 +130,10 @@ var rootCmd = &cobra.Command{
 		}
 
 		// 验证配置
-		if err := cfg.Validate(); err != nil {
-			return fmt.Errorf("配置错误: %w", err)
+		for _, c := range upstreams {
+			if err := c.Validate(); err != nil {
+				return fmt.Errorf("配置错误: %w", err)
+			}
 		}
 
 		log := logger.NewLogger(cfg.Verbose)
@@ -142,15 +154,44 @@ var rootCmd = &cobra.Command{
 				log.Warnf("加载规则文件失败: %v。将以全局代理模式运行。", err)
 			} else {
 				log.Infof("已加载规则文件: %s", cfg.RuleFile)
+
+				// 规则文件修改或收到 SIGHUP 时热加载，无需重启和重新认证
+				hup := make(chan os.Signal, 1)
+				signal.Notify(hup, syscall.SIGHUP)
+				stopWatch := make(chan struct{})
+				defer close(stopWatch)
+				go r.Watch(log, 2*time.Second, hup, stopWatch)
 			}
 		}
 
-		// 2. 初始化 SSHClient
-		sshClient, err := proxy.NewSSHClient(cfg, log)
-		if err != nil {
-			return fmt.Errorf("SSH连接失败: %w", err)
+		// 2. 初始化 SSHClient，多个目标时由 UpstreamGroup 在各上游间选择
+		var sshClient proxy.Dialer
+		var upstreamGroup *proxy.UpstreamGroup
+		var err error
+		if len(upstreams) > 1 {
+			upstreamGroup, err = proxy.NewUpstreamGroup(upstreams, cfg.ProbeInterval, log)
+			if err != nil {
+				return fmt.Errorf("SSH连接失败: %w", err)
+			}
+			defer upstreamGroup.Close()
+			sshClient = upstreamGroup
+		} else {
+			client, err := proxy.NewSSHClient(cfg, log)
+			if err != nil {
+				return fmt.Errorf("SSH连接失败: %w", err)
+			}
+			defer client.Close()
+			sshClient = client
+		}
+
+		// 规则可以指定命名出站，HTTP 和 SOCKS5 代理按匹配结果选择连接。
+		// dns.resolver 为 remote 时，IP 类规则通过默认的 SSH 连接解析域名
+		if r != nil {
+			r.SetRemoteDialer(sshClient.Dial)
+			outbounds := proxy.NewOutbounds(cfg, log, sshClient, r)
+			defer outbounds.Close()
+			sshClient = outbounds
 		}
-		defer sshClient.Close()
 
 		// 3. 初始化 HTTP 代理
 		httpProxy, err := proxy.NewHTTPOverSSH(cfg, log, sshClient, r)
@@ -175,12 +216,27 @@ var rootCmd = &cobra.Command{
 		// 5. 初始化 TUN 模式
 		var tunService *tun.TunService
 		if cfg.TunMode {
-			tunService, err = tun.NewTunService(cfg, log, sshClient)
+			tunService, err = tun.NewTunService(cfg, log, sshClient, r)
 			if err != nil {
 				return fmt.Errorf("TUN服务初始化失败: %w", err)
 			}
 		}
 
+		// 6. 初始化本地端口转发
+		var localForwards []*proxy.LocalForward
+		for _, spec := range cfg.LocalForwards {
+			fwd, err := config.ParseForward(spec)
+			if err != nil {
+				return err
+			}
+			lf, err := proxy.NewLocalForward(fwd, log, sshClient)
+			if err != nil {
+				return err
+			}
+			defer lf.Close()
+			localForwards = append(localForwards, lf)
+		}
+
 		sigChan := make(chan os.Signal, 1)
 		signal.Notify(sigChan, syscall.SIGINT, syscall.SIGTERM)
 
@@ -214,6 +270,15 @@ var rootCmd = &cobra.Command{
 			}()
 		}
 
+		for _, lf := range localForwards {
+			go func(lf *proxy.LocalForward) {
+				if err := lf.Start(); err != nil {
+					log.Errorf("本地转发 %s 启动失败: %v", lf, err)
+					sigChan <- syscall.SIGTERM
+				}
+			}(lf)
+		}
+
 		fmt.Println("\n代理服务已启动:")
 		fmt.Println("HTTP Proxy:", "http://"+cfg.ListenAddr)
 		if cfg.SocksAddr != "" {
@@ -222,8 +287,16 @@ var rootCmd = &cobra.Command{
 		if cfg.TunMode {
 			fmt.Printf("TUN Mode: Enabled (CIDR: %s)\n", cfg.TunCIDR)
 		}
+		for _, lf := range localForwards {
+			fmt.Println("本地转发:", lf)
+		}
+		for _, spec := range cfg.RemoteForwards {
+			fmt.Println("远程转发:", spec)
+		}
 
-		if len(cfg.JumpHosts) > 0 {
+		if upstreamGroup != nil {
+			fmt.Println("SSH 上游:", upstreamGroup)
+		} else if len(cfg.JumpHosts) > 0 {
 			fmt.Printf("跳板机链: %s -> %s\n", fmt.Sprintf("%v", cfg.JumpHosts), cfg.SSHServer)
 		} else {
 			fmt.Println("直连SSH服务器:", cfg.SSHServer)
@@ -262,6 +335,12 @@ var rootCmd = &cobra.Command{
 			}
 		}
 
+		for _, lf := range localForwards {
+			if err := lf.Close(); err != nil {
+				log.Errorf("关闭本地转发 %s 失败: %v", lf, err)
+			}
+		}
+
 		return nil
 	},
 }
@@ -272,8 +351,24 @@ func init() {
 	rootCmd.PersistentFlags().StringVarP(&cfg.SSHPort, "port", "p", "22", "SSH服务器端口")
 	rootCmd.PersistentFlags().StringVar(&cfg.SSHPassword, "pass", "", "SSH密码 (不安全, 建议使用交互式认证)")
 	rootCmd.PersistentFlags().StringVarP(&cfg.SSHKeyFile, "identity_file", "i", "", "用于认证的私钥文件路径")
-	rootCmd.PersistentFlags().StringSliceVarP(&cfg.JumpHosts, "jump", "J", []string{}, "跳板机列表,用逗号分隔 (格式: user@host:port)")
+	rootCmd.PersistentFlags().StringVar(&cfg.CertificateFile, "certificate-file", "", "OpenSSH 用户证书路径 (默认自动使用私钥旁的 *-cert.pub)")
+	rootCmd.PersistentFlags().StringVar(&cfg.KeyPassphraseFile, "key-passphrase-file", "", "私钥密码文件路径 (也可使用环境变量 "+proxy.KeyPassphraseEnv+")")
+	rootCmd.PersistentFlags().BoolVarP(&cfg.ForwardAgent, "forward-agent", "A", false, "将本地 ssh-agent 转发到目标主机")
+	rootCmd.PersistentFlags().StringArrayVarP(&cfg.LocalForwards, "local-forward", "L", []string{}, "本地端口转发，可重复指定 (格式: [bind:]port:host:hostport 或 Unix socket 路径)")
+	rootCmd.PersistentFlags().StringArrayVarP(&cfg.RemoteForwards, "remote-forward", "R", []string{}, "远程端口转发，将本地服务暴露到远端，可重复指定 (格式: [bind:]port:host:hostport，port 为 0 时由服务器分配；只有 [bind:]port 时在远端提供反向 SOCKS5)")
+	rootCmd.PersistentFlags().StringSliceVar(&cfg.RemoteSocksAllow, "remote-socks-allow", []string{}, "反向 SOCKS5 (-R [bind:]port) 允许访问的本地目标，用逗号分隔 (如 10.8.0.0/16,*.corp.lan:443，* 表示全部)")
+	rootCmd.PersistentFlags().StringVar(&cfg.Proxy, "proxy", "", "经由上游代理连接第一跳 (格式: http://[user:pass@]host:port 或 socks5://[user:pass@]host:port)")
+	rootCmd.PersistentFlags().StringVar(&cfg.ProxyCommand, "proxy-command", "", "通过命令的标准输入输出连接第一跳，支持 %h %p %r %n (如 \"cloudflared access ssh --hostname %h\")")
+	rootCmd.PersistentFlags().StringArrayVarP(&cfg.JumpHosts, "jump", "J", []string{}, "跳板机列表,用逗号分隔或多次指定 (格式: user@host:port[?identity=...&password-env=...&timeout=...]，设置值中的逗号写作 %2C)")
 	rootCmd.PersistentFlags().DurationVar(&cfg.Timeout, "timeout", 10*time.Second, "连接超时时间")
+	rootCmd.PersistentFlags().DurationVar(&cfg.KeepAliveInterval, "keepalive", 30*time.Second, "发送 SSH keepalive 的间隔 (~/.ssh/config 中的 ServerAliveInterval 优先于默认值, 0 表示不发送)")
+	rootCmd.PersistentFlags().IntVar(&cfg.KeepAliveCountMax, "keepalive-count", 3, "连续多少次 keepalive 无响应后重连")
+	rootCmd.PersistentFlags().BoolVar(&cfg.Reconnect, "reconnect", true, "SSH 连接断开后自动重连")
+	rootCmd.PersistentFlags().DurationVar(&cfg.ProbeInterval, "probe-interval", 10*time.Second, "给出多个目标时探测各 SSH 上游延迟的间隔")
+	rootCmd.PersistentFlags().IntVar(&cfg.SSHConns, "ssh-conns", 1, "到目标服务器的并行 SSH 连接数, 新连接分配到活动通道最少的连接上")
+	rootCmd.PersistentFlags().StringVarP(&sshConfigFile, "ssh-config", "F", "", "SSH 配置文件路径 (默认读取 ~/.ssh/config, \"none\" 表示不读取)")
+	rootCmd.PersistentFlags().StringVar(&cfg.KnownHostsFile, "known-hosts", "", "额外的 known_hosts 文件路径 (新确认的主机也会写入此文件)")
+	rootCmd.PersistentFlags().StringVar(&cfg.HostKeyCheck, "host-key-check", "ask", "主机密钥校验策略: ask (未知主机询问), yes (只信任已知主机), accept-new (自动信任新主机), no (不校验, 不安全)")
 
 	// --- Group 2: Proxy Services ---
 	rootCmd.PersistentFlags().StringVarP(&cfg.ListenAddr, "listen", "l", ":8080", "本地HTTP代理监听地址 [已废弃，推荐使用 --http]")
@@ -306,24 +401,94 @@ func Execute(version string) {
 	}
 }
 
-// 解析SSH目标格式(user@host)
-func parseSSHTarget(target string) (string, string, error) {
+// loadSSHConfig 读取 -F 指定的或默认的 SSH 配置文件，失败时只给出警告
+func loadSSHConfig() {
+	if sshConfigFile == "none" {
+		return
+	}
+	var err error
+	if sshConfigFile != "" {
+		cfg.SSHConfig, err = sshconfig.Load(sshConfigFile)
+	} else {
+		cfg.SSHConfig, err = sshconfig.LoadDefault()
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "警告: 读取SSH配置文件失败: %v\n", err)
+	}
+}
+
+// resolveSSHTarget 解析目标主机参数，并按 ~/.ssh/config 补全未在命令行中指定的设置
+func resolveSSHTarget(cmd *cobra.Command, cfg *config.Config, target string) error {
+	user, host, port, err := parseSSHTarget(target)
+	if err != nil {
+		return err
+	}
+
+	// 端口优先级: 参数中的端口 > -p > ~/.ssh/config > 22
+	if port == "" && cmd.Flags().Changed("port") {
+		port = cfg.SSHPort
+	}
+	resolved := cfg.ResolveSSHHost(host, user, port)
+	if resolved.User == "" {
+		resolved.User = sshconfig.LocalUser()
+	}
+	cfg.SSHUser = resolved.User
+	cfg.SSHServer = resolved.Addr()
+	cfg.SSHPort = resolved.Port
+	cfg.SSHAlias = host
+	cfg.IdentityFiles = resolved.IdentityFiles
+	cfg.CertificateFiles = resolved.CertificateFiles
+	cfg.IdentitiesOnly = resolved.IdentitiesOnly
+
+	hc := cfg.SSHConfig.Lookup(host)
+	if !cmd.Flags().Changed("keepalive") && hc.ServerAliveInterval > 0 {
+		cfg.KeepAliveInterval = hc.ServerAliveInterval
+	}
+	if !cmd.Flags().Changed("keepalive-count") && hc.ServerAliveCountMax > 0 {
+		cfg.KeepAliveCountMax = hc.ServerAliveCountMax
+	}
+
+	// 命令行未指定 -J 时使用配置文件中的 ProxyJump
+	if cmd.Flags().Changed("jump") {
+		cfg.JumpHosts = config.SplitJumpHosts(cfg.JumpHosts)
+	} else {
+		cfg.JumpHosts = config.SplitProxyJump(hc.ProxyJump)
+	}
+	cfg.JumpHosts, err = cfg.ExpandJumpChain(cfg.JumpHosts)
+	if err != nil {
+		return err
+	}
+
+	// 直接连接目标服务器时，配置文件中的 ProxyCommand 在命令行未指定代理时生效；
+	// 经由跳板机时则使用第一跳的 ProxyCommand
+	if len(cfg.JumpHosts) == 0 && cfg.Proxy == "" && cfg.ProxyCommand == "" {
+		cfg.ProxyCommand = hc.ProxyCommand
+	}
+	return nil
+}
+
+// 解析SSH目标格式([user@]host[:port])，host 可以是 ~/.ssh/config 中的别名
+func parseSSHTarget(target string) (user, host, port string, err error) {
 	if target == "" {
-		return "", "", nil
+		return "", "", "", fmt.Errorf("必须提供SSH服务器地址")
 	}
 
-	parts := strings.Split(target, "@")
-	if len(parts) != 2 {
-		return "", "", fmt.Errorf("无效的SSH目标格式，需要 user@host 格式")
+	host = target
+	if i := strings.LastIndex(target, "@"); i >= 0 {
+		user, host = target[:i], target[i+1:]
+		if user == "" {
+			return "", "", "", fmt.Errorf("用户名不能为空")
+		}
 	}
 
-	user := parts[0]
-	host := parts[1]
+	if h, p, splitErr := net.SplitHostPort(host); splitErr == nil {
+		host, port = h, p
+	}
 
 	// 检查是否有效
-	if user == "" || host == "" {
-		return "", "", fmt.Errorf("用户名或主机名不能为空")
+	if host == "" {
+		return "", "", "", fmt.Errorf("主机名不能为空")
 	}
 
-	return user, host, nil
+	return user, host, port, nil
 }
@@ -0,0 +1,57 @@
+package cli
+
+import (
+	"fmt"
+
+	"github.com/Sesame2/gotun/internal/router"
+	"github.com/spf13/cobra"
+)
+
+// rules test 模拟的连接信息
+var testRequest router.Request
+
+// rulesCmd 是规则相关工具命令的父命令
+var rulesCmd = &cobra.Command{
+	Use:   "rules",
+	Short: "规则文件工具",
+}
+
+// rulesTestCmd 检查给定的主机会命中规则文件中的哪条规则
+var rulesTestCmd = &cobra.Command{
+	Use:   "test <rules.yaml> <host[:port]>...",
+	Short: "显示每个主机命中的规则及原因",
+	Example: `  gotun rules test rules.yaml www.google.com 192.168.1.10:22
+  gotun rules test rules.yaml ads.example.com:443
+  gotun rules test --source 172.17.0.2:40000 --inbound socks5 rules.yaml example.com:22
+  gotun rules test --process /usr/bin/git rules.yaml github.com:22`,
+	Args: cobra.MinimumNArgs(2),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		cmd.SilenceUsage = true
+		r, err := router.NewRouter(args[0])
+		if err != nil {
+			return err
+		}
+
+		out := cmd.OutOrStdout()
+		for _, host := range args[1:] {
+			req := testRequest
+			req.Host = host
+			result := r.EvaluateRequest(req)
+			fmt.Fprintf(out, "%s -> %s\n", host, result.Target())
+			if result.Matched() {
+				fmt.Fprintf(out, "  规则: %s\n", result)
+			}
+			fmt.Fprintf(out, "  原因: %s\n", result.Reason)
+		}
+		return nil
+	},
+}
+
+func init() {
+	rulesTestCmd.Flags().StringVar(&testRequest.Source, "source", "", "模拟的客户端地址 (ip:port)，用于 SRC-IP-CIDR 和 SRC-PORT 规则")
+	rulesTestCmd.Flags().StringVar(&testRequest.Network, "network", "tcp", "模拟的网络类型 (tcp 或 udp)")
+	rulesTestCmd.Flags().StringVar(&testRequest.Inbound, "inbound", "", "模拟的入站名称 (http、socks5 或 tun)")
+	rulesTestCmd.Flags().StringVar(&testRequest.Process, "process", "", "模拟的客户端进程路径，用于 PROCESS-NAME 和 PROCESS-PATH 规则")
+	rulesCmd.AddCommand(rulesTestCmd)
+	rootCmd.AddCommand(rulesCmd)
+}
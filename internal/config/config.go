@@ -4,8 +4,13 @@ import (
 	"errors"
 	"fmt"
 	"net"
+	"net/url"
+	"os"
 	"strings"
 	"time"
+
+	"github.com/Sesame2/gotun/internal/sshconfig"
+	"github.com/Sesame2/gotun/internal/utils"
 )
 
 // SubnetAlias 定义网段映射规则
@@ -14,28 +19,81 @@ type SubnetAlias struct {
 	Dst *net.IPNet
 }
 
+// SSHHost 描述 SSH 链路中的一个节点 (跳板机或目标服务器)
+type SSHHost struct {
+	User             string
+	Host             string
+	Alias            string // 在 ~/.ssh/config 中查找时使用的主机名，用于展开 ProxyCommand 的 %n
+	Port             string
+	IdentityFiles    []string // 来自 ~/.ssh/config 的 IdentityFile
+	CertificateFiles []string // 来自 ~/.ssh/config 的 CertificateFile
+	IdentitiesOnly   bool
+	ProxyCommand     string // 来自 ~/.ssh/config 的 ProxyCommand，仅在该节点为第一跳时使用
+
+	// 来自 -J 参数的单跳设置，为空时使用全局设置
+	KeyFile      string        // 该跳使用的私钥，代替 -i
+	PasswordFile string        // 从文件读取该跳的密码
+	PasswordEnv  string        // 从环境变量读取该跳的密码
+	Timeout      time.Duration // 该跳的连接超时
+}
+
+// Addr 返回 host:port 形式的地址
+func (h SSHHost) Addr() string {
+	return net.JoinHostPort(h.Host, h.Port)
+}
+
 // Config 存储应用配置
 type Config struct {
-	ListenAddr      string
-	SSHServer       string
-	SSHUser         string
-	SSHPassword     string
-	SSHKeyFile      string
-	HTTPUpstream    string        // 强制 HTTP 上游 (原 SSHTargetDial)
-	SSHPort         string        // 添加SSH端口配置
-	SocksAddr       string        // SOCKS5 监听地址
-	TunMode         bool          // 是否启用 TUN 模式
-	TunCIDR         string        // TUN 设备 CIDR (e.g. 10.0.0.1/24)
-	TunRoute        []string      // 需要路由到 TUN 的网段
-	TunGlobal       bool          // 是否开启全局模式
-	SubnetAliases   []SubnetAlias // 网段/IP映射规则 (NAT)
-	JumpHosts       []string      // 跳板机列表
-	Timeout         time.Duration
-	Verbose         bool
-	LogFile         string
-	InteractiveAuth bool
-	SystemProxy     bool // 是否启用系统代理
-	RuleFile        string
+	ListenAddr       string
+	SSHServer        string
+	SSHUser          string
+	SSHPassword      string
+	SSHKeyFile       string
+	HTTPUpstream     string        // 强制 HTTP 上游 (原 SSHTargetDial)
+	SSHPort          string        // 添加SSH端口配置
+	SSHAlias         string        // 目标服务器在命令行上给出的主机名 (可以是 ~/.ssh/config 中的别名)
+	SocksAddr        string        // SOCKS5 监听地址
+	TunMode          bool          // 是否启用 TUN 模式
+	TunCIDR          string        // TUN 设备 CIDR (e.g. 10.0.0.1/24)
+	TunRoute         []string      // 需要路由到 TUN 的网段
+	TunGlobal        bool          // 是否开启全局模式
+	SubnetAliases    []SubnetAlias // 网段/IP映射规则 (NAT)
+	JumpHosts        []string      // 跳板机列表
+	Timeout          time.Duration
+	Verbose          bool
+	LogFile          string
+	InteractiveAuth  bool
+	SystemProxy      bool // 是否启用系统代理
+	RuleFile         string
+	LocalForwards    []string // -L 本地端口转发
+	RemoteForwards   []string // -R 远程端口转发
+	RemoteSocksAllow []string // 反向 SOCKS5 允许访问的本地目标
+
+	// 主机密钥校验与认证
+	KnownHostsFile    string // 额外的 known_hosts 文件，新主机也写入此文件
+	HostKeyCheck      string // 主机密钥校验策略: ask, yes, accept-new, no
+	ForwardAgent      bool   // 是否将本地 ssh-agent 转发到目标主机
+	KeyPassphraseFile string // 私钥密码文件，用于无人值守运行
+	CertificateFile   string // 额外的 OpenSSH 用户证书
+	NoPrompt          bool   // 不在终端上询问密码、私钥密码或未知主机，用于在后台建立的连接
+
+	// 连接第一跳的方式，都为空时直接建立 TCP 连接
+	Proxy        string // 上游代理，格式为 http://[user:pass@]host:port 或 socks5://[user:pass@]host:port
+	ProxyCommand string // 通过命令的标准输入输出承载 SSH 连接，支持 %h %p %r 占位符
+
+	// 来自 ~/.ssh/config 的设置
+	SSHConfig         *sshconfig.Config
+	IdentityFiles     []string      // 目标服务器的 IdentityFile
+	CertificateFiles  []string      // 目标服务器的 CertificateFile
+	IdentitiesOnly    bool          // 只使用明确配置的私钥
+	KeepAliveInterval time.Duration // 发送 keepalive 的间隔, 0 表示不发送
+	KeepAliveCountMax int           // 连续多少次 keepalive 无响应后认为连接已断开
+	Reconnect         bool          // 连接断开后是否自动重连
+	SSHConns          int           // 到目标服务器的并行连接数
+
+	// 多个 SSH 上游
+	SSHServers    []string      // 所有上游的服务器地址 (host:port)，只有一个上游时为空
+	ProbeInterval time.Duration // 探测上游延迟的间隔
 }
 
 // NewConfig 创建默认配置
@@ -56,42 +114,106 @@ func NewConfig() *Config {
 		TunRoute:        []string{},
 		TunGlobal:       false,
 		SubnetAliases:   []SubnetAlias{},
+		HostKeyCheck:    "ask",
+
+		KeepAliveInterval: 30 * time.Second,
+		KeepAliveCountMax: 3,
+		Reconnect:         true,
+		SSHConns:          1,
+		ProbeInterval:     10 * time.Second,
 	}
 }
 
-// parseJumpHost 解析跳板机格式
-func parseJumpHost(jumpHost string) (user, host, port string, err error) {
-	// 支持格式: user@host:port, user@host, host:port, host
-	parts := strings.Split(jumpHost, "@")
+// parseJumpHost 解析跳板机格式，未指定端口时 Port 为空，由 ssh 配置或默认值补全
+func parseJumpHost(jumpHost string) (SSHHost, error) {
+	// 支持格式: user@host:port, user@host, host:port, host，
+	// 之后可以跟 ?identity=...&password-file=... 形式的单跳设置
+	var hop SSHHost
+	hostSpec, query, hasQuery := strings.Cut(jumpHost, "?")
+	parts := strings.Split(hostSpec, "@")
 
 	var hostPart string
 	if len(parts) == 2 {
-		user = parts[0]
+		hop.User = parts[0]
 		hostPart = parts[1]
 	} else if len(parts) == 1 {
 		hostPart = parts[0]
 	} else {
-		return "", "", "", fmt.Errorf("无效的跳板机格式: %s", jumpHost)
+		return SSHHost{}, fmt.Errorf("无效的跳板机格式: %s", jumpHost)
 	}
 
 	// 解析主机和端口
 	if strings.Contains(hostPart, ":") {
 		hostPortParts := strings.Split(hostPart, ":")
 		if len(hostPortParts) != 2 {
-			return "", "", "", fmt.Errorf("无效的主机:端口格式: %s", hostPart)
+			return SSHHost{}, fmt.Errorf("无效的主机:端口格式: %s", hostPart)
 		}
-		host = hostPortParts[0]
-		port = hostPortParts[1]
+		hop.Host = hostPortParts[0]
+		hop.Port = hostPortParts[1]
 	} else {
-		host = hostPart
-		port = "22" // 默认SSH端口
+		hop.Host = hostPart
+	}
+
+	if hop.Host == "" {
+		return SSHHost{}, fmt.Errorf("主机名不能为空")
+	}
+
+	if hasQuery {
+		if err := hop.parseOptions(query); err != nil {
+			return SSHHost{}, fmt.Errorf("跳板机 %s 的设置无效: %v", hostSpec, err)
+		}
 	}
+	return hop, nil
+}
 
-	if host == "" {
-		return "", "", "", fmt.Errorf("主机名不能为空")
+// parseOptions 解析 -J 中 ? 之后的单跳设置
+func (h *SSHHost) parseOptions(query string) error {
+	values, err := url.ParseQuery(query)
+	if err != nil {
+		return err
+	}
+	for key, vals := range values {
+		value := vals[len(vals)-1]
+		switch key {
+		case "identity":
+			h.KeyFile = value
+		case "password-file":
+			h.PasswordFile = value
+		case "password-env":
+			h.PasswordEnv = value
+		case "timeout":
+			d, err := time.ParseDuration(value)
+			if err != nil || d <= 0 {
+				return fmt.Errorf("无效的超时时间: %s", value)
+			}
+			h.Timeout = d
+		default:
+			return fmt.Errorf("未知的设置 %q (可选: identity, password-file, password-env, timeout)", key)
+		}
+	}
+	if h.PasswordFile != "" && h.PasswordEnv != "" {
+		return fmt.Errorf("password-file 和 password-env 不能同时使用")
 	}
+	return nil
+}
 
-	return user, host, port, nil
+// HopPassword 返回该跳通过 password-file 或 password-env 指定的密码，未指定时返回空
+func (h SSHHost) HopPassword() (string, error) {
+	switch {
+	case h.PasswordFile != "":
+		data, err := os.ReadFile(utils.ExpandHome(h.PasswordFile))
+		if err != nil {
+			return "", fmt.Errorf("读取密码文件失败: %v", err)
+		}
+		return strings.TrimRight(string(data), "\r\n"), nil
+	case h.PasswordEnv != "":
+		password, ok := os.LookupEnv(h.PasswordEnv)
+		if !ok {
+			return "", fmt.Errorf("环境变量 %s 未设置", h.PasswordEnv)
+		}
+		return password, nil
+	}
+	return "", nil
 }
 
 // Validate 验证配置
@@ -104,17 +226,47 @@ func (c *Config) Validate() error {
 		return errors.New("必须提供SSH用户名")
 	}
 
-	if !c.InteractiveAuth && c.SSHPassword == "" && c.SSHKeyFile == "" {
+	// ~/.ssh/config 中的 IdentityFile 和 ssh-agent 同样可用于认证
+	if !c.InteractiveAuth && c.SSHPassword == "" && c.SSHKeyFile == "" &&
+		len(c.IdentityFiles) == 0 && os.Getenv("SSH_AUTH_SOCK") == "" {
 		return errors.New("必须提供SSH密码、私钥文件或使用交互式认证")
 	}
 
+	if c.SSHConns < 1 {
+		return fmt.Errorf("SSH 并行连接数必须大于 0: %d", c.SSHConns)
+	}
+
+	if c.Proxy != "" && c.ProxyCommand != "" {
+		return errors.New("--proxy 和 --proxy-command 不能同时使用")
+	}
+	if c.Proxy != "" {
+		if _, err := ParseProxyURL(c.Proxy); err != nil {
+			return err
+		}
+	}
+
+	for _, spec := range c.LocalForwards {
+		if _, err := ParseForward(spec); err != nil {
+			return err
+		}
+	}
+	for _, spec := range c.RemoteForwards {
+		if _, err := ParseRemoteForward(spec); err != nil {
+			return err
+		}
+	}
+	for _, entry := range c.RemoteSocksAllow {
+		if _, err := ParseAllowEntry(entry); err != nil {
+			return err
+		}
+	}
+
 	// 验证跳板机格式
 	for _, jumpHost := range c.JumpHosts {
 		if jumpHost == "" {
 			continue
 		}
-		_, _, _, err := parseJumpHost(jumpHost)
-		if err != nil {
+		if _, err := parseJumpHost(jumpHost); err != nil {
 			return fmt.Errorf("跳板机格式错误: %v", err)
 		}
 	}
@@ -122,7 +274,208 @@ func (c *Config) Validate() error {
 	return nil
 }
 
-// GetJumpHostInfo 获取跳板机信息
-func (c *Config) GetJumpHostInfo(jumpHost string) (user, host, port string, err error) {
-	return parseJumpHost(jumpHost)
+// GetJumpHostInfo 获取跳板机信息，未显式指定的用户和端口从 ~/.ssh/config 中补全
+func (c *Config) GetJumpHostInfo(jumpHost string) (SSHHost, error) {
+	parsed, err := parseJumpHost(jumpHost)
+	if err != nil {
+		return SSHHost{}, err
+	}
+	hop := c.ResolveSSHHost(parsed.Host, parsed.User, parsed.Port)
+	if hop.User == "" {
+		hop.User = c.SSHUser
+	}
+	hop.KeyFile = parsed.KeyFile
+	hop.PasswordFile = parsed.PasswordFile
+	hop.PasswordEnv = parsed.PasswordEnv
+	hop.Timeout = parsed.Timeout
+	return hop, nil
+}
+
+// TargetHost 返回目标服务器的节点信息
+func (c *Config) TargetHost() SSHHost {
+	host, port, err := net.SplitHostPort(c.SSHServer)
+	if err != nil {
+		host, port = c.SSHServer, c.SSHPort
+	}
+	return SSHHost{
+		User:             c.SSHUser,
+		Host:             host,
+		Alias:            c.SSHAlias,
+		Port:             port,
+		IdentityFiles:    c.IdentityFiles,
+		CertificateFiles: c.CertificateFiles,
+		IdentitiesOnly:   c.IdentitiesOnly,
+	}
+}
+
+// ForOutbound 返回规则文件中命名 SSH 出站使用的配置: 以 c 为基础，替换目标服务器、
+// 跳板机和认证设置。server 的格式为 [user@]host[:port]，host 可以是 ~/.ssh/config 中的别名；
+// jumps 为 nil 时使用配置文件中的 ProxyJump。opts 中的 KeyFile、PasswordFile 和 PasswordEnv
+// 与 -J 的单跳设置含义相同。--pass、端口转发、agent 转发等只作用于主连接的设置被清空
+func (c *Config) ForOutbound(server string, jumps []string, opts SSHHost) (*Config, error) {
+	target, err := parseJumpHost(server)
+	if err != nil {
+		return nil, err
+	}
+	out := *c
+	hop := c.ResolveSSHHost(target.Host, target.User, target.Port)
+	if hop.User == "" {
+		hop.User = sshconfig.LocalUser()
+	}
+	out.SSHUser = hop.User
+	out.SSHServer = hop.Addr()
+	out.SSHPort = hop.Port
+	out.SSHAlias = target.Host
+	out.IdentityFiles = hop.IdentityFiles
+	out.CertificateFiles = hop.CertificateFiles
+	out.IdentitiesOnly = hop.IdentitiesOnly
+	if opts.KeyFile != "" {
+		out.SSHKeyFile = opts.KeyFile
+	}
+	// 主目标的密码不能发送给其它服务器
+	if out.SSHPassword, err = opts.HopPassword(); err != nil {
+		return nil, err
+	}
+
+	hc := c.SSHConfig.Lookup(target.Host)
+	if jumps == nil {
+		jumps = SplitProxyJump(hc.ProxyJump)
+	}
+	if out.JumpHosts, err = out.ExpandJumpChain(jumps); err != nil {
+		return nil, err
+	}
+	// 命令行的 ProxyCommand 可能来自主目标的配置，出站只使用自己的配置
+	out.ProxyCommand = ""
+	if len(out.JumpHosts) == 0 && out.Proxy == "" {
+		out.ProxyCommand = hc.ProxyCommand
+	}
+
+	out.LocalForwards = nil
+	out.RemoteForwards = nil
+	out.ForwardAgent = false
+	out.SSHServers = nil
+	return &out, out.Validate()
+}
+
+// SSHServerHosts 返回所有上游 SSH 服务器的主机名 (不含端口)
+func (c *Config) SSHServerHosts() []string {
+	servers := c.SSHServers
+	if len(servers) == 0 {
+		servers = []string{c.SSHServer}
+	}
+	var hosts []string
+	for _, s := range servers {
+		if host, _, err := net.SplitHostPort(s); err == nil {
+			s = host
+		}
+		hosts = append(hosts, s)
+	}
+	return hosts
+}
+
+// ResolveSSHHost 按 ~/.ssh/config 解析主机别名，显式给出的 user 和 port 优先
+func (c *Config) ResolveSSHHost(alias, user, port string) SSHHost {
+	hc := c.SSHConfig.Lookup(alias)
+
+	h := SSHHost{
+		User:           user,
+		Host:           alias,
+		Alias:          alias,
+		Port:           port,
+		IdentitiesOnly: hc.IdentitiesOnly,
+	}
+	if hc.HostName != "" {
+		h.Host = hc.HostName
+	}
+	if h.User == "" {
+		h.User = hc.User
+	}
+	if h.Port == "" {
+		h.Port = hc.Port
+	}
+	if h.Port == "" {
+		h.Port = "22"
+	}
+	for _, f := range hc.IdentityFiles {
+		h.IdentityFiles = append(h.IdentityFiles, hc.ExpandTokens(f, h.Host, h.User, h.Port))
+	}
+	for _, f := range hc.CertificateFiles {
+		h.CertificateFiles = append(h.CertificateFiles, hc.ExpandTokens(f, h.Host, h.User, h.Port))
+	}
+	if hc.ProxyCommand != "" {
+		h.ProxyCommand = hc.ExpandTokens(hc.ProxyCommand, h.Host, h.User, h.Port)
+	}
+	return h
+}
+
+// ParseProxyURL 解析 --proxy 指定的上游代理地址，支持 http 和 socks5
+func ParseProxyURL(raw string) (*url.URL, error) {
+	u, err := url.Parse(raw)
+	if err != nil {
+		return nil, fmt.Errorf("无效的代理地址 %s: %v", raw, err)
+	}
+	switch u.Scheme {
+	case "http", "socks5", "socks5h":
+	default:
+		return nil, fmt.Errorf("不支持的代理类型 %q (可选: http, socks5)", u.Scheme)
+	}
+	if u.Hostname() == "" {
+		return nil, fmt.Errorf("代理地址 %s 缺少主机名", raw)
+	}
+	if u.Port() == "" {
+		port := "1080"
+		if u.Scheme == "http" {
+			port = "8080"
+		}
+		u.Host = net.JoinHostPort(u.Hostname(), port)
+	}
+	return u, nil
+}
+
+// ExpandJumpChain 展开第一跳在 ~/.ssh/config 中的 ProxyJump，
+// 与 OpenSSH 一致，后续各跳经由前一跳连接，其 ProxyJump 不再生效
+func (c *Config) ExpandJumpChain(jumps []string) ([]string, error) {
+	seen := make(map[string]bool)
+	for len(jumps) > 0 {
+		hop, err := parseJumpHost(jumps[0])
+		if err != nil {
+			return nil, err
+		}
+		if seen[hop.Host] {
+			return nil, fmt.Errorf("ProxyJump 存在循环: %s", hop.Host)
+		}
+		seen[hop.Host] = true
+
+		prefix := SplitProxyJump(c.SSHConfig.Lookup(hop.Host).ProxyJump)
+		if len(prefix) == 0 {
+			break
+		}
+		jumps = append(prefix, jumps...)
+	}
+	return jumps, nil
+}
+
+// SplitJumpHosts 拆分命令行中的 -J 参数。-J 可以多次给出，每个值中的多个跳板机用逗号分隔；
+// 单跳设置的值中含有逗号时需写作 %2C，否则会被当作下一跳的开始
+func SplitJumpHosts(values []string) []string {
+	var jumps []string
+	for _, v := range values {
+		jumps = append(jumps, SplitProxyJump(v)...)
+	}
+	return jumps
+}
+
+// SplitProxyJump 解析逗号分隔的 ProxyJump 值，"none" 表示不使用跳板机
+func SplitProxyJump(value string) []string {
+	if value == "" || strings.EqualFold(value, "none") {
+		return nil
+	}
+	var jumps []string
+	for _, j := range strings.Split(value, ",") {
+		if j = strings.TrimSpace(j); j != "" {
+			// ssh:// URI 形式
+			jumps = append(jumps, strings.TrimPrefix(j, "ssh://"))
+		}
+	}
+	return jumps
 }
@@ -0,0 +1,34 @@
+package config
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestSplitJumpHosts(t *testing.T) {
+	tests := []struct {
+		values []string
+		want   []string
+	}{
+		{values: []string{"a@j1,b@j2:2222"}, want: []string{"a@j1", "b@j2:2222"}},
+		{values: []string{"a@j1", "b@j2"}, want: []string{"a@j1", "b@j2"}},
+		{values: []string{"ssh://a@j1, j2 ", "j3"}, want: []string{"a@j1", "j2", "j3"}},
+		{values: []string{`"j1"`}, want: []string{`"j1"`}},
+		{values: []string{"j1?identity=~/k%2Cx&timeout=5s,j2"}, want: []string{"j1?identity=~/k%2Cx&timeout=5s", "j2"}},
+		{values: []string{"none"}, want: nil},
+	}
+	for _, tt := range tests {
+		if got := SplitJumpHosts(tt.values); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("SplitJumpHosts(%q) = %q, 期望 %q", tt.values, got, tt.want)
+		}
+	}
+
+	// 设置值中编码的逗号在解析时还原
+	hop, err := parseJumpHost(SplitJumpHosts([]string{"u@j1?identity=~/k%2Cx,j2"})[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if hop.KeyFile != "~/k,x" {
+		t.Errorf("KeyFile = %q, 期望 ~/k,x", hop.KeyFile)
+	}
+}
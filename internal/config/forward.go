@@ -0,0 +1,181 @@
+package config
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// Forward 描述一条端口转发规则，监听端和目标端都可以是 TCP 地址或 Unix socket 路径
+type Forward struct {
+	Spec string // 原始参数，用于日志
+
+	ListenNet  string // "tcp" 或 "unix"
+	ListenAddr string // host:port 或 socket 路径
+	TargetNet  string
+	TargetAddr string
+	Dynamic    bool // 远程动态转发: 在远端提供 SOCKS5，目标由客户端指定并在本地连接
+}
+
+// ParseForward 解析 OpenSSH 格式的转发参数:
+//
+//	[bind:]port:host:hostport
+//	[bind:]port:remote_socket
+//	local_socket:host:hostport
+//	local_socket:remote_socket
+//
+// 未指定 bind 时只监听 localhost，bind 为 * 或空时监听所有地址。
+// IPv6 地址需放在方括号中，如 [::1]:8080:db:5432
+func ParseForward(spec string) (Forward, error) {
+	fields, err := splitForwardSpec(spec)
+	if err != nil {
+		return Forward{}, fmt.Errorf("无效的转发参数 %s: %v", spec, err)
+	}
+
+	var listen []string
+	var target []string
+	switch len(fields) {
+	case 2:
+		listen, target = fields[:1], fields[1:]
+	case 3:
+		// bind:port:remote_socket 或 listen:host:hostport
+		if isSocketPath(fields[2]) {
+			listen, target = fields[:2], fields[2:]
+		} else {
+			listen, target = fields[:1], fields[1:]
+		}
+	case 4:
+		listen, target = fields[:2], fields[2:]
+	default:
+		return Forward{}, fmt.Errorf("无效的转发参数 %s (格式: [bind:]port:host:hostport)", spec)
+	}
+
+	f := Forward{Spec: spec}
+	if f.ListenNet, f.ListenAddr, err = forwardEndpoint(listen, "localhost"); err != nil {
+		return Forward{}, fmt.Errorf("无效的转发参数 %s: %v", spec, err)
+	}
+	if f.TargetNet, f.TargetAddr, err = forwardEndpoint(target, ""); err != nil {
+		return Forward{}, fmt.Errorf("无效的转发参数 %s: %v", spec, err)
+	}
+	return f, nil
+}
+
+// ParseRemoteForward 解析 -R 参数。除 ParseForward 支持的格式外，
+// 只有 [bind:]port 时表示远程动态转发 (反向 SOCKS5)
+func ParseRemoteForward(spec string) (Forward, error) {
+	fields, err := splitForwardSpec(spec)
+	if err != nil {
+		return Forward{}, fmt.Errorf("无效的转发参数 %s: %v", spec, err)
+	}
+	if len(fields) == 1 || (len(fields) == 2 && !isSocketPath(fields[0]) && !isSocketPath(fields[1])) {
+		f := Forward{Spec: spec, Dynamic: true}
+		if f.ListenNet, f.ListenAddr, err = forwardEndpoint(fields, "localhost"); err != nil {
+			return Forward{}, fmt.Errorf("无效的转发参数 %s: %v", spec, err)
+		}
+		return f, nil
+	}
+	return ParseForward(spec)
+}
+
+// AllowEntry 是反向 SOCKS5 允许访问的一类本地目标
+type AllowEntry struct {
+	Any    bool       // * 表示允许所有主机
+	Net    *net.IPNet // IP 或网段
+	Domain string     // 域名，以 *. 开头时匹配所有子域名
+	Port   string     // 为空时允许所有端口
+}
+
+// ParseAllowEntry 解析 --remote-socks-allow 的一项，格式为
+// *、域名、*.域名、IP 或网段，可附加 :port，IPv6 带端口时需放在方括号中
+func ParseAllowEntry(s string) (AllowEntry, error) {
+	host, port := s, ""
+	if strings.HasPrefix(s, "[") {
+		end := strings.Index(s, "]")
+		if end < 0 {
+			return AllowEntry{}, fmt.Errorf("无效的允许目标 %s: 方括号未闭合", s)
+		}
+		host, port = s[1:end], strings.TrimPrefix(s[end+1:], ":")
+	} else if i := strings.Index(s, ":"); i >= 0 && strings.Count(s, ":") == 1 {
+		host, port = s[:i], s[i+1:]
+	}
+	if port != "" {
+		if n, err := strconv.Atoi(port); err != nil || n <= 0 || n > 65535 {
+			return AllowEntry{}, fmt.Errorf("无效的允许目标 %s: 端口无效", s)
+		}
+	}
+
+	e := AllowEntry{Port: port}
+	if host == "*" {
+		e.Any = true
+	} else if _, ipNet, err := net.ParseCIDR(host); err == nil {
+		e.Net = ipNet
+	} else if ip := net.ParseIP(host); ip != nil {
+		bits := 8 * net.IPv6len
+		if ip4 := ip.To4(); ip4 != nil {
+			ip, bits = ip4, 8*net.IPv4len
+		}
+		e.Net = &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)}
+	} else if host != "" {
+		e.Domain = strings.ToLower(host)
+	} else {
+		return AllowEntry{}, fmt.Errorf("无效的允许目标 %s", s)
+	}
+	return e, nil
+}
+
+// forwardEndpoint 将 [host:]port 或 socket 路径转换为网络类型和地址
+func forwardEndpoint(fields []string, defaultHost string) (string, string, error) {
+	if len(fields) == 1 {
+		if isSocketPath(fields[0]) {
+			return "unix", fields[0], nil
+		}
+		if defaultHost == "" {
+			return "", "", fmt.Errorf("缺少目标主机")
+		}
+		fields = []string{defaultHost, fields[0]}
+	}
+
+	host, port := fields[0], fields[1]
+	if host == "*" {
+		host = ""
+	}
+	if n, err := strconv.Atoi(port); err != nil || n < 0 || n > 65535 {
+		return "", "", fmt.Errorf("无效的端口: %s", port)
+	}
+	return "tcp", net.JoinHostPort(host, port), nil
+}
+
+// splitForwardSpec 按冒号拆分转发参数，方括号中的 IPv6 地址作为一个整体
+func splitForwardSpec(spec string) ([]string, error) {
+	var fields []string
+	for spec != "" {
+		var field string
+		if strings.HasPrefix(spec, "[") {
+			end := strings.Index(spec, "]")
+			if end < 0 {
+				return nil, fmt.Errorf("方括号未闭合")
+			}
+			field, spec = spec[1:end], spec[end+1:]
+			if spec != "" && !strings.HasPrefix(spec, ":") {
+				return nil, fmt.Errorf("方括号后应为冒号")
+			}
+		} else if i := strings.Index(spec, ":"); i >= 0 {
+			field, spec = spec[:i], spec[i:]
+		} else {
+			field, spec = spec, ""
+		}
+		fields = append(fields, field)
+		if strings.HasPrefix(spec, ":") {
+			spec = spec[1:]
+			if spec == "" {
+				fields = append(fields, "")
+			}
+		}
+	}
+	return fields, nil
+}
+
+func isSocketPath(s string) bool {
+	return strings.Contains(s, "/")
+}
@@ -0,0 +1,108 @@
+package config
+
+import "testing"
+
+func TestParseForward(t *testing.T) {
+	tests := []struct {
+		spec    string
+		want    Forward
+		wantErr bool
+	}{
+		{spec: "5432:db.internal:5432", want: Forward{ListenNet: "tcp", ListenAddr: "localhost:5432", TargetNet: "tcp", TargetAddr: "db.internal:5432"}},
+		{spec: "0.0.0.0:8080:web:80", want: Forward{ListenNet: "tcp", ListenAddr: "0.0.0.0:8080", TargetNet: "tcp", TargetAddr: "web:80"}},
+		{spec: "*:8080:web:80", want: Forward{ListenNet: "tcp", ListenAddr: ":8080", TargetNet: "tcp", TargetAddr: "web:80"}},
+		{spec: ":8080:web:80", want: Forward{ListenNet: "tcp", ListenAddr: ":8080", TargetNet: "tcp", TargetAddr: "web:80"}},
+		{spec: "[::1]:8080:[fd00::1]:80", want: Forward{ListenNet: "tcp", ListenAddr: "[::1]:8080", TargetNet: "tcp", TargetAddr: "[fd00::1]:80"}},
+		{spec: "/tmp/db.sock:db:5432", want: Forward{ListenNet: "unix", ListenAddr: "/tmp/db.sock", TargetNet: "tcp", TargetAddr: "db:5432"}},
+		{spec: "2375:/var/run/docker.sock", want: Forward{ListenNet: "tcp", ListenAddr: "localhost:2375", TargetNet: "unix", TargetAddr: "/var/run/docker.sock"}},
+		{spec: "127.0.0.1:2375:/var/run/docker.sock", want: Forward{ListenNet: "tcp", ListenAddr: "127.0.0.1:2375", TargetNet: "unix", TargetAddr: "/var/run/docker.sock"}},
+		{spec: "/tmp/docker.sock:/var/run/docker.sock", want: Forward{ListenNet: "unix", ListenAddr: "/tmp/docker.sock", TargetNet: "unix", TargetAddr: "/var/run/docker.sock"}},
+		{spec: "5432", wantErr: true},
+		{spec: "5432:db", wantErr: true},
+		{spec: "abc:db:5432", wantErr: true},
+		{spec: "5432:db:99999", wantErr: true},
+		{spec: "[::1:8080:db:80", wantErr: true},
+		{spec: "a:b:c:d:e", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.spec, func(t *testing.T) {
+			got, err := ParseForward(tt.spec)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("ParseForward(%q) 应返回错误, 得到 %+v", tt.spec, got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("ParseForward(%q) 失败: %v", tt.spec, err)
+			}
+			tt.want.Spec = tt.spec
+			if got != tt.want {
+				t.Errorf("ParseForward(%q) = %+v, 期望 %+v", tt.spec, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseRemoteForwardDynamic(t *testing.T) {
+	tests := []struct {
+		spec       string
+		dynamic    bool
+		listenAddr string
+	}{
+		{spec: "1080", dynamic: true, listenAddr: "localhost:1080"},
+		{spec: "0.0.0.0:1080", dynamic: true, listenAddr: "0.0.0.0:1080"},
+		{spec: "9000:localhost:3000", listenAddr: "localhost:9000"},
+		{spec: "9000:/tmp/app.sock", listenAddr: "localhost:9000"},
+	}
+	for _, tt := range tests {
+		got, err := ParseRemoteForward(tt.spec)
+		if err != nil {
+			t.Fatalf("ParseRemoteForward(%q) 失败: %v", tt.spec, err)
+		}
+		if got.Dynamic != tt.dynamic || got.ListenAddr != tt.listenAddr {
+			t.Errorf("ParseRemoteForward(%q) = %+v", tt.spec, got)
+		}
+	}
+}
+
+func TestParseAllowEntry(t *testing.T) {
+	tests := []struct {
+		entry   string
+		want    string // 期望的 Domain 或网段
+		port    string
+		any     bool
+		wantErr bool
+	}{
+		{entry: "*", any: true},
+		{entry: "*:443", any: true, port: "443"},
+		{entry: "10.8.0.0/16", want: "10.8.0.0/16"},
+		{entry: "10.8.1.5:22", want: "10.8.1.5/32", port: "22"},
+		{entry: "fd00::/8", want: "fd00::/8"},
+		{entry: "[fd00::1]:443", want: "fd00::1/128", port: "443"},
+		{entry: "*.Corp.lan:443", want: "*.corp.lan", port: "443"},
+		{entry: "db.corp.lan", want: "db.corp.lan"},
+		{entry: "db:99999", wantErr: true},
+		{entry: ":80", wantErr: true},
+	}
+	for _, tt := range tests {
+		got, err := ParseAllowEntry(tt.entry)
+		if tt.wantErr {
+			if err == nil {
+				t.Errorf("ParseAllowEntry(%q) 应返回错误", tt.entry)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("ParseAllowEntry(%q) 失败: %v", tt.entry, err)
+		}
+		target := got.Domain
+		if got.Net != nil {
+			target = got.Net.String()
+		}
+		if got.Any != tt.any || target != tt.want || got.Port != tt.port {
+			t.Errorf("ParseAllowEntry(%q) = %+v", tt.entry, got)
+		}
+	}
+}
@@ -27,12 +27,16 @@ type Logger struct {
 	file    *os.File
 }
 
-// NewLogger 创建日志记录器
+// NewLogger 创建日志记录器，verbose 时输出调试日志
 func NewLogger(verbose bool) *Logger {
+	level := LevelInfo
+	if verbose {
+		level = LevelDebug
+	}
 	return &Logger{
 		verbose: verbose,
 		logger:  log.New(os.Stdout, "", log.LstdFlags),
-		level:   LevelInfo,
+		level:   level,
 	}
 }
 
@@ -101,7 +105,7 @@ func (l *Logger) log(level LogLevel, format string, args ...interface{}) {
 // Debug 记录调试日志
 func (l *Logger) Debug(msg string) {
 	if l.verbose {
-		l.log(LevelDebug, msg)
+		l.log(LevelDebug, "%s", msg)
 	}
 }
 
@@ -114,7 +118,7 @@ func (l *Logger) Debugf(format string, args ...interface{}) {
 
 // Info 记录信息日志
 func (l *Logger) Info(msg string) {
-	l.log(LevelInfo, msg)
+	l.log(LevelInfo, "%s", msg)
 }
 
 // Infof 记录格式化信息日志
@@ -124,7 +128,7 @@ func (l *Logger) Infof(format string, args ...interface{}) {
 
 // Warn 记录警告日志
 func (l *Logger) Warn(msg string) {
-	l.log(LevelWarn, msg)
+	l.log(LevelWarn, "%s", msg)
 }
 
 // Warnf 记录格式化警告日志
@@ -134,7 +138,7 @@ func (l *Logger) Warnf(format string, args ...interface{}) {
 
 // Error 记录错误日志
 func (l *Logger) Error(msg string) {
-	l.log(LevelError, msg)
+	l.log(LevelError, "%s", msg)
 }
 
 // Errorf 记录格式化错误日志
@@ -144,7 +148,7 @@ func (l *Logger) Errorf(format string, args ...interface{}) {
 
 // Fatal 记录致命错误并退出
 func (l *Logger) Fatal(msg string) {
-	l.log(LevelFatal, msg)
+	l.log(LevelFatal, "%s", msg)
 	os.Exit(1)
 }
 
@@ -0,0 +1,118 @@
+package proxy
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+
+	"github.com/Sesame2/gotun/internal/logger"
+	"github.com/Sesame2/gotun/internal/utils"
+)
+
+// dialAgent 通过 SSH_AUTH_SOCK 连接本地 ssh-agent，未设置时返回 nil
+func dialAgent(log *logger.Logger) (agent.ExtendedAgent, net.Conn) {
+	sock := os.Getenv("SSH_AUTH_SOCK")
+	if sock == "" {
+		log.Debug("未设置 SSH_AUTH_SOCK，跳过 ssh-agent 认证")
+		return nil, nil
+	}
+
+	conn, err := net.Dial("unix", sock)
+	if err != nil {
+		log.Warnf("连接 ssh-agent (%s) 失败: %v", sock, err)
+		return nil, nil
+	}
+	log.Debugf("已连接 ssh-agent: %s", sock)
+	return agent.NewClient(conn), conn
+}
+
+// agentSigners 返回 ssh-agent 中的所有密钥
+func agentSigners(a agent.ExtendedAgent, log *logger.Logger) []ssh.Signer {
+	if a == nil {
+		return nil
+	}
+	signers, err := a.Signers()
+	if err != nil {
+		log.Warnf("读取 ssh-agent 密钥失败: %v", err)
+		return nil
+	}
+	for _, signer := range signers {
+		log.Debugf("添加 ssh-agent 密钥进行尝试: %s %s", signer.PublicKey().Type(), ssh.FingerprintSHA256(signer.PublicKey()))
+	}
+	return signers
+}
+
+// matchAgentSigner 若私钥对应的 .pub 公钥已在 ssh-agent 中，返回 agent 中的密钥
+func matchAgentSigner(agentKeys []ssh.Signer, keyFile string) ssh.Signer {
+	if len(agentKeys) == 0 {
+		return nil
+	}
+	data, err := os.ReadFile(utils.ExpandHome(keyFile) + ".pub")
+	if err != nil {
+		return nil
+	}
+	pub, _, _, _, err := ssh.ParseAuthorizedKey(data)
+	if err != nil {
+		return nil
+	}
+	for _, signer := range agentKeys {
+		if keyEqual(signer.PublicKey(), pub) {
+			return signer
+		}
+	}
+	return nil
+}
+
+// forwardAgent 将本地 ssh-agent 转发到目标主机。
+// 转发只对某个会话生效，因此这里保持一个会话常驻，并输出远端的 SSH_AUTH_SOCK
+// 供在目标主机上执行的命令使用
+func forwardAgent(client *ssh.Client, log *logger.Logger) (*ssh.Session, error) {
+	sock := os.Getenv("SSH_AUTH_SOCK")
+	if sock == "" {
+		return nil, fmt.Errorf("未设置 SSH_AUTH_SOCK，无法转发 ssh-agent")
+	}
+	if err := agent.ForwardToRemote(client, sock); err != nil {
+		return nil, fmt.Errorf("注册 ssh-agent 转发失败: %w", err)
+	}
+
+	session, err := client.NewSession()
+	if err != nil {
+		return nil, fmt.Errorf("创建 ssh-agent 转发会话失败: %w", err)
+	}
+	if err := agent.RequestAgentForwarding(session); err != nil {
+		session.Close()
+		return nil, fmt.Errorf("服务器拒绝了 ssh-agent 转发请求: %w", err)
+	}
+
+	// stdin 保持打开，cat 会一直阻塞，直到会话关闭
+	if _, err := session.StdinPipe(); err != nil {
+		session.Close()
+		return nil, err
+	}
+	stdout, err := session.StdoutPipe()
+	if err != nil {
+		session.Close()
+		return nil, err
+	}
+	if err := session.Start(`echo "$SSH_AUTH_SOCK"; exec cat >/dev/null`); err != nil {
+		session.Close()
+		return nil, fmt.Errorf("启动 ssh-agent 转发会话失败: %w", err)
+	}
+
+	line, err := bufio.NewReader(stdout).ReadString('\n')
+	if err != nil {
+		session.Close()
+		return nil, fmt.Errorf("读取远端 SSH_AUTH_SOCK 失败: %w", err)
+	}
+	if remoteSock := strings.TrimSpace(line); remoteSock != "" {
+		log.Infof("ssh-agent 已转发到目标主机，远端可使用 SSH_AUTH_SOCK=%s", remoteSock)
+	} else {
+		log.Warn("ssh-agent 转发会话已建立，但远端未设置 SSH_AUTH_SOCK (sshd 可能禁用了 AllowAgentForwarding)")
+	}
+	return session, nil
+}
@@ -0,0 +1,137 @@
+package proxy
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+
+	"github.com/Sesame2/gotun/internal/utils"
+)
+
+// 密码和键盘交互认证的最大尝试次数，与 OpenSSH 的 NumberOfPasswordPrompts 一致
+const maxAuthPrompts = 3
+
+// promptMu 保证多个连接 (连接池、多上游) 同时认证时，终端提示不会交错
+var promptMu sync.Mutex
+
+// handshakeDeadline 控制单次握手的超时，等待用户输入期间暂停计时
+type handshakeDeadline struct {
+	conn    net.Conn
+	timeout time.Duration
+}
+
+func (d *handshakeDeadline) start(conn net.Conn) {
+	d.conn = conn
+	d.resume()
+}
+
+func (d *handshakeDeadline) pause() {
+	if d.conn != nil {
+		d.conn.SetDeadline(time.Time{})
+	}
+}
+
+func (d *handshakeDeadline) resume() {
+	if d.conn != nil {
+		// 跳板机通道不支持 deadline，忽略错误
+		d.conn.SetDeadline(time.Now().Add(d.timeout))
+	}
+}
+
+func (d *handshakeDeadline) stop() {
+	d.pause()
+	d.conn = nil
+}
+
+// passwordMethod 返回按需获取密码的认证方法，只有服务器要求密码时才会提示输入。
+// 第一次使用缓存的密码，失败后重新询问
+func (s *SSHClient) passwordMethod(authCfg *AuthConfig, dl *handshakeDeadline) ssh.AuthMethod {
+	attempt := 0
+	return ssh.RetryableAuthMethod(ssh.PasswordCallback(func() (string, error) {
+		attempt++
+		if attempt > 1 {
+			s.forgetPassword(authCfg.User, authCfg.ServerAddr)
+			if !s.canPrompt() {
+				return "", fmt.Errorf("%s@%s 密码错误", authCfg.User, authCfg.ServerAddr)
+			}
+			fmt.Println("密码错误，请重试。")
+		}
+		s.logger.Debugf("尝试密码认证: %s@%s", authCfg.User, authCfg.ServerAddr)
+
+		dl.pause()
+		defer dl.resume()
+		return s.password(authCfg)
+	}), maxAuthPrompts)
+}
+
+// keyboardInteractiveMethod 返回键盘交互认证方法，用于 OTP/2FA 等服务器发起的问答。
+// 回显与否由服务器指定；看起来是询问密码的问题会先尝试已知的密码
+func (s *SSHClient) keyboardInteractiveMethod(authCfg *AuthConfig, dl *handshakeDeadline) ssh.AuthMethod {
+	passwordTried := false
+	return ssh.RetryableAuthMethod(ssh.KeyboardInteractive(func(name, instruction string, questions []string, echos []bool) ([]string, error) {
+		s.logger.Debugf("键盘交互认证: %s@%s (%d 个问题)", authCfg.User, authCfg.ServerAddr, len(questions))
+
+		// 服务器可能发送不含问题的消息，只需展示
+		if len(questions) == 0 {
+			if text := strings.TrimSpace(name + "\n" + instruction); text != "" && s.canPrompt() {
+				fmt.Println(text)
+			}
+			return nil, nil
+		}
+
+		answers := make([]string, len(questions))
+		for i, q := range questions {
+			if !echos[i] && isPasswordPrompt(q) && !passwordTried {
+				if password, ok := s.knownPassword(authCfg); ok {
+					passwordTried = true
+					answers[i] = password
+					continue
+				}
+			}
+
+			if !s.canPrompt() {
+				return nil, fmt.Errorf("服务器要求键盘交互认证 (%s)，但当前无法在终端上询问", strings.TrimSpace(q))
+			}
+			answer, err := s.askChallenge(name, instruction, q, echos[i], dl)
+			if err != nil {
+				return nil, err
+			}
+			// 只展示一次说明
+			name, instruction = "", ""
+			if !echos[i] && isPasswordPrompt(q) {
+				s.rememberPassword(authCfg, answer)
+			}
+			answers[i] = answer
+		}
+		return answers, nil
+	}), maxAuthPrompts)
+}
+
+// askChallenge 在终端上展示服务器的问题并读取回答
+func (s *SSHClient) askChallenge(name, instruction, question string, echo bool, dl *handshakeDeadline) (string, error) {
+	promptMu.Lock()
+	defer promptMu.Unlock()
+	dl.pause()
+	defer dl.resume()
+
+	if name = strings.TrimSpace(name); name != "" {
+		fmt.Println(name)
+	}
+	if instruction = strings.TrimSpace(instruction); instruction != "" {
+		fmt.Println(instruction)
+	}
+	if echo {
+		return utils.ReadLineFromTerminal(question)
+	}
+	return utils.ReadPasswordFromTerminal(question)
+}
+
+// isPasswordPrompt 判断键盘交互的问题是否在询问登录密码 (PAM 通常以此方式询问密码)
+func isPasswordPrompt(question string) bool {
+	q := strings.ToLower(question)
+	return strings.Contains(q, "password") || strings.Contains(q, "密码")
+}
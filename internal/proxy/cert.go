@@ -0,0 +1,117 @@
+package proxy
+
+import (
+	"fmt"
+	"os"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+
+	"github.com/Sesame2/gotun/internal/utils"
+)
+
+// certSuffix 是 OpenSSH 在私钥旁存放用户证书的文件名后缀
+const certSuffix = "-cert.pub"
+
+// loadCertificate 读取 OpenSSH 用户证书文件
+func loadCertificate(path string) (*ssh.Certificate, error) {
+	data, err := os.ReadFile(utils.ExpandHome(path))
+	if err != nil {
+		return nil, fmt.Errorf("读取证书文件 '%s' 失败: %v", path, err)
+	}
+	pub, _, _, _, err := ssh.ParseAuthorizedKey(data)
+	if err != nil {
+		return nil, fmt.Errorf("解析证书文件 '%s' 失败: %v", path, err)
+	}
+	cert, ok := pub.(*ssh.Certificate)
+	if !ok {
+		return nil, fmt.Errorf("'%s' 不是 OpenSSH 证书", path)
+	}
+	if cert.CertType != ssh.UserCert {
+		return nil, fmt.Errorf("'%s' 不是用户证书", path)
+	}
+	return cert, nil
+}
+
+// certSigners 为证书找到公钥匹配的密钥，返回包装后的证书签名器。
+// certFiles 为明确指定的证书，keyFiles 旁的 *-cert.pub 会被自动使用，每次连接都重新读取，
+// 以便使用磁盘上刚续签的短期证书
+func (s *SSHClient) certSigners(signers []ssh.Signer, certFiles, keyFiles []string, user string) []ssh.Signer {
+	log := s.logger
+
+	paths := append([]string(nil), certFiles...)
+	for _, keyFile := range keyFiles {
+		certFile := utils.ExpandHome(keyFile) + certSuffix
+		if _, err := os.Stat(certFile); err == nil {
+			paths = append(paths, certFile)
+		}
+	}
+
+	var result []ssh.Signer
+	seen := make(map[string]bool)
+	for _, path := range paths {
+		cert, err := loadCertificate(path)
+		if err != nil {
+			log.Warnf("%v", err)
+			continue
+		}
+		if seen[string(cert.Marshal())] {
+			continue
+		}
+		seen[string(cert.Marshal())] = true
+
+		var signer ssh.Signer
+		for _, sg := range signers {
+			if keyEqual(sg.PublicKey(), cert.Key) {
+				signer = sg
+				break
+			}
+		}
+		if signer == nil {
+			log.Warnf("证书 %s 没有对应的私钥，已忽略", path)
+			continue
+		}
+
+		certSigner, err := ssh.NewCertSigner(cert, signer)
+		if err != nil {
+			log.Warnf("无法使用证书 %s: %v", path, err)
+			continue
+		}
+		s.checkCertificate(cert, path, user)
+		result = append(result, certSigner)
+	}
+	return result
+}
+
+// checkCertificate 检查证书有效期和主体，问题只给出警告，由服务器做最终判断
+func (s *SSHClient) checkCertificate(cert *ssh.Certificate, path, user string) {
+	log := s.logger
+	now := time.Now()
+	const layout = "2006-01-02 15:04:05"
+
+	if cert.ValidAfter != 0 {
+		if after := time.Unix(int64(cert.ValidAfter), 0); now.Before(after) {
+			log.Warnf("证书 %s 尚未生效 (生效时间 %s)", path, after.Format(layout))
+		}
+	}
+	validUntil := "永久"
+	if cert.ValidBefore != ssh.CertTimeInfinity {
+		before := time.Unix(int64(cert.ValidBefore), 0)
+		if !now.Before(before) {
+			log.Warnf("证书 %s 已于 %s 过期", path, before.Format(layout))
+		}
+		validUntil = before.Format(layout)
+	}
+
+	if len(cert.ValidPrincipals) == 0 {
+		log.Debugf("使用证书 %s (KeyId %q, 有效期至 %s)，证书不限制主体，以 %s 登录", path, cert.KeyId, validUntil, user)
+		return
+	}
+	for _, p := range cert.ValidPrincipals {
+		if p == user {
+			log.Debugf("使用证书 %s (KeyId %q, 有效期至 %s)，主体 %s", path, cert.KeyId, validUntil, p)
+			return
+		}
+	}
+	log.Warnf("证书 %s 的主体 %v 不包含登录用户 %s，服务器可能拒绝该证书", path, cert.ValidPrincipals, user)
+}
@@ -0,0 +1,179 @@
+package proxy
+
+import (
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+
+	"github.com/Sesame2/gotun/internal/config"
+	"github.com/Sesame2/gotun/internal/logger"
+)
+
+// LocalForward 表示一条本地端口转发 (-L)，本地连接经 SSH 转发到固定的远端地址
+type LocalForward struct {
+	fwd      config.Forward
+	ssh      Dialer
+	logger   *logger.Logger
+	listener net.Listener
+	mu       sync.Mutex
+}
+
+// NewLocalForward 创建本地端口转发并开始监听，监听失败时直接返回错误
+func NewLocalForward(fwd config.Forward, log *logger.Logger, sshClient Dialer) (*LocalForward, error) {
+	l, err := net.Listen(fwd.ListenNet, fwd.ListenAddr)
+	if err != nil {
+		return nil, fmt.Errorf("本地转发 %s 监听失败: %w", fwd.Spec, err)
+	}
+	return &LocalForward{
+		fwd:      fwd,
+		ssh:      sshClient,
+		logger:   log,
+		listener: l,
+	}, nil
+}
+
+// String 返回 "监听地址 -> 目标地址" 形式的描述
+func (f *LocalForward) String() string {
+	return fmt.Sprintf("%s -> %s", f.fwd.ListenAddr, f.fwd.TargetAddr)
+}
+
+// Start 运行 accept 循环，直到 Close 被调用
+func (f *LocalForward) Start() error {
+	f.mu.Lock()
+	l := f.listener
+	f.mu.Unlock()
+	if l == nil {
+		return nil
+	}
+
+	f.logger.Infof("本地转发已启动: %s", f)
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			f.mu.Lock()
+			closing := f.listener == nil
+			f.mu.Unlock()
+
+			if closing {
+				return nil
+			}
+			f.logger.Errorf("本地转发 %s Accept 错误: %v", f.fwd.ListenAddr, err)
+			continue
+		}
+		go f.handleConnection(conn)
+	}
+}
+
+// handleConnection 将一个本地连接转发到远端
+func (f *LocalForward) handleConnection(conn net.Conn) {
+	start := time.Now()
+	clientAddr := conn.RemoteAddr().String()
+
+	remote, err := f.ssh.Dial(f.fwd.TargetNet, f.fwd.TargetAddr)
+	if err != nil {
+		f.logger.Warnf("[转发] %s 连接 %s 失败: %v", f.fwd.ListenAddr, f.fwd.TargetAddr, err)
+		conn.Close()
+		return
+	}
+	f.logger.Infof("[转发] %s -> %s (来自 %s)", f.fwd.ListenAddr, f.fwd.TargetAddr, clientAddr)
+
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go transfer(&wg, remote, conn, "local->forward", f.logger)
+	go transfer(&wg, conn, remote, "forward->local", f.logger)
+	wg.Wait()
+
+	f.logger.Debugf("[转发] 连接关闭: %s -> %s, 耗时: %v", clientAddr, f.fwd.TargetAddr, time.Since(start))
+}
+
+// Close 停止监听，已建立的连接不受影响
+func (f *LocalForward) Close() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.listener == nil {
+		return nil
+	}
+	err := f.listener.Close()
+	f.listener = nil
+	return err
+}
+
+// startRemoteForwards 在目标服务器上建立所有远程端口转发 (-R) 的监听。
+// 监听随链路一起关闭，重连后由 connectChain 重新建立
+func (s *SSHClient) startRemoteForwards(client *ssh.Client) []net.Listener {
+	var listeners []net.Listener
+	for _, fwd := range s.remoteForwards {
+		addr := fwd.ListenAddr
+		if fwd.ListenNet == "tcp" {
+			// 未指定地址时监听所有地址，x/crypto 要求地址为 IP
+			if host, port, _ := net.SplitHostPort(addr); host == "" {
+				addr = net.JoinHostPort("0.0.0.0", port)
+			}
+		}
+
+		l, err := client.Listen(fwd.ListenNet, addr)
+		if err != nil {
+			s.logger.Warnf("远程转发 %s 监听失败: %v", fwd.Spec, err)
+			continue
+		}
+		target := fwd.TargetAddr
+		if fwd.Dynamic {
+			target = "SOCKS5"
+		}
+		if _, port, _ := net.SplitHostPort(addr); port == "0" {
+			s.logger.Infof("远程转发已建立: %s -> %s (服务器分配的端口: %s)", l.Addr(), target, portOf(l.Addr()))
+		} else {
+			s.logger.Infof("远程转发已建立: %s -> %s", l.Addr(), target)
+		}
+		listeners = append(listeners, l)
+
+		if fwd.Dynamic {
+			// 反向 SOCKS5: 协议处理与本地 SOCKS5 代理相同，只是目标在本地连接
+			socks := &SOCKS5OverSSH{cfg: s.cfg, logger: s.logger, ssh: s.reverseDialer, local: true}
+			go socks.Serve(l)
+		} else {
+			go s.serveRemoteForward(l, fwd)
+		}
+	}
+	return listeners
+}
+
+// serveRemoteForward 接受远端连接并转发到本地目标，监听关闭时返回
+func (s *SSHClient) serveRemoteForward(l net.Listener, fwd config.Forward) {
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			s.logger.Debugf("远程转发 %s 已停止: %v", l.Addr(), err)
+			return
+		}
+		go func() {
+			start := time.Now()
+			local, err := net.DialTimeout(fwd.TargetNet, fwd.TargetAddr, s.cfg.Timeout)
+			if err != nil {
+				s.logger.Warnf("[远程转发] %s 连接本地 %s 失败: %v", l.Addr(), fwd.TargetAddr, err)
+				conn.Close()
+				return
+			}
+			s.logger.Infof("[远程转发] %s -> %s (来自 %s)", l.Addr(), fwd.TargetAddr, conn.RemoteAddr())
+
+			var wg sync.WaitGroup
+			wg.Add(2)
+			go transfer(&wg, local, conn, "remote->local", s.logger)
+			go transfer(&wg, conn, local, "local->remote", s.logger)
+			wg.Wait()
+
+			s.logger.Debugf("[远程转发] 连接关闭: %s -> %s, 耗时: %v", l.Addr(), fwd.TargetAddr, time.Since(start))
+		}()
+	}
+}
+
+func portOf(addr net.Addr) string {
+	if _, port, err := net.SplitHostPort(addr.String()); err == nil {
+		return port
+	}
+	return addr.String()
+}
@@ -0,0 +1,271 @@
+package proxy
+
+import (
+	"crypto/ed25519"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+
+	"github.com/Sesame2/gotun/internal/logger"
+	"github.com/Sesame2/gotun/internal/utils"
+)
+
+// 主机密钥校验策略，取值与 OpenSSH 的 StrictHostKeyChecking 保持一致
+const (
+	HostKeyCheckAsk       = "ask"        // 未知主机交互式确认 (默认)
+	HostKeyCheckYes       = "yes"        // 只信任 known_hosts 中已有的主机
+	HostKeyCheckAcceptNew = "accept-new" // 未知主机自动信任并写入 known_hosts
+	HostKeyCheckNo        = "no"         // 不校验 (不安全)
+)
+
+// hostKeyChecker 基于 known_hosts 校验每一跳的主机密钥
+type hostKeyChecker struct {
+	mode      string
+	files     []string // 读取的 known_hosts 文件
+	writeFile string   // 新主机写入的文件
+	noPrompt  bool     // 后台建立的连接不询问，ask 策略下的未知主机直接拒绝
+	logger    *logger.Logger
+
+	mu       sync.Mutex
+	callback ssh.HostKeyCallback
+	accepted map[string][]ssh.PublicKey // 本次运行中已确认的主机 (写文件失败时兜底)
+}
+
+// newHostKeyChecker 根据配置创建主机密钥校验器
+func newHostKeyChecker(mode, knownHostsFile string, log *logger.Logger) (*hostKeyChecker, error) {
+	switch mode {
+	case "":
+		mode = HostKeyCheckAsk
+	case HostKeyCheckAsk, HostKeyCheckYes, HostKeyCheckAcceptNew, HostKeyCheckNo:
+	default:
+		return nil, fmt.Errorf("无效的主机密钥校验策略: %s (可选: ask, yes, accept-new, no)", mode)
+	}
+
+	h := &hostKeyChecker{
+		mode:     mode,
+		logger:   log,
+		accepted: make(map[string][]ssh.PublicKey),
+	}
+	if mode == HostKeyCheckNo {
+		log.Warn("已关闭主机密钥校验，连接可能遭受中间人攻击")
+		return h, nil
+	}
+
+	if home, err := os.UserHomeDir(); err == nil {
+		h.writeFile = filepath.Join(home, ".ssh", "known_hosts")
+		h.files = append(h.files, h.writeFile)
+	}
+	if knownHostsFile != "" {
+		expanded := utils.ExpandHome(knownHostsFile)
+		h.files = append(h.files, expanded)
+		h.writeFile = expanded
+	}
+
+	if err := h.load(); err != nil {
+		return nil, err
+	}
+	return h, nil
+}
+
+// load (重新)读取所有存在的 known_hosts 文件
+func (h *hostKeyChecker) load() error {
+	var existing []string
+	for _, f := range h.files {
+		if _, err := os.Stat(f); err == nil {
+			existing = append(existing, f)
+		}
+	}
+	cb, err := knownhosts.New(existing...)
+	if err != nil {
+		return fmt.Errorf("读取 known_hosts 失败: %w", err)
+	}
+	h.logger.Debugf("已加载 known_hosts: %v", existing)
+	h.callback = cb
+	return nil
+}
+
+// hostKeyError 表示主机密钥校验失败，此时不应再尝试其它认证方式
+type hostKeyError struct {
+	err error
+}
+
+func (e *hostKeyError) Error() string { return e.err.Error() }
+func (e *hostKeyError) Unwrap() error { return e.err }
+
+// isHostKeyError 判断连接错误是否由主机密钥校验失败引起
+func isHostKeyError(err error) bool {
+	var hkErr *hostKeyError
+	return errors.As(err, &hkErr)
+}
+
+// check 实现 ssh.HostKeyCallback，hostname 为当前这一跳的 host:port
+func (h *hostKeyChecker) check(hostname string, remote net.Addr, key ssh.PublicKey) error {
+	if h.mode == HostKeyCheckNo {
+		return nil
+	}
+	if err := h.verify(hostname, remote, key); err != nil {
+		return &hostKeyError{err: err}
+	}
+	return nil
+}
+
+// verify 在 known_hosts 及本次运行已确认的主机中查找密钥，未知主机按策略处理
+func (h *hostKeyChecker) verify(hostname string, remote net.Addr, key ssh.PublicKey) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	for _, k := range h.accepted[knownhosts.Normalize(hostname)] {
+		if keyEqual(k, key) {
+			return nil
+		}
+	}
+
+	err := h.callback(hostname, remote, key)
+	if err == nil {
+		h.logger.Debugf("主机密钥校验通过: %s (%s)", hostname, ssh.FingerprintSHA256(key))
+		return nil
+	}
+
+	var revokedErr *knownhosts.RevokedError
+	if errors.As(err, &revokedErr) {
+		return fmt.Errorf("主机 %s 的密钥已被吊销 (%s)", hostname, revokedErr.Revoked.String())
+	}
+
+	var keyErr *knownhosts.KeyError
+	if !errors.As(err, &keyErr) {
+		// 例如证书不是由 @cert-authority 中的 CA 签发
+		return fmt.Errorf("主机 %s 的密钥校验失败: %w", hostname, err)
+	}
+	if len(keyErr.Want) > 0 {
+		return h.mismatchError(hostname, key, keyErr.Want)
+	}
+
+	// 未知主机: 按策略处理
+	fingerprint := ssh.FingerprintSHA256(key)
+	switch h.mode {
+	case HostKeyCheckYes:
+		return fmt.Errorf("主机 %s 不在 known_hosts 中 (%s 密钥指纹 %s)，可使用 --host-key-check=accept-new 或先用 ssh 登录一次", hostname, key.Type(), fingerprint)
+	case HostKeyCheckAsk:
+		if h.noPrompt || !utils.IsTerminal() {
+			return fmt.Errorf("主机 %s 不在 known_hosts 中且当前无法在终端上确认 (%s 密钥指纹 %s)", hostname, key.Type(), fingerprint)
+		}
+		prompt := fmt.Sprintf("无法确认主机 '%s' 的真实性。\n%s 密钥指纹为 %s。\n确定要继续连接吗 (yes/no)? ", hostname, key.Type(), fingerprint)
+		promptMu.Lock()
+		ok, err := utils.Confirm(prompt)
+		promptMu.Unlock()
+		if err != nil {
+			return err
+		}
+		if !ok {
+			return fmt.Errorf("用户拒绝了主机 %s 的密钥", hostname)
+		}
+	}
+
+	h.accept(hostname, key)
+	return nil
+}
+
+// accept 记住新主机并写入 known_hosts
+func (h *hostKeyChecker) accept(hostname string, key ssh.PublicKey) {
+	normalized := knownhosts.Normalize(hostname)
+	h.accepted[normalized] = append(h.accepted[normalized], key)
+
+	if h.writeFile == "" {
+		return
+	}
+	if err := os.MkdirAll(filepath.Dir(h.writeFile), 0700); err != nil {
+		h.logger.Warnf("无法创建 known_hosts 目录: %v", err)
+		return
+	}
+	f, err := os.OpenFile(h.writeFile, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		h.logger.Warnf("无法写入 known_hosts: %v", err)
+		return
+	}
+	defer f.Close()
+
+	if _, err := fmt.Fprintln(f, knownhosts.Line([]string{hostname}, key)); err != nil {
+		h.logger.Warnf("写入 known_hosts 失败: %v", err)
+		return
+	}
+	h.logger.Infof("已将主机 '%s' (%s) 永久添加到 %s", normalized, key.Type(), h.writeFile)
+}
+
+// mismatchError 生成主机密钥不匹配的错误
+func (h *hostKeyChecker) mismatchError(hostname string, key ssh.PublicKey, want []knownhosts.KnownKey) error {
+	var known []string
+	for _, w := range want {
+		known = append(known, fmt.Sprintf("%s:%d (%s)", w.Filename, w.Line, w.Key.Type()))
+	}
+	h.logger.Errorf("@@@ 警告: 主机 %s 的密钥已改变! 可能正在遭受中间人攻击 @@@", hostname)
+	h.logger.Errorf("服务器提供的 %s 密钥指纹为 %s", key.Type(), ssh.FingerprintSHA256(key))
+	h.logger.Errorf("known_hosts 中的记录: %s", strings.Join(known, ", "))
+	return fmt.Errorf("主机 %s 的密钥与 known_hosts 不匹配，已拒绝连接", hostname)
+}
+
+// algorithms 返回优先使用 known_hosts 中已知密钥类型的主机密钥算法列表，
+// 避免服务器协商出其它类型的密钥而被误判为不匹配
+func (h *hostKeyChecker) algorithms(hostname string) []string {
+	if h.mode == HostKeyCheckNo {
+		return nil
+	}
+
+	// 用一个临时密钥查询数据库，从 KeyError 中取出已知的密钥
+	pub, _, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		return nil
+	}
+	probe, err := ssh.NewPublicKey(pub)
+	if err != nil {
+		return nil
+	}
+
+	h.mu.Lock()
+	err = h.callback(hostname, &net.TCPAddr{IP: net.IPv4zero}, probe)
+	h.mu.Unlock()
+
+	var keyErr *knownhosts.KeyError
+	if !errors.As(err, &keyErr) {
+		return nil
+	}
+
+	var algos []string
+	seen := make(map[string]bool)
+	for _, w := range keyErr.Want {
+		for _, algo := range keyAlgorithms(w.Key.Type()) {
+			if !seen[algo] {
+				seen[algo] = true
+				algos = append(algos, algo)
+			}
+		}
+	}
+	if len(algos) == 0 {
+		return nil
+	}
+	// 其余算法放在后面，仅调整优先级而不限制协商范围
+	for _, algo := range ssh.SupportedAlgorithms().HostKeys {
+		if !seen[algo] {
+			algos = append(algos, algo)
+		}
+	}
+	return algos
+}
+
+// keyAlgorithms 将密钥类型映射为可用于签名的主机密钥算法
+func keyAlgorithms(keyType string) []string {
+	if keyType == ssh.KeyAlgoRSA {
+		return []string{ssh.KeyAlgoRSASHA512, ssh.KeyAlgoRSASHA256}
+	}
+	return []string{keyType}
+}
+
+func keyEqual(a, b ssh.PublicKey) bool {
+	return a.Type() == b.Type() && string(a.Marshal()) == string(b.Marshal())
+}
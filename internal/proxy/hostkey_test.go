@@ -0,0 +1,240 @@
+package proxy
+
+import (
+	"crypto/rand"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+
+	"github.com/Sesame2/gotun/internal/logger"
+)
+
+// writeKnownHosts 把若干行写入临时的 known_hosts 文件
+func writeKnownHosts(t *testing.T, lines ...string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "known_hosts")
+	if err := os.WriteFile(path, []byte(strings.Join(lines, "\n")+"\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+// hashedLine 返回使用散列主机名的 known_hosts 行 (ssh-keygen -H 的格式)
+func hashedLine(addr string, key ssh.PublicKey) string {
+	return knownhosts.HashHostname(knownhosts.Normalize(addr)) + " " + string(ssh.MarshalAuthorizedKey(key))
+}
+
+// newCertSigner 返回由 ca 签发、适用于 127.0.0.1 的主机证书
+func newCertSigner(t *testing.T, ca ssh.Signer) ssh.Signer {
+	t.Helper()
+	host := newTestSigner(t)
+	cert := &ssh.Certificate{
+		Key:             host.PublicKey(),
+		CertType:        ssh.HostCert,
+		ValidPrincipals: []string{"127.0.0.1"},
+		ValidBefore:     ssh.CertTimeInfinity,
+	}
+	if err := cert.SignCert(rand.Reader, ca); err != nil {
+		t.Fatal(err)
+	}
+	signer, err := ssh.NewCertSigner(cert, host)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signer
+}
+
+func TestHostKeyCheck(t *testing.T) {
+	plain := startTestSSHServer(t)
+	ca := newTestSigner(t)
+	certified := startTestSSHServerWithKey(t, newCertSigner(t, ca))
+	other := newTestSigner(t).PublicKey()
+
+	tests := []struct {
+		name   string
+		server *testSSHServer
+		lines  []string
+		ok     bool
+		want   string
+	}{
+		{
+			name:   "已知主机",
+			server: plain,
+			lines:  []string{knownhosts.Line([]string{plain.addr}, plain.hostKey.PublicKey())},
+			ok:     true,
+		},
+		{
+			name:   "散列的主机名",
+			server: plain,
+			lines:  []string{hashedLine(plain.addr, plain.hostKey.PublicKey())},
+			ok:     true,
+		},
+		{
+			name:   "cert-authority",
+			server: certified,
+			lines:  []string{"@cert-authority " + knownhosts.Line([]string{certified.addr}, ca.PublicKey())},
+			ok:     true,
+		},
+		{
+			name:   "其它 CA 签发的证书",
+			server: certified,
+			lines:  []string{"@cert-authority " + knownhosts.Line([]string{certified.addr}, other)},
+			want:   "校验失败",
+		},
+		{
+			name:   "密钥不匹配",
+			server: plain,
+			lines:  []string{knownhosts.Line([]string{plain.addr}, other)},
+			want:   "不匹配",
+		},
+		{
+			name:   "散列的主机名密钥不匹配",
+			server: plain,
+			lines:  []string{hashedLine(plain.addr, other)},
+			want:   "不匹配",
+		},
+		{
+			name:   "未知主机",
+			server: plain,
+			lines:  []string{"# 空"},
+			want:   "不在 known_hosts 中",
+		},
+	}
+	for _, tt := range tests {
+		cfg := testClientConfig(t, tt.server.addr)
+		cfg.HostKeyCheck = HostKeyCheckYes
+		cfg.KnownHostsFile = writeKnownHosts(t, tt.lines...)
+
+		c, err := newSSHClient(cfg, logger.NewLogger(false), nil)
+		if tt.ok {
+			if err != nil {
+				t.Errorf("%s: 连接失败: %v", tt.name, err)
+			} else {
+				c.Close()
+			}
+			continue
+		}
+		if err == nil {
+			c.Close()
+			t.Errorf("%s: 连接应失败", tt.name)
+			continue
+		}
+		if !isHostKeyError(err) || !strings.Contains(err.Error(), tt.want) {
+			t.Errorf("%s: 错误 = %v, 期望包含 %q 的主机密钥错误", tt.name, err, tt.want)
+		}
+	}
+}
+
+// TestHostKeyMismatchAcceptNew 确认 accept-new 只信任未知主机，密钥改变时仍然拒绝
+func TestHostKeyMismatchAcceptNew(t *testing.T) {
+	srv := startTestSSHServer(t)
+	cfg := testClientConfig(t, srv.addr)
+	cfg.HostKeyCheck = HostKeyCheckAcceptNew
+	cfg.KnownHostsFile = writeKnownHosts(t, knownhosts.Line([]string{srv.addr}, newTestSigner(t).PublicKey()))
+	before, _ := os.ReadFile(cfg.KnownHostsFile)
+
+	c, err := newSSHClient(cfg, logger.NewLogger(false), nil)
+	if err == nil {
+		c.Close()
+		t.Fatal("密钥改变时连接应失败")
+	}
+	if !isHostKeyError(err) {
+		t.Errorf("错误 = %v, 期望主机密钥错误", err)
+	}
+	if got := srv.auths.Load(); got != 0 {
+		t.Errorf("密钥不匹配后仍进行了 %d 次认证", got)
+	}
+	if after, _ := os.ReadFile(cfg.KnownHostsFile); string(after) != string(before) {
+		t.Errorf("known_hosts 被修改:\n%s", after)
+	}
+}
+
+func TestHostKeyAcceptNew(t *testing.T) {
+	srv := startTestSSHServer(t)
+	cfg := testClientConfig(t, srv.addr)
+	cfg.HostKeyCheck = HostKeyCheckAcceptNew
+	cfg.KnownHostsFile = filepath.Join(t.TempDir(), "ssh", "known_hosts")
+
+	newTestSSHClient(t, cfg)
+	data, err := os.ReadFile(cfg.KnownHostsFile)
+	if err != nil {
+		t.Fatalf("新主机未写入 --known-hosts 文件: %v", err)
+	}
+	want := knownhosts.Line([]string{srv.addr}, srv.hostKey.PublicKey())
+	if strings.TrimSpace(string(data)) != want {
+		t.Errorf("known_hosts 内容 = %q, 期望 %q", data, want)
+	}
+	home, _ := os.UserHomeDir()
+	if _, err := os.Stat(filepath.Join(home, ".ssh", "known_hosts")); !os.IsNotExist(err) {
+		t.Errorf("指定 --known-hosts 时不应写入 ~/.ssh/known_hosts: %v", err)
+	}
+
+	// 写入的记录可以直接用于严格校验
+	cfg.HostKeyCheck = HostKeyCheckYes
+	newTestSSHClient(t, cfg)
+}
+
+// TestHostKeyJumpHops 确认 -J 的每一跳都用自己的地址单独校验
+func TestHostKeyJumpHops(t *testing.T) {
+	jump := startTestSSHServer(t)
+	target := startTestSSHServer(t)
+	jumpLine := knownhosts.Line([]string{jump.addr}, jump.hostKey.PublicKey())
+	targetLine := knownhosts.Line([]string{target.addr}, target.hostKey.PublicKey())
+	// 跳板机的密钥记在目标地址下，不能让目标通过校验
+	swapped := knownhosts.Line([]string{target.addr}, jump.hostKey.PublicKey())
+
+	tests := []struct {
+		name  string
+		lines []string
+		fail  string // 校验失败的那一跳，为空表示应连接成功
+	}{
+		{name: "两跳都已知", lines: []string{jumpLine, targetLine}},
+		{name: "只知道目标", lines: []string{targetLine}, fail: jump.addr},
+		{name: "只知道跳板机", lines: []string{jumpLine}, fail: target.addr},
+		{name: "目标记录了跳板机的密钥", lines: []string{jumpLine, swapped}, fail: target.addr},
+	}
+	for _, tt := range tests {
+		cfg := testClientConfig(t, target.addr)
+		cfg.JumpHosts = []string{"test@" + jump.addr}
+		cfg.HostKeyCheck = HostKeyCheckYes
+		cfg.KnownHostsFile = writeKnownHosts(t, tt.lines...)
+
+		c, err := newSSHClient(cfg, logger.NewLogger(false), nil)
+		if tt.fail == "" {
+			if err != nil {
+				t.Errorf("%s: 连接失败: %v", tt.name, err)
+			} else {
+				c.Close()
+			}
+			continue
+		}
+		if err == nil {
+			c.Close()
+			t.Errorf("%s: 连接应失败", tt.name)
+			continue
+		}
+		if !isHostKeyError(err) || !strings.Contains(err.Error(), tt.fail) {
+			t.Errorf("%s: 错误 = %v, 期望 %s 的主机密钥错误", tt.name, err, tt.fail)
+		}
+	}
+
+	// accept-new 为每一跳分别写入记录
+	cfg := testClientConfig(t, target.addr)
+	cfg.JumpHosts = []string{"test@" + jump.addr}
+	cfg.HostKeyCheck = HostKeyCheckAcceptNew
+	cfg.KnownHostsFile = filepath.Join(t.TempDir(), "known_hosts")
+	newTestSSHClient(t, cfg)
+	data, err := os.ReadFile(cfg.KnownHostsFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, line := range []string{jumpLine, targetLine} {
+		if !strings.Contains(string(data), line) {
+			t.Errorf("known_hosts 中缺少 %q", line)
+		}
+	}
+}
@@ -3,6 +3,7 @@ package proxy
 import (
 	"bufio"
 	"context"
+	"fmt"
 	"io"
 	"net"
 	"net/http"
@@ -18,14 +19,14 @@ import (
 // HTTPOverSSH 表示基于SSH的HTTP代理
 type HTTPOverSSH struct {
 	cfg    *config.Config
-	ssh    *SSHClient
+	ssh    Dialer
 	logger *logger.Logger
 	server *http.Server
 	router *router.Router
 }
 
 // NewHTTPOverSSH 创建HTTP代理
-func NewHTTPOverSSH(cfg *config.Config, log *logger.Logger, sshClient *SSHClient, r *router.Router) (*HTTPOverSSH, error) {
+func NewHTTPOverSSH(cfg *config.Config, log *logger.Logger, sshClient Dialer, r *router.Router) (*HTTPOverSSH, error) {
 	log.Info("初始化HTTP-over-SSH代理")
 
 	proxy := &HTTPOverSSH{
@@ -67,14 +68,19 @@ func (p *HTTPOverSSH) handlePlainHTTP(w http.ResponseWriter, req *http.Request)
 	startTime := time.Now()
 
 	// 路由判断
+	var outbound string
 	if p.router != nil {
-		action := p.router.Match(req.Host)
-		if action == router.ActionDirect {
-			p.logger.Infof("规则匹配: %s -> DIRECT", req.Host)
+		result := p.evaluate(req, 80)
+		if result.Action.IsReject() {
+			p.reject(w, req, result)
+			return
+		}
+		p.logger.Infof("规则匹配: %s -> %s (%s)", req.Host, result.Target(), result)
+		outbound = result.Outbound
+		if result.Action == router.ActionDirect {
 			p.handleDirect(w, req)
 			return
 		}
-		p.logger.Infof("规则匹配: %s -> PROXY", req.Host)
 	}
 
 	if !req.URL.IsAbs() {
@@ -96,7 +102,7 @@ func (p *HTTPOverSSH) handlePlainHTTP(w http.ResponseWriter, req *http.Request)
 		targetAddr += ":80"
 	}
 
-	conn, err := p.ssh.client.Dial("tcp", targetAddr)
+	conn, err := dialOutbound(p.ssh, outbound, "tcp", targetAddr)
 	if err != nil {
 		p.logger.Errorf("无法通过SSH连接到目标 %s: %v", targetAddr, err)
 		http.Error(w, "无法通过SSH连接到目标", http.StatusBadGateway)
@@ -141,14 +147,19 @@ func (p *HTTPOverSSH) handleHTTPSConnect(w http.ResponseWriter, req *http.Reques
 	startTime := time.Now()
 
 	// 路由判断
+	var outbound string
 	if p.router != nil {
-		action := p.router.Match(req.Host)
-		if action == router.ActionDirect {
-			p.logger.Infof("规则匹配: %s -> DIRECT (CONNECT)", req.Host)
+		result := p.evaluate(req, 443)
+		if result.Action.IsReject() {
+			p.reject(w, req, result)
+			return
+		}
+		p.logger.Infof("规则匹配: %s -> %s (CONNECT, %s)", req.Host, result.Target(), result)
+		outbound = result.Outbound
+		if result.Action == router.ActionDirect {
 			p.handleDirectConnect(w, req)
 			return
 		}
-		p.logger.Infof("规则匹配: %s -> PROXY (CONNECT)", req.Host)
 	}
 
 	p.logger.Infof("HTTPS CONNECT 请求: %s", req.Host)
@@ -158,7 +169,7 @@ func (p *HTTPOverSSH) handleHTTPSConnect(w http.ResponseWriter, req *http.Reques
 		targetAddr = targetAddr + ":443"
 	}
 
-	sshConn, err := p.ssh.client.Dial("tcp", targetAddr)
+	sshConn, err := dialOutbound(p.ssh, outbound, "tcp", targetAddr)
 	if err != nil {
 		p.logger.Errorf("无法通过SSH连接到HTTPS目标 %s: %v", targetAddr, err)
 		http.Error(w, "无法通过SSH连接到HTTPS目标", http.StatusBadGateway)
@@ -209,6 +220,36 @@ func (p *HTTPOverSSH) Close() error {
 	return err
 }
 
+// evaluate 按请求的目标、端口和客户端地址匹配规则，Host 中没有端口时使用 defaultPort
+func (p *HTTPOverSSH) evaluate(req *http.Request, defaultPort int) router.MatchResult {
+	r := router.Request{
+		Host:    req.Host,
+		Source:  req.RemoteAddr,
+		Network: "tcp",
+		Inbound: "http",
+	}
+	if _, _, err := net.SplitHostPort(req.Host); err != nil {
+		r.Port = defaultPort
+	}
+	return p.router.EvaluateRequest(r)
+}
+
+// reject 按规则拒绝请求: REJECT 返回 403 并在响应中说明命中的规则，
+// REJECT-DROP 不作任何响应直接关闭连接
+func (p *HTTPOverSSH) reject(w http.ResponseWriter, req *http.Request, result router.MatchResult) {
+	p.logger.Infof("规则匹配: %s -> %s (%s)", req.Host, result.Action, result)
+
+	if result.Action == router.ActionRejectDrop {
+		if hijacker, ok := w.(http.Hijacker); ok {
+			if conn, _, err := hijacker.Hijack(); err == nil {
+				conn.Close()
+				return
+			}
+		}
+	}
+	http.Error(w, fmt.Sprintf("gotun: 访问 %s 被规则 %s 拒绝", req.Host, result), http.StatusForbidden)
+}
+
 // --- 新增的直连处理函数 ---
 
 // handleDirect 处理直连的HTTP请求
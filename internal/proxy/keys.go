@@ -0,0 +1,169 @@
+package proxy
+
+import (
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+
+	"golang.org/x/crypto/ssh"
+
+	"github.com/Sesame2/gotun/internal/logger"
+	"github.com/Sesame2/gotun/internal/utils"
+)
+
+// KeyPassphraseEnv 用于无人值守运行时提供私钥密码的环境变量
+const KeyPassphraseEnv = "GOTUN_KEY_PASSPHRASE"
+
+// 交互式输入私钥密码的最大尝试次数
+const maxPassphraseAttempts = 3
+
+// keyStore 缓存已加载的私钥，跳板机和目标主机使用同一私钥时只需解密一次。
+// 私钥密码的来源由每次加载的调用方给出，多个上游或出站可以各自指定密码文件
+type keyStore struct {
+	logger *logger.Logger
+
+	mu      sync.Mutex
+	signers map[string]ssh.Signer
+	failed  map[failedKey]error // 解密失败的私钥不再用同一密码来源重复尝试
+}
+
+// failedKey 标识一次解密失败: 换一个密码文件后仍可以重新尝试
+type failedKey struct {
+	path           string
+	passphraseFile string
+}
+
+func newKeyStore(log *logger.Logger) *keyStore {
+	return &keyStore{
+		logger:  log,
+		signers: make(map[string]ssh.Signer),
+		failed:  make(map[failedKey]error),
+	}
+}
+
+// errNoPrompt 表示私钥需要密码，但本次加载不允许在终端上询问
+var errNoPrompt = errors.New("后台连接不在终端上询问私钥密码")
+
+// load 加载私钥，优先返回缓存。私钥受密码保护时依次从 passphraseFile、环境变量和终端获取密码，
+// prompt 为 false 时不在终端上询问
+func (k *keyStore) load(path, passphraseFile string, prompt bool) (ssh.Signer, error) {
+	expanded := utils.ExpandHome(path)
+
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	if signer, ok := k.signers[expanded]; ok {
+		k.logger.Debugf("使用已缓存的私钥: %s", expanded)
+		return signer, nil
+	}
+	failed := failedKey{path: expanded, passphraseFile: passphraseFile}
+	if err, ok := k.failed[failed]; ok {
+		return nil, err
+	}
+
+	signer, err := loadPrivateKey(expanded, func(path string, attempt int) ([]byte, error) {
+		return k.passphrase(path, passphraseFile, attempt, prompt)
+	})
+	if err != nil {
+		// 文件不存在等错误不缓存，只缓存需要用户参与的解密失败；
+		// 没有询问过用户时之后仍可以询问
+		var passErr *passphraseError
+		if errors.As(err, &passErr) && !errors.Is(err, errNoPrompt) {
+			k.failed[failed] = err
+		}
+		return nil, err
+	}
+	k.signers[expanded] = signer
+	return signer, nil
+}
+
+// passphrase 依次从密码文件、环境变量和终端获取私钥密码，attempt 从 1 开始
+func (k *keyStore) passphrase(path, passphraseFile string, attempt int, prompt bool) ([]byte, error) {
+	if passphraseFile != "" {
+		if attempt > 1 {
+			return nil, fmt.Errorf("密码文件 '%s' 中的密码无法解密私钥", passphraseFile)
+		}
+		data, err := os.ReadFile(utils.ExpandHome(passphraseFile))
+		if err != nil {
+			return nil, fmt.Errorf("读取私钥密码文件失败: %v", err)
+		}
+		return []byte(strings.TrimRight(string(data), "\r\n")), nil
+	}
+
+	if env, ok := os.LookupEnv(KeyPassphraseEnv); ok {
+		if attempt > 1 {
+			return nil, fmt.Errorf("环境变量 %s 中的密码无法解密私钥", KeyPassphraseEnv)
+		}
+		return []byte(env), nil
+	}
+
+	if !prompt {
+		return nil, errNoPrompt
+	}
+	if !utils.IsTerminal() {
+		return nil, fmt.Errorf("私钥受密码保护，但当前不是交互式终端 (可使用 --key-passphrase-file 或环境变量 %s)", KeyPassphraseEnv)
+	}
+	if attempt > maxPassphraseAttempts {
+		return nil, fmt.Errorf("私钥密码错误次数过多")
+	}
+	if attempt > 1 {
+		fmt.Println("密码错误，请重试。")
+	}
+	promptMu.Lock()
+	defer promptMu.Unlock()
+	pass, err := utils.ReadPasswordFromTerminal(fmt.Sprintf("请输入私钥 '%s' 的密码：", path))
+	if err != nil {
+		return nil, err
+	}
+	if pass == "" {
+		return nil, fmt.Errorf("未输入密码，跳过该私钥")
+	}
+	return []byte(pass), nil
+}
+
+// passphraseError 表示私钥因缺少或错误的密码而无法解密
+type passphraseError struct {
+	path string
+	err  error
+}
+
+func (e *passphraseError) Error() string {
+	return fmt.Sprintf("私钥 '%s' 受密码保护，解密失败: %v", e.path, e.err)
+}
+
+func (e *passphraseError) Unwrap() error { return e.err }
+
+// loadPrivateKey 读取并解析私钥文件，私钥受密码保护时通过 passphrase 获取密码
+func loadPrivateKey(path string, passphrase func(path string, attempt int) ([]byte, error)) (ssh.Signer, error) {
+	key, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("读取私钥文件 '%s' 失败: %v", path, err)
+	}
+
+	signer, err := ssh.ParsePrivateKey(key)
+	if err == nil {
+		return signer, nil
+	}
+
+	var missing *ssh.PassphraseMissingError
+	if !errors.As(err, &missing) {
+		return nil, fmt.Errorf("解析私钥文件 '%s' 失败: %v", path, err)
+	}
+
+	for attempt := 1; ; attempt++ {
+		pass, err := passphrase(path, attempt)
+		if err != nil {
+			return nil, &passphraseError{path: path, err: err}
+		}
+		signer, err := ssh.ParsePrivateKeyWithPassphrase(key, pass)
+		if err == nil {
+			return signer, nil
+		}
+		if !errors.Is(err, x509.IncorrectPasswordError) {
+			return nil, fmt.Errorf("解析私钥文件 '%s' 失败: %v", path, err)
+		}
+	}
+}
@@ -0,0 +1,52 @@
+package proxy
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/pem"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"golang.org/x/crypto/ssh"
+
+	"github.com/Sesame2/gotun/internal/logger"
+)
+
+// TestKeyStorePassphraseFile 确认各上游使用自己的私钥密码文件，
+// 一个上游的密码错误不影响另一个上游解密同一私钥
+func TestKeyStorePassphraseFile(t *testing.T) {
+	dir := t.TempDir()
+	_, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	block, err := ssh.MarshalPrivateKeyWithPassphrase(priv, "", []byte("right"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	key := filepath.Join(dir, "id_ed25519")
+	wrong := filepath.Join(dir, "wrong")
+	right := filepath.Join(dir, "right")
+	for path, data := range map[string][]byte{
+		key:   pem.EncodeToMemory(block),
+		wrong: []byte("wrong\n"),
+		right: []byte("right\n"),
+	} {
+		if err := os.WriteFile(path, data, 0o600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	k := newKeyStore(logger.NewLogger(false))
+	if _, err := k.load(key, wrong, false); err == nil {
+		t.Fatal("密码错误时加载应失败")
+	}
+	signer, err := k.load(key, right, false)
+	if err != nil {
+		t.Fatalf("使用正确的密码文件加载失败: %v", err)
+	}
+	if again, err := k.load(key, "", false); err != nil || again != signer {
+		t.Errorf("解密后的私钥应被缓存, err = %v", err)
+	}
+}
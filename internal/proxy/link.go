@@ -0,0 +1,319 @@
+package proxy
+
+import (
+	"fmt"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// 重连退避的初始间隔和上限
+const (
+	minReconnectBackoff = time.Second
+	maxReconnectBackoff = time.Minute
+)
+
+// sshChain 是一次完整建立的链路: 所有跳板机连接加上目标服务器连接
+type sshChain struct {
+	client   *ssh.Client    // 这个是最终目标机器的连接
+	jumps    []*ssh.Client  // 这里存储所有跳板机的连接
+	agentFwd *ssh.Session   // 保持 ssh-agent 转发的会话
+	remote   []net.Listener // 远程端口转发在目标服务器上的监听
+	dead     chan struct{}  // 链路断开后关闭
+}
+
+// waitDead 等待链路断开，超时返回 false
+func (c *sshChain) waitDead(timeout time.Duration) bool {
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case <-c.dead:
+		return true
+	case <-timer.C:
+		return false
+	}
+}
+
+// close 关闭链路上的所有连接（逆序关闭跳板机）
+func (c *sshChain) close() {
+	if c.agentFwd != nil {
+		c.agentFwd.Close()
+	}
+	for _, l := range c.remote {
+		l.Close()
+	}
+	if c.client != nil {
+		c.client.Close()
+	}
+	for i := len(c.jumps) - 1; i >= 0; i-- {
+		c.jumps[i].Close()
+	}
+}
+
+// sshLink 维护一条到目标服务器的链路，检测到断开后按指数退避重建整条链路
+type sshLink struct {
+	owner  *SSHClient
+	id     int          // 在连接池中的编号，从 1 开始
+	active atomic.Int64 // 当前打开的通道数，用于负载均衡
+
+	mu     sync.Mutex
+	chain  *sshChain     // 重连期间为 nil
+	ready  chan struct{} // 链路可用时关闭
+	err    error         // 不再重连时的最终错误
+	down   error         // 最近一次断开或重连失败的原因，链路可用时为 nil
+	closed bool
+	done   chan struct{}
+}
+
+// newSSHLink 使用已建立的链路创建 sshLink 并开始监控，chain 为 nil 时立即开始重连
+func newSSHLink(owner *SSHClient, id int, chain *sshChain) *sshLink {
+	l := &sshLink{
+		owner: owner,
+		id:    id,
+		chain: chain,
+		ready: make(chan struct{}),
+		done:  make(chan struct{}),
+	}
+	if chain != nil {
+		close(l.ready)
+	}
+	go l.run(chain)
+	return l
+}
+
+// run 监控链路，断开后重连，直到 sshLink 被关闭
+func (l *sshLink) run(chain *sshChain) {
+	log := l.owner.logger
+	if chain == nil {
+		if chain = l.reconnect(); chain == nil {
+			return
+		}
+	}
+	for {
+		if interval := l.owner.cfg.KeepAliveInterval; interval > 0 {
+			go l.keepAlive(chain, interval, l.owner.cfg.KeepAliveCountMax)
+		}
+
+		err := chain.client.Wait()
+		close(chain.dead)
+
+		l.mu.Lock()
+		if l.closed {
+			l.mu.Unlock()
+			return
+		}
+		l.chain = nil
+		l.ready = make(chan struct{})
+		l.down = fmt.Errorf("SSH 连接已断开: %v", err)
+		l.mu.Unlock()
+		chain.close()
+
+		if !l.owner.cfg.Reconnect {
+			log.Errorf("SSH 连接 %s 已断开: %v", l.name(), err)
+			l.fail(fmt.Errorf("SSH 连接已断开: %v", err))
+			return
+		}
+		log.Warnf("SSH 连接 %s 已断开: %v，开始重连", l.name(), err)
+
+		chain = l.reconnect()
+		if chain == nil {
+			return
+		}
+	}
+}
+
+// reconnect 按指数退避重建链路，sshLink 被关闭或遇到无法恢复的错误时返回 nil
+func (l *sshLink) reconnect() *sshChain {
+	log := l.owner.logger
+	backoff := minReconnectBackoff
+	for attempt := 1; ; attempt++ {
+		chain, err := l.owner.connectChain(l.id == 1)
+		if err == nil {
+			l.mu.Lock()
+			if l.closed {
+				l.mu.Unlock()
+				chain.close()
+				return nil
+			}
+			l.chain = chain
+			l.down = nil
+			close(l.ready)
+			l.mu.Unlock()
+			log.Infof("SSH 连接 %s 重连成功 (第 %d 次尝试)", l.name(), attempt)
+			return chain
+		}
+
+		// 主机密钥不匹配时重试没有意义，且可能正遭受攻击
+		if isHostKeyError(err) {
+			log.Errorf("重连时主机密钥校验失败，停止重连: %v", err)
+			l.fail(err)
+			return nil
+		}
+
+		l.mu.Lock()
+		l.down = err
+		l.mu.Unlock()
+		log.Warnf("SSH 连接 %s 第 %d 次重连失败: %v，%v 后重试", l.name(), attempt, err, backoff)
+		select {
+		case <-l.done:
+			return nil
+		case <-time.After(backoff):
+		}
+		backoff *= 2
+		if backoff > maxReconnectBackoff {
+			backoff = maxReconnectBackoff
+		}
+	}
+}
+
+// name 返回用于日志的连接名称: 服务器地址，连接池有多个连接时附加编号
+func (l *sshLink) name() string {
+	if l.owner.cfg.SSHConns <= 1 {
+		return l.owner.cfg.SSHServer
+	}
+	return fmt.Sprintf("%s #%d", l.owner.cfg.SSHServer, l.id)
+}
+
+// state 返回链路当前是否可用，以及是否已放弃重连
+func (l *sshLink) state() (ready, failed bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.chain != nil, l.err != nil || l.closed
+}
+
+// track 包装通过该链路打开的连接，关闭时减少活动通道计数
+func (l *sshLink) track(conn net.Conn) net.Conn {
+	l.active.Add(1)
+	return &trackedConn{Conn: conn, link: l}
+}
+
+type trackedConn struct {
+	net.Conn
+	link *sshLink
+	once sync.Once
+}
+
+func (c *trackedConn) Close() error {
+	c.once.Do(func() { c.link.active.Add(-1) })
+	return c.Conn.Close()
+}
+
+// fail 停止重连，之后的 Dial 直接返回 err
+func (l *sshLink) fail(err error) {
+	l.mu.Lock()
+	l.err = err
+	close(l.ready)
+	l.mu.Unlock()
+}
+
+// keepAlive 定期发送 keepalive@openssh.com 请求。连续 countMax 次没有响应时
+// 认为连接已失效并主动关闭，以触发重连 (例如休眠唤醒或切换网络后)
+func (l *sshLink) keepAlive(chain *sshChain, interval time.Duration, countMax int) {
+	log := l.owner.logger
+	if countMax <= 0 {
+		countMax = 1
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	missed := 0
+	for {
+		select {
+		case <-chain.dead:
+			return
+		case <-ticker.C:
+		}
+
+		result := make(chan error, 1)
+		go func() {
+			_, _, err := chain.client.SendRequest("keepalive@openssh.com", true, nil)
+			result <- err
+		}()
+
+		var err error
+		select {
+		case err = <-result:
+		case <-time.After(interval):
+			err = fmt.Errorf("等待响应超时")
+		case <-chain.dead:
+			return
+		}
+
+		if err == nil {
+			missed = 0
+			log.Debug("已发送 keepalive")
+			continue
+		}
+		missed++
+		log.Warnf("%s keepalive 失败 (%d/%d): %v", l.name(), missed, countMax, err)
+		if missed >= countMax {
+			log.Warnf("%s 连续 %d 次未响应 keepalive，关闭连接", l.name(), missed)
+			chain.client.Close()
+			return
+		}
+	}
+}
+
+// get 返回当前可用的链路，重连期间最多等待 timeout
+func (l *sshLink) get(timeout time.Duration) (*sshChain, error) {
+	l.mu.Lock()
+	if l.closed {
+		l.mu.Unlock()
+		return nil, fmt.Errorf("SSH 连接已关闭")
+	}
+	if l.err != nil {
+		err := l.err
+		l.mu.Unlock()
+		return nil, err
+	}
+	if l.chain != nil {
+		chain := l.chain
+		l.mu.Unlock()
+		return chain, nil
+	}
+	ready := l.ready
+	l.mu.Unlock()
+
+	l.owner.logger.Debug("SSH 正在重连，等待连接恢复")
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case <-ready:
+	case <-l.done:
+		return nil, fmt.Errorf("SSH 连接已关闭")
+	case <-timer.C:
+		return nil, fmt.Errorf("等待 SSH 重连超时 (%v)", timeout)
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.err != nil {
+		return nil, l.err
+	}
+	if l.chain == nil {
+		return nil, fmt.Errorf("SSH 连接不可用")
+	}
+	return l.chain, nil
+}
+
+// close 关闭链路并停止重连
+func (l *sshLink) close() {
+	l.mu.Lock()
+	if l.closed {
+		l.mu.Unlock()
+		return
+	}
+	l.closed = true
+	close(l.done)
+	chain := l.chain
+	l.chain = nil
+	l.mu.Unlock()
+
+	if chain != nil {
+		l.owner.logger.Debug("关闭目标SSH连接")
+		chain.close()
+	}
+}
@@ -0,0 +1,551 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"net"
+	"net/http"
+	"reflect"
+	"sort"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+
+	"github.com/Sesame2/gotun/internal/config"
+	"github.com/Sesame2/gotun/internal/logger"
+	"github.com/Sesame2/gotun/internal/router"
+)
+
+// Outbounds 按规则命中的出站名称选择 Dialer。PROXY 使用命令行指定的 SSH 连接，
+// DIRECT 直接连接，其余名称对应规则文件中 outbounds 和 proxy-groups 的定义。
+// 命名出站在第一次使用时才建立连接，规则文件重新加载后定义变化的出站会被重建，
+// 旧的出站在经由它的连接全部关闭后才关闭。
+// 建立失败后按指数退避，退避期间使用该出站的连接直接失败
+type Outbounds struct {
+	cfg    *config.Config
+	logger *logger.Logger
+	def    Dialer // PROXY
+	direct Dialer // DIRECT
+	router *router.Router
+	keys   *keyStore // 与命令行指定的 SSH 连接共用
+
+	// newSSH 按配置建立 SSH 出站，测试中替换为假的 Dialer
+	newSSH func(cfg *config.Config) (Dialer, error)
+
+	mu       sync.Mutex
+	entries  map[string]*outboundEntry
+	draining map[*outboundEntry]bool // 定义已变化、仍有连接在使用的旧出站
+	closed   bool
+}
+
+// outboundEntry 是一个已建立 (或正在建立、建立失败) 的命名出站
+type outboundEntry struct {
+	def    router.Outbound
+	ready  chan struct{} // 建立完成后关闭
+	dialer Dialer
+	err    error
+
+	// 以下字段在 ready 关闭前写入
+	background bool      // 由出站组的探测在后台建立，不在终端上询问
+	failures   int       // 连续建立失败的次数
+	retryAt    time.Time // 建立失败后，在此之前不再重试
+
+	// 以下字段由 Outbounds.mu 保护
+	conns   int  // 经由该出站尚未关闭的连接数
+	retired bool // 定义已变化，连接数降为 0 时关闭
+}
+
+// NewOutbounds 创建出站管理器，def 为 PROXY 使用的连接
+func NewOutbounds(cfg *config.Config, log *logger.Logger, def Dialer, r *router.Router) *Outbounds {
+	o := &Outbounds{
+		cfg:      cfg,
+		logger:   log,
+		def:      def,
+		direct:   &net.Dialer{Timeout: cfg.Timeout},
+		router:   r,
+		entries:  make(map[string]*outboundEntry),
+		draining: make(map[*outboundEntry]bool),
+	}
+	switch d := def.(type) {
+	case *SSHClient:
+		o.keys = d.keys
+	case *UpstreamGroup:
+		o.keys = d.keys
+	}
+	if o.keys == nil {
+		o.keys = newKeyStore(log)
+	}
+	o.newSSH = func(cfg *config.Config) (Dialer, error) {
+		return newSSHClient(cfg, o.logger, o.keys)
+	}
+	return o
+}
+
+// Dial 通过 PROXY 建立连接，使 Outbounds 可以代替原来的 SSH 连接使用
+func (o *Outbounds) Dial(network, addr string) (net.Conn, error) {
+	return o.def.Dial(network, addr)
+}
+
+// DialOutbound 通过指定名称的出站建立连接。连接关闭前，即使出站的定义发生变化，
+// 该出站也不会被关闭
+func (o *Outbounds) DialOutbound(name, network, addr string) (net.Conn, error) {
+	d, e, err := o.entry(name, false, true)
+	if err != nil {
+		return nil, err
+	}
+	conn, err := d.Dial(network, addr)
+	if e == nil {
+		return conn, err
+	}
+	if err != nil {
+		o.release(e)
+		return nil, err
+	}
+	return &outboundConn{Conn: conn, release: func() { o.release(e) }}, nil
+}
+
+// get 返回名称对应的 Dialer，命名出站尚未建立、定义已变化或失败后已过退避时间时建立连接。
+// background 为 true 时由探测调用，建立连接时不在终端上询问
+func (o *Outbounds) get(name string, background bool) (Dialer, error) {
+	d, _, err := o.entry(name, background, false)
+	return d, err
+}
+
+// entry 实现 get，同时返回命名出站的 outboundEntry (PROXY 和 DIRECT 时为 nil)。
+// hold 为 true 时为即将建立的连接占用该出站，调用方需在连接关闭后调用 release
+func (o *Outbounds) entry(name string, background, hold bool) (Dialer, *outboundEntry, error) {
+	switch name {
+	case "", string(router.ActionProxy):
+		return o.def, nil, nil
+	case string(router.ActionDirect):
+		return o.direct, nil, nil
+	}
+	if o.router == nil {
+		return nil, nil, fmt.Errorf("未定义的出站 %s", name)
+	}
+	def, ok := o.router.Outbound(name)
+	if !ok {
+		return nil, nil, fmt.Errorf("未定义的出站 %s", name)
+	}
+
+	o.mu.Lock()
+	if o.closed {
+		o.mu.Unlock()
+		return nil, nil, fmt.Errorf("出站已关闭")
+	}
+	e := o.entries[name]
+	var old *outboundEntry
+	failures := 0
+	switch {
+	case e == nil:
+	case !reflect.DeepEqual(e.def, *def):
+		old = e
+		e = nil
+	case e.retry(background, time.Now()):
+		failures = e.failures
+		e = nil
+	}
+	if old != nil {
+		o.logger.Infof("出站 %s 的定义已变化，重新建立", name)
+		o.retire(old)
+	}
+	created := e == nil
+	if created {
+		e = &outboundEntry{def: *def, ready: make(chan struct{}), background: background, failures: failures}
+		o.entries[name] = e
+	}
+	if hold {
+		e.conns++
+	}
+	if created {
+		o.mu.Unlock()
+
+		e.dialer, e.err = o.create(&e.def, background)
+		if e.err != nil {
+			e.failures++
+			e.retryAt = time.Now().Add(buildBackoff(e.failures))
+		}
+		close(e.ready)
+	} else {
+		o.mu.Unlock()
+	}
+
+	<-e.ready
+	if e.err != nil {
+		if hold {
+			o.release(e)
+		}
+		return nil, nil, fmt.Errorf("出站 %s 不可用: %w", name, e.err)
+	}
+	return e.dialer, e, nil
+}
+
+// retire 将定义已变化的出站移出使用，没有连接时立即关闭，否则等最后一个连接关闭。
+// 调用时需持有 o.mu
+func (o *Outbounds) retire(e *outboundEntry) {
+	e.retired = true
+	if e.conns == 0 {
+		go e.close()
+		return
+	}
+	o.draining[e] = true
+	o.logger.Infof("出站 %s 的旧连接仍有 %d 个在使用，全部关闭后断开", e.def.Name, e.conns)
+}
+
+// release 在经由 e 的连接关闭 (或建立失败) 后调用
+func (o *Outbounds) release(e *outboundEntry) {
+	o.mu.Lock()
+	e.conns--
+	last := e.retired && e.conns == 0
+	if last {
+		delete(o.draining, e)
+	}
+	o.mu.Unlock()
+	if last {
+		o.logger.Debugf("出站 %s 的旧连接已全部关闭", e.def.Name)
+		e.close()
+	}
+}
+
+// outboundConn 是经由命名出站的连接，关闭时释放对出站的占用
+type outboundConn struct {
+	net.Conn
+	once    sync.Once
+	release func()
+}
+
+func (c *outboundConn) Close() error {
+	err := c.Conn.Close()
+	c.once.Do(c.release)
+	return err
+}
+
+// CloseWrite 在底层连接支持时半关闭连接
+func (c *outboundConn) CloseWrite() error {
+	if cw, ok := c.Conn.(interface{ CloseWrite() error }); ok {
+		return cw.CloseWrite()
+	}
+	return nil
+}
+
+// retry 判断建立失败的出站是否应重新建立: 已过退避时间，
+// 或者上次在后台建立 (没有询问用户) 而这次可以询问。调用时需持有 o.mu
+func (e *outboundEntry) retry(background bool, now time.Time) bool {
+	select {
+	case <-e.ready:
+	default:
+		return false // 正在建立
+	}
+	if e.err == nil {
+		return false
+	}
+	return !now.Before(e.retryAt) || (e.background && !background)
+}
+
+// buildBackoff 返回第 failures 次建立失败后的退避时间
+func buildBackoff(failures int) time.Duration {
+	backoff := minReconnectBackoff
+	for i := 1; i < failures && backoff < maxReconnectBackoff; i++ {
+		backoff *= 2
+	}
+	return min(backoff, maxReconnectBackoff)
+}
+
+// create 按定义建立 SSH 出站或出站组，background 为 true 时不在终端上询问
+func (o *Outbounds) create(def *router.Outbound, background bool) (Dialer, error) {
+	if def.IsGroup() {
+		return newOutboundGroup(def, o), nil
+	}
+	cfg, err := o.cfg.ForOutbound(def.Server, def.Jump, config.SSHHost{
+		KeyFile:      def.Identity,
+		PasswordFile: def.PasswordFile,
+		PasswordEnv:  def.PasswordEnv,
+	})
+	if err != nil {
+		return nil, err
+	}
+	cfg.NoPrompt = cfg.NoPrompt || background
+	o.logger.Infof("建立 SSH 出站 %s: %s@%s", def.Name, cfg.SSHUser, cfg.SSHServer)
+	return o.newSSH(cfg)
+}
+
+// close 关闭出站持有的连接或探测
+func (e *outboundEntry) close() {
+	<-e.ready
+	if c, ok := e.dialer.(interface{ Close() error }); ok {
+		c.Close()
+	}
+}
+
+// Close 关闭所有命名出站，PROXY 使用的连接由调用方关闭
+func (o *Outbounds) Close() error {
+	o.mu.Lock()
+	o.closed = true
+	entries := make([]*outboundEntry, 0, len(o.entries)+len(o.draining))
+	for _, e := range o.entries {
+		entries = append(entries, e)
+	}
+	for e := range o.draining {
+		entries = append(entries, e)
+	}
+	o.entries = nil
+	o.draining = nil
+	o.mu.Unlock()
+
+	for _, e := range entries {
+		e.close()
+	}
+	return nil
+}
+
+// probe 测量通过出站 name 的延迟。指定 url 时测量 HTTP 请求的耗时，
+// 否则测量 SSH keepalive 的往返时间；无法测量的出站 (如 DIRECT) 视为可用
+func (o *Outbounds) probe(name, url string) (time.Duration, error) {
+	d, err := o.get(name, true)
+	if err != nil {
+		return 0, err
+	}
+	if url == "" {
+		if p, ok := d.(interface{ Ping() (time.Duration, error) }); ok {
+			return p.Ping()
+		}
+		return 0, nil
+	}
+
+	client := &http.Client{
+		Timeout: o.cfg.Timeout,
+		Transport: &http.Transport{
+			DialContext: func(_ context.Context, network, addr string) (net.Conn, error) {
+				return d.Dial(network, addr)
+			},
+			DisableKeepAlives: true,
+		},
+	}
+	start := time.Now()
+	resp, err := client.Head(url)
+	if err != nil {
+		return 0, err
+	}
+	resp.Body.Close()
+	return time.Since(start), nil
+}
+
+// OutboundGroup 是 proxy-groups 中定义的出站组，按类型在成员间选择
+type OutboundGroup struct {
+	def   *router.Outbound
+	owner *Outbounds
+
+	mu      sync.Mutex
+	members []*groupMember
+	active  *groupMember // url-test 当前使用的成员
+	done    chan struct{}
+	once    sync.Once
+}
+
+// groupMember 是出站组中的一个成员
+type groupMember struct {
+	name    string
+	latency time.Duration
+	healthy bool
+	probed  bool
+}
+
+func newOutboundGroup(def *router.Outbound, owner *Outbounds) *OutboundGroup {
+	g := &OutboundGroup{
+		def:   def,
+		owner: owner,
+		done:  make(chan struct{}),
+	}
+	// 探测完成前认为所有成员都可用，按定义的顺序使用
+	for _, name := range def.Members {
+		g.members = append(g.members, &groupMember{name: name, healthy: true})
+	}
+	if def.Type != router.OutboundSelect {
+		go g.probeLoop()
+	}
+	return g
+}
+
+// probeLoop 立即探测一次，之后按 interval 定期探测
+func (g *OutboundGroup) probeLoop() {
+	ticker := time.NewTicker(g.def.Interval)
+	defer ticker.Stop()
+	for {
+		g.probe()
+		select {
+		case <-g.done:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// probe 同时测量所有成员的延迟，然后重新选择 url-test 的当前成员。
+// 尚未建立的成员在后台建立，不会在终端上询问
+func (g *OutboundGroup) probe() {
+	log := g.owner.logger
+	var wg sync.WaitGroup
+	for _, m := range g.members {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			latency, err := g.owner.probe(m.name, g.def.URL)
+
+			g.mu.Lock()
+			m.healthy = err == nil
+			m.probed = true
+			if err == nil {
+				m.latency = latency
+			}
+			g.mu.Unlock()
+
+			if err != nil {
+				log.Debugf("出站组 %s: %s 探测失败: %v", g.def.Name, m.name, err)
+			} else {
+				log.Debugf("出站组 %s: %s 延迟 %v", g.def.Name, m.name, latency)
+			}
+		}()
+	}
+	wg.Wait()
+
+	g.mu.Lock()
+	g.selectActive()
+	g.mu.Unlock()
+}
+
+// selectActive 为 url-test 组选择延迟最低的可用成员，调用时需持有 g.mu
+func (g *OutboundGroup) selectActive() {
+	if g.def.Type != router.OutboundURLTest {
+		return
+	}
+	var best *groupMember
+	for _, m := range g.members {
+		if m.healthy && m.probed && (best == nil || m.latency < best.latency) {
+			best = m
+		}
+	}
+	if best == nil || best == g.active {
+		return
+	}
+
+	log := g.owner.logger
+	prev := g.active
+	switch {
+	case prev == nil:
+		log.Infof("出站组 %s: 使用 %s (延迟 %v)", g.def.Name, best.name, best.latency)
+	case !prev.healthy:
+		log.Warnf("出站组 %s: %s 不可用，切换到 %s (延迟 %v)", g.def.Name, prev.name, best.name, best.latency)
+	case float64(best.latency) < float64(prev.latency)*switchThreshold:
+		log.Infof("出站组 %s: %s 延迟更低 (%v < %v)，从 %s 切换", g.def.Name, best.name, best.latency, prev.latency, prev.name)
+	default:
+		return
+	}
+	g.active = best
+}
+
+// markDown 在成员上建立连接失败时将其标记为不可用
+func (g *OutboundGroup) markDown(m *groupMember, err error) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if !m.healthy {
+		return
+	}
+	m.healthy = false
+	g.owner.logger.Warnf("出站组 %s: %s 连接失败: %v", g.def.Name, m.name, err)
+	g.selectActive()
+}
+
+// candidates 返回本次连接依次尝试的成员:
+// select 只使用选中的成员；fallback 按定义的顺序；url-test 当前成员优先，其余按延迟排序；
+// load-balance 按目标主机的哈希选择起点，同一主机的连接总是落在同一成员上。
+// 没有可用成员时返回所有成员
+func (g *OutboundGroup) candidates(addr string) []*groupMember {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	if g.def.Type == router.OutboundSelect {
+		for _, m := range g.members {
+			if m.name == g.def.Selected {
+				return []*groupMember{m}
+			}
+		}
+	}
+
+	var ready []*groupMember
+	for _, m := range g.members {
+		if m.healthy {
+			ready = append(ready, m)
+		}
+	}
+	if len(ready) == 0 {
+		return append([]*groupMember(nil), g.members...)
+	}
+
+	switch g.def.Type {
+	case router.OutboundURLTest:
+		sort.SliceStable(ready, func(i, j int) bool {
+			if ready[i] == g.active || ready[j] == g.active {
+				return ready[i] == g.active
+			}
+			return ready[i].latency < ready[j].latency
+		})
+	case router.OutboundLoadBalance:
+		host, _, err := net.SplitHostPort(addr)
+		if err != nil {
+			host = addr
+		}
+		h := fnv.New32a()
+		h.Write([]byte(host))
+		start := int(h.Sum32() % uint32(len(ready)))
+		ready = append(ready[start:], ready[:start]...)
+	}
+	return ready
+}
+
+// Dial 按组的类型选择成员建立连接，失败时依次尝试其余成员
+func (g *OutboundGroup) Dial(network, addr string) (net.Conn, error) {
+	var lastErr error
+	for _, m := range g.candidates(addr) {
+		conn, err := g.owner.DialOutbound(m.name, network, addr)
+		if err == nil {
+			return conn, nil
+		}
+		// 目标拒绝连接与成员无关，换成员也无济于事
+		var openErr *ssh.OpenChannelError
+		if errors.As(err, &openErr) {
+			return nil, err
+		}
+		lastErr = err
+		g.markDown(m, err)
+	}
+	if lastErr == nil {
+		lastErr = fmt.Errorf("出站组 %s 没有可用的成员", g.def.Name)
+	}
+	return nil, lastErr
+}
+
+// Ping 返回当前首选成员的延迟，用于嵌套的出站组
+func (g *OutboundGroup) Ping() (time.Duration, error) {
+	candidates := g.candidates("")
+	if len(candidates) == 0 {
+		return 0, fmt.Errorf("出站组 %s 没有可用的成员", g.def.Name)
+	}
+	return g.owner.probe(candidates[0].name, "")
+}
+
+// Close 停止探测，成员的连接由 Outbounds 管理
+func (g *OutboundGroup) Close() error {
+	g.once.Do(func() { close(g.done) })
+	return nil
+}
+
+// dialOutbound 通过规则指定的出站建立连接。d 不是 Outbounds 或没有指定出站时直接使用 d
+func dialOutbound(d Dialer, outbound, network, addr string) (net.Conn, error) {
+	if o, ok := d.(*Outbounds); ok && outbound != "" {
+		return o.DialOutbound(outbound, network, addr)
+	}
+	return d.Dial(network, addr)
+}
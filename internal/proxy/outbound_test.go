@@ -0,0 +1,574 @@
+package proxy
+
+import (
+	"errors"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/Sesame2/gotun/internal/config"
+	"github.com/Sesame2/gotun/internal/logger"
+	"github.com/Sesame2/gotun/internal/router"
+)
+
+// fakeDialer 记录经过它的连接，err 非空时连接失败
+type fakeDialer struct {
+	name string
+	err  error
+	ping func() (time.Duration, error)
+
+	mu     sync.Mutex
+	dials  []string
+	closed bool
+}
+
+func (f *fakeDialer) Dial(network, addr string) (net.Conn, error) {
+	f.mu.Lock()
+	f.dials = append(f.dials, addr)
+	f.mu.Unlock()
+	if f.err != nil {
+		return nil, f.err
+	}
+	c1, c2 := net.Pipe()
+	c2.Close()
+	return c1, nil
+}
+
+func (f *fakeDialer) Ping() (time.Duration, error) {
+	if f.ping != nil {
+		return f.ping()
+	}
+	return time.Millisecond, nil
+}
+
+func (f *fakeDialer) Close() error {
+	f.mu.Lock()
+	f.closed = true
+	f.mu.Unlock()
+	return nil
+}
+
+func (f *fakeDialer) isClosed() bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.closed
+}
+
+func (f *fakeDialer) dialed() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return len(f.dials)
+}
+
+// fakeSSH 代替 newSSHClient，按目标服务器返回 fakeDialer 并记录每次建立时的配置
+type fakeSSH struct {
+	mu      sync.Mutex
+	fail    map[string]error // 按 SSHServer 指定建立失败
+	builds  []*config.Config
+	dialers map[string]*fakeDialer
+}
+
+func (f *fakeSSH) build(cfg *config.Config) (Dialer, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.builds = append(f.builds, cfg)
+	if err := f.fail[cfg.SSHServer]; err != nil {
+		return nil, err
+	}
+	d := &fakeDialer{name: cfg.SSHServer}
+	f.dialers[cfg.SSHServer] = d
+	return d, nil
+}
+
+func (f *fakeSSH) count() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return len(f.builds)
+}
+
+func (f *fakeSSH) last() *config.Config {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.builds[len(f.builds)-1]
+}
+
+// newTestOutbounds 加载规则文件并创建使用 fakeSSH 的 Outbounds，返回规则文件路径以便修改
+func newTestOutbounds(t *testing.T, rules string) (*Outbounds, *fakeSSH, string) {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "rules.yaml")
+	if err := os.WriteFile(path, []byte(rules), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	r, err := router.NewRouter(path)
+	if err != nil {
+		t.Fatalf("NewRouter 失败: %v", err)
+	}
+
+	cfg := config.NewConfig()
+	cfg.SSHServer = "main.test:22"
+	cfg.SSHUser = "alice"
+	cfg.SSHPassword = "main-secret"
+	fake := &fakeSSH{fail: make(map[string]error), dialers: make(map[string]*fakeDialer)}
+	o := NewOutbounds(cfg, logger.NewLogger(false), &fakeDialer{name: "PROXY"}, r)
+	o.newSSH = fake.build
+	t.Cleanup(func() { o.Close() })
+	return o, fake, path
+}
+
+func TestOutboundsGet(t *testing.T) {
+	o, fake, path := newTestOutbounds(t, `
+outbounds:
+  corp:
+    server: bob@corp.test
+  lab:
+    server: lab.test:2222
+    password-env: GOTUN_TEST_LAB_PASSWORD
+rules:
+  - MATCH,corp
+`)
+	t.Setenv("GOTUN_TEST_LAB_PASSWORD", "lab-secret")
+
+	// 第一次使用时建立，之后复用
+	for i := 0; i < 2; i++ {
+		conn, err := o.DialOutbound("corp", "tcp", "a.test:80")
+		if err != nil {
+			t.Fatalf("DialOutbound(corp) 失败: %v", err)
+		}
+		conn.Close()
+	}
+	if n := fake.count(); n != 1 {
+		t.Fatalf("建立了 %d 次, 期望 1 次", n)
+	}
+	corp := fake.last()
+	if corp.SSHServer != "corp.test:22" || corp.SSHUser != "bob" {
+		t.Errorf("corp 的目标为 %s@%s", corp.SSHUser, corp.SSHServer)
+	}
+	// 主目标的密码不能发送给命名出站
+	if corp.SSHPassword != "" {
+		t.Errorf("corp 使用了主目标的密码 %q", corp.SSHPassword)
+	}
+	if corp.NoPrompt {
+		t.Error("前台建立的出站不应设置 NoPrompt")
+	}
+
+	if _, err := o.get("lab", true); err != nil {
+		t.Fatalf("get(lab) 失败: %v", err)
+	}
+	lab := fake.last()
+	if lab.SSHPassword != "lab-secret" {
+		t.Errorf("lab 的密码 = %q, 期望来自 password-env", lab.SSHPassword)
+	}
+	if !lab.NoPrompt {
+		t.Error("后台建立的出站应设置 NoPrompt")
+	}
+
+	// 定义变化后重新建立，没有连接在使用的旧出站被关闭
+	old := fake.dialers["corp.test:22"]
+	rules := "outbounds:\n  corp:\n    server: carol@corp.test\nrules:\n  - MATCH,corp\n"
+	if err := os.WriteFile(path, []byte(rules), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := o.router.Reload(); err != nil {
+		t.Fatalf("Reload 失败: %v", err)
+	}
+	conn, err := o.DialOutbound("corp", "tcp", "a.test:80")
+	if err != nil {
+		t.Fatalf("重新加载后 DialOutbound(corp) 失败: %v", err)
+	}
+	conn.Close()
+	if got := fake.last().SSHUser; got != "carol" {
+		t.Errorf("重新加载后的用户为 %s, 期望 carol", got)
+	}
+	deadline := time.Now().Add(time.Second)
+	for {
+		if old.isClosed() {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("定义变化后原有连接未关闭")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	if _, err := o.DialOutbound("nope", "tcp", "a.test:80"); err == nil {
+		t.Error("未定义的出站应返回错误")
+	}
+}
+
+// TestOutboundsDrain 确认定义变化时经由旧出站的连接不被切断，最后一个连接关闭后旧出站才关闭
+func TestOutboundsDrain(t *testing.T) {
+	o, fake, path := newTestOutbounds(t, `
+outbounds:
+  corp:
+    server: bob@corp.test
+rules:
+  - MATCH,corp
+`)
+	live, err := o.DialOutbound("corp", "tcp", "a.test:80")
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := o.DialOutbound("corp", "tcp", "b.test:80")
+	if err != nil {
+		t.Fatal(err)
+	}
+	old := fake.dialers["corp.test:22"]
+
+	rules := "outbounds:\n  corp:\n    server: carol@corp.test\nrules:\n  - MATCH,corp\n"
+	if err := os.WriteFile(path, []byte(rules), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := o.router.Reload(); err != nil {
+		t.Fatalf("Reload 失败: %v", err)
+	}
+	conn, err := o.DialOutbound("corp", "tcp", "a.test:80")
+	if err != nil {
+		t.Fatalf("重新加载后 DialOutbound(corp) 失败: %v", err)
+	}
+	defer conn.Close()
+	if n := fake.count(); n != 2 {
+		t.Fatalf("建立了 %d 次, 期望 2 次", n)
+	}
+
+	time.Sleep(50 * time.Millisecond)
+	if old.isClosed() {
+		t.Fatal("仍有连接在使用时旧出站被关闭")
+	}
+	// 重复关闭同一个连接只释放一次
+	live.Close()
+	live.Close()
+	if old.isClosed() {
+		t.Fatal("还有一个连接在使用时旧出站被关闭")
+	}
+	second.Close()
+	if !old.isClosed() {
+		t.Error("最后一个连接关闭后旧出站应关闭")
+	}
+	if fake.dialers["corp.test:22"] == old {
+		t.Fatal("新的出站不应复用旧的 Dialer")
+	}
+}
+
+// TestOutboundsCloseDraining 确认 Close 同时关闭仍在等待连接关闭的旧出站
+func TestOutboundsCloseDraining(t *testing.T) {
+	o, fake, path := newTestOutbounds(t, `
+outbounds:
+  corp:
+    server: bob@corp.test
+rules:
+  - MATCH,corp
+`)
+	live, err := o.DialOutbound("corp", "tcp", "a.test:80")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer live.Close()
+	old := fake.dialers["corp.test:22"]
+
+	rules := "outbounds:\n  corp:\n    server: carol@corp.test\nrules:\n  - MATCH,corp\n"
+	if err := os.WriteFile(path, []byte(rules), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := o.router.Reload(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := o.get("corp", false); err != nil {
+		t.Fatal(err)
+	}
+	o.Close()
+	if !old.isClosed() {
+		t.Error("Close 后旧出站应关闭")
+	}
+}
+
+func TestOutboundsBuildBackoff(t *testing.T) {
+	o, fake, _ := newTestOutbounds(t, `
+outbounds:
+  corp:
+    server: corp.test
+rules:
+  - MATCH,corp
+`)
+	fake.fail["corp.test:22"] = errors.New("连接被拒绝")
+
+	// 后台建立失败后，前台使用时可以询问用户，立即重试一次
+	if _, err := o.get("corp", true); err == nil {
+		t.Fatal("get 应失败")
+	}
+	if _, err := o.get("corp", false); err == nil {
+		t.Fatal("get 应失败")
+	}
+	if n := fake.count(); n != 2 {
+		t.Fatalf("建立了 %d 次, 期望 2 次", n)
+	}
+
+	// 退避期间不再重试
+	for i := 0; i < 3; i++ {
+		o.get("corp", false)
+		o.get("corp", true)
+	}
+	if n := fake.count(); n != 2 {
+		t.Fatalf("退避期间建立了 %d 次, 期望 2 次", n)
+	}
+
+	// 退避结束后重试，成功后不再退避
+	delete(fake.fail, "corp.test:22")
+	o.mu.Lock()
+	e := o.entries["corp"]
+	if e.failures != 2 || e.retryAt.Sub(time.Now()) > buildBackoff(2) {
+		t.Errorf("失败 %d 次, %v 后重试", e.failures, time.Until(e.retryAt))
+	}
+	e.retryAt = time.Now()
+	o.mu.Unlock()
+	if _, err := o.get("corp", false); err != nil {
+		t.Fatalf("退避结束后 get 失败: %v", err)
+	}
+	if n := fake.count(); n != 3 {
+		t.Fatalf("建立了 %d 次, 期望 3 次", n)
+	}
+}
+
+func TestBuildBackoff(t *testing.T) {
+	tests := []struct {
+		failures int
+		want     time.Duration
+	}{
+		{1, time.Second},
+		{2, 2 * time.Second},
+		{4, 8 * time.Second},
+		{7, time.Minute},
+		{100, time.Minute},
+	}
+	for _, tt := range tests {
+		if got := buildBackoff(tt.failures); got != tt.want {
+			t.Errorf("buildBackoff(%d) = %v, 期望 %v", tt.failures, got, tt.want)
+		}
+	}
+}
+
+// newTestGroup 创建不启动探测的出站组
+func newTestGroup(typ router.OutboundType, selected string, members ...*groupMember) *OutboundGroup {
+	def := &router.Outbound{Name: "g", Type: typ, Selected: selected}
+	for _, m := range members {
+		def.Members = append(def.Members, m.name)
+	}
+	return &OutboundGroup{
+		def:     def,
+		owner:   &Outbounds{logger: logger.NewLogger(false)},
+		members: members,
+		done:    make(chan struct{}),
+	}
+}
+
+func memberNames(members []*groupMember) []string {
+	names := make([]string, 0, len(members))
+	for _, m := range members {
+		names = append(names, m.name)
+	}
+	return names
+}
+
+func TestOutboundGroupCandidates(t *testing.T) {
+	up := func(name string, latency time.Duration) *groupMember {
+		return &groupMember{name: name, latency: latency, healthy: true, probed: true}
+	}
+	down := func(name string) *groupMember {
+		return &groupMember{name: name, probed: true}
+	}
+
+	tests := []struct {
+		name     string
+		typ      router.OutboundType
+		selected string
+		members  []*groupMember
+		active   string
+		want     []string
+	}{
+		{
+			name: "select 只使用选中的成员", typ: router.OutboundSelect, selected: "b",
+			members: []*groupMember{up("a", 1), down("b")},
+			want:    []string{"b"},
+		},
+		{
+			name: "fallback 按顺序跳过不可用的成员", typ: router.OutboundFallback,
+			members: []*groupMember{down("a"), up("b", 30), up("c", 10)},
+			want:    []string{"b", "c"},
+		},
+		{
+			name: "没有可用成员时返回所有成员", typ: router.OutboundFallback,
+			members: []*groupMember{down("a"), down("b")},
+			want:    []string{"a", "b"},
+		},
+		{
+			name: "url-test 当前成员优先，其余按延迟", typ: router.OutboundURLTest,
+			members: []*groupMember{up("a", 30), up("b", 20), up("c", 10), down("d")},
+			active:  "b",
+			want:    []string{"b", "c", "a"},
+		},
+		{
+			name: "url-test 没有当前成员时按延迟", typ: router.OutboundURLTest,
+			members: []*groupMember{up("a", 30), up("b", 20), up("c", 10)},
+			want:    []string{"c", "b", "a"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			g := newTestGroup(tt.typ, tt.selected, tt.members...)
+			for _, m := range g.members {
+				if m.name == tt.active {
+					g.active = m
+				}
+			}
+			if got := memberNames(g.candidates("x.test:443")); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("candidates = %v, 期望 %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestOutboundGroupLoadBalance(t *testing.T) {
+	g := newTestGroup(router.OutboundLoadBalance, "",
+		&groupMember{name: "a", healthy: true},
+		&groupMember{name: "b", healthy: true},
+		&groupMember{name: "c", healthy: true},
+		&groupMember{name: "d"},
+	)
+	ready := []string{"a", "b", "c"}
+
+	starts := make(map[string]bool)
+	for _, host := range []string{"a.test", "b.test", "c.test", "d.test", "e.test", "f.test", "g.test", "h.test"} {
+		got := memberNames(g.candidates(host + ":443"))
+		// 同一主机不论端口都落在同一成员上
+		if other := memberNames(g.candidates(host + ":80")); !reflect.DeepEqual(got, other) {
+			t.Errorf("%s 的两个端口选择了不同的成员: %v, %v", host, got, other)
+		}
+		// 结果是可用成员的轮转
+		if len(got) != len(ready) {
+			t.Fatalf("%s: candidates = %v, 期望 %v 的轮转", host, got, ready)
+		}
+		start := 0
+		for start < len(ready) && ready[start] != got[0] {
+			start++
+		}
+		for i := range got {
+			if got[i] != ready[(start+i)%len(ready)] {
+				t.Fatalf("%s: candidates = %v, 期望 %v 的轮转", host, got, ready)
+			}
+		}
+		starts[got[0]] = true
+	}
+	if len(starts) < 2 {
+		t.Errorf("所有主机都落在同一成员上: %v", starts)
+	}
+}
+
+func TestOutboundGroupSelectActive(t *testing.T) {
+	a := &groupMember{name: "a", latency: 100 * time.Millisecond, healthy: true, probed: true}
+	b := &groupMember{name: "b", latency: 90 * time.Millisecond, healthy: true, probed: true}
+	c := &groupMember{name: "c", healthy: true} // 尚未探测
+	g := newTestGroup(router.OutboundURLTest, "", a, b, c)
+	g.active = a
+
+	steps := []struct {
+		name   string
+		update func()
+		want   string
+	}{
+		{name: "延迟相近时不切换", update: func() {}, want: "a"},
+		{name: "延迟明显更低时切换", update: func() { b.latency = 50 * time.Millisecond }, want: "b"},
+		{name: "未探测的成员不参与选择", update: func() { c.latency = 0 }, want: "b"},
+		{name: "当前成员不可用时切换", update: func() { g.markDown(b, errors.New("断开")) }, want: "a"},
+	}
+	for _, step := range steps {
+		step.update()
+		g.mu.Lock()
+		g.selectActive()
+		got := g.active.name
+		g.mu.Unlock()
+		if got != step.want {
+			t.Errorf("%s: 当前成员为 %s, 期望 %s", step.name, got, step.want)
+		}
+	}
+	if b.healthy {
+		t.Error("markDown 后成员仍为可用")
+	}
+}
+
+func TestOutboundGroupDial(t *testing.T) {
+	o, fake, _ := newTestOutbounds(t, `
+outbounds:
+  a:
+    server: a.test
+  b:
+    server: b.test
+proxy-groups:
+  g:
+    type: fallback
+    outbounds: [a, b, DIRECT]
+    interval: 3600
+rules:
+  - MATCH,g
+`)
+	fake.fail["a.test:22"] = errors.New("连接被拒绝")
+
+	if _, err := o.DialOutbound("g", "tcp", "x.test:443"); err != nil {
+		t.Fatalf("DialOutbound(g) 失败: %v", err)
+	}
+	if n := fake.dialers["b.test:22"].dialed(); n == 0 {
+		t.Error("a 失败后应使用 b")
+	}
+	d, _ := o.get("g", false)
+	g := d.(*OutboundGroup)
+	if got := memberNames(g.candidates("x.test:443")); !reflect.DeepEqual(got, []string{"b", "DIRECT"}) {
+		t.Errorf("a 失败后 candidates = %v, 期望 [b DIRECT]", got)
+	}
+}
+
+// TestOutboundGroupProbeParallel 确认各成员同时探测，一个成员无响应不会拖慢其它成员
+func TestOutboundGroupProbeParallel(t *testing.T) {
+	o, fake, _ := newTestOutbounds(t, `
+outbounds:
+  a:
+    server: a.test
+  b:
+    server: b.test
+rules:
+  - MATCH,a
+`)
+	for _, name := range []string{"a", "b"} {
+		if _, err := o.get(name, false); err != nil {
+			t.Fatal(err)
+		}
+	}
+	var started sync.WaitGroup
+	started.Add(2)
+	both := make(chan struct{})
+	go func() { started.Wait(); close(both) }()
+	ping := func() (time.Duration, error) {
+		started.Done()
+		select {
+		case <-both:
+			return time.Millisecond, nil
+		case <-time.After(2 * time.Second):
+			return 0, errors.New("成员没有同时探测")
+		}
+	}
+	fake.dialers["a.test:22"].ping = ping
+	fake.dialers["b.test:22"].ping = ping
+
+	g := newTestGroup(router.OutboundURLTest, "",
+		&groupMember{name: "a", healthy: true},
+		&groupMember{name: "b", healthy: true},
+	)
+	g.owner = o
+	g.probe()
+	for _, m := range g.members {
+		if !m.healthy || !m.probed {
+			t.Errorf("成员 %s 探测失败", m.name)
+		}
+	}
+}
@@ -0,0 +1,94 @@
+package proxy
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/Sesame2/gotun/internal/config"
+	"github.com/Sesame2/gotun/internal/logger"
+)
+
+// allowDialer 在本地建立连接，只允许访问 --remote-socks-allow 中的目标。
+// 反向 SOCKS5 用它代替 SSH 连接，使远端客户端可以访问本机所在的网络
+type allowDialer struct {
+	allow   []config.AllowEntry
+	timeout time.Duration
+	logger  *logger.Logger
+}
+
+func newAllowDialer(entries []string, timeout time.Duration, log *logger.Logger) (*allowDialer, error) {
+	d := &allowDialer{timeout: timeout, logger: log}
+	for _, s := range entries {
+		e, err := config.ParseAllowEntry(s)
+		if err != nil {
+			return nil, err
+		}
+		d.allow = append(d.allow, e)
+	}
+	return d, nil
+}
+
+// Dial 检查目标是否被允许后在本地连接。目标为域名且只有 IP 规则可能匹配时，
+// 先在本地解析，再连接通过检查的 IP，避免域名解析到未被允许的地址
+func (d *allowDialer) Dial(network, addr string) (net.Conn, error) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+
+	if ip := net.ParseIP(host); ip != nil {
+		if !d.allowed(host, ip, port) {
+			return nil, d.denied(addr)
+		}
+		return net.DialTimeout(network, addr, d.timeout)
+	}
+
+	if d.allowed(host, nil, port) {
+		return net.DialTimeout(network, addr, d.timeout)
+	}
+	ips, err := net.LookupIP(host)
+	if err != nil {
+		return nil, err
+	}
+	for _, ip := range ips {
+		if d.allowed("", ip, port) {
+			return net.DialTimeout(network, net.JoinHostPort(ip.String(), port), d.timeout)
+		}
+	}
+	return nil, d.denied(addr)
+}
+
+// allowed 判断主机名或 IP 加端口是否命中某条允许规则
+func (d *allowDialer) allowed(host string, ip net.IP, port string) bool {
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+	for _, e := range d.allow {
+		if e.Port != "" && e.Port != port {
+			continue
+		}
+		switch {
+		case e.Any:
+			return true
+		case e.Net != nil:
+			if ip != nil && e.Net.Contains(ip) {
+				return true
+			}
+		case strings.HasPrefix(e.Domain, "*."):
+			if host != "" && strings.HasSuffix(host, e.Domain[1:]) {
+				return true
+			}
+		default:
+			if host != "" && host == e.Domain {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// denied 返回包装了 errRuleRejected 的错误，SOCKS5 据此回复 0x02 (规则不允许)
+func (d *allowDialer) denied(addr string) error {
+	d.logger.Warnf("[反向SOCKS5] 拒绝访问 %s: 不在 --remote-socks-allow 允许列表中", addr)
+	return fmt.Errorf("%w: 目标 %s 不在允许列表中", errRuleRejected, addr)
+}
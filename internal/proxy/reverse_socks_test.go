@@ -0,0 +1,90 @@
+package proxy
+
+import (
+	"errors"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/Sesame2/gotun/internal/config"
+	"github.com/Sesame2/gotun/internal/logger"
+)
+
+func TestAllowDialerAllowed(t *testing.T) {
+	tests := []struct {
+		allow []string
+		host  string // 为空时只按 IP 检查
+		ip    string
+		port  string
+		want  bool
+	}{
+		{allow: []string{"*"}, host: "any.test", port: "443", want: true},
+		{allow: []string{"*:22"}, ip: "192.0.2.1", port: "22", want: true},
+		{allow: []string{"*:22"}, ip: "192.0.2.1", port: "80", want: false},
+		{allow: []string{"10.0.0.0/8"}, ip: "10.1.2.3", port: "80", want: true},
+		{allow: []string{"10.0.0.0/8"}, ip: "11.1.2.3", port: "80", want: false},
+		{allow: []string{"10.0.0.0/8"}, host: "intranet.test", port: "80", want: false},
+		{allow: []string{"192.168.1.5:5432"}, ip: "192.168.1.5", port: "5432", want: true},
+		{allow: []string{"192.168.1.5:5432"}, ip: "192.168.1.5", port: "22", want: false},
+		{allow: []string{"[fd00::/8]:443"}, ip: "fd00::1", port: "443", want: true},
+		{allow: []string{"*.corp.test"}, host: "git.corp.test", port: "443", want: true},
+		{allow: []string{"*.corp.test"}, host: "a.b.CORP.test.", port: "443", want: true},
+		{allow: []string{"*.corp.test"}, host: "corp.test", port: "443", want: false},
+		{allow: []string{"*.corp.test"}, host: "evilcorp.test", port: "443", want: false},
+		{allow: []string{"db.test:5432"}, host: "DB.test", port: "5432", want: true},
+		{allow: []string{"db.test:5432"}, host: "db.test", port: "5433", want: false},
+		{allow: []string{"db.test"}, host: "www.db.test", port: "80", want: false},
+		{allow: []string{"a.test", "10.0.0.0/8:22"}, ip: "10.0.0.1", port: "22", want: true},
+		{allow: nil, host: "a.test", port: "80", want: false},
+	}
+	for _, tt := range tests {
+		d, err := newAllowDialer(tt.allow, time.Second, logger.NewLogger(false))
+		if err != nil {
+			t.Fatalf("newAllowDialer(%v) 失败: %v", tt.allow, err)
+		}
+		if got := d.allowed(tt.host, net.ParseIP(tt.ip), tt.port); got != tt.want {
+			t.Errorf("allow %v: allowed(%q, %q, %q) = %v, 期望 %v", tt.allow, tt.host, tt.ip, tt.port, got, tt.want)
+		}
+	}
+}
+
+// TestReverseSOCKS5Denied 确认不在允许列表中的目标得到 SOCKS5 回复 0x02 (规则不允许)
+func TestReverseSOCKS5Denied(t *testing.T) {
+	d, err := newAllowDialer([]string{"192.0.2.1:22"}, time.Second, logger.NewLogger(false))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := d.Dial("tcp", "127.0.0.1:9"); !errors.Is(err, errRuleRejected) {
+		t.Fatalf("Dial 错误 = %v, 期望 errRuleRejected", err)
+	}
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	socks := &SOCKS5OverSSH{cfg: config.NewConfig(), logger: logger.NewLogger(false), ssh: d, local: true}
+	go socks.Serve(ln)
+	defer socks.Close()
+
+	conn, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(2 * time.Second))
+
+	// 无认证协商，然后请求 CONNECT 127.0.0.1:9
+	conn.Write([]byte{0x05, 0x01, 0x00})
+	buf := make([]byte, 10)
+	if _, err := io.ReadFull(conn, buf[:2]); err != nil {
+		t.Fatal(err)
+	}
+	conn.Write([]byte{0x05, 0x01, 0x00, 0x01, 127, 0, 0, 1, 0, 9})
+	if _, err := io.ReadFull(conn, buf); err != nil {
+		t.Fatal(err)
+	}
+	if buf[1] != 0x02 {
+		t.Errorf("SOCKS5 回复 = 0x%02x, 期望 0x02", buf[1])
+	}
+}
@@ -2,6 +2,7 @@ package proxy
 
 import (
 	"encoding/binary"
+	"errors"
 	"fmt"
 	"io"
 	"net"
@@ -17,14 +18,15 @@ import (
 type SOCKS5OverSSH struct {
 	cfg      *config.Config
 	logger   *logger.Logger
-	ssh      *SSHClient
+	ssh      Dialer
 	router   *router.Router
+	local    bool // 反向 SOCKS5: 不使用路由规则，由 ssh (allowDialer) 在本地连接目标
 	listener net.Listener
 	mu       sync.Mutex // 互斥锁，保证 Close 的线程安全
 }
 
 // NewSOCKS5OverSSH 创建 SOCKS5 代理实例
-func NewSOCKS5OverSSH(cfg *config.Config, log *logger.Logger, sshClient *SSHClient, r *router.Router) (*SOCKS5OverSSH, error) {
+func NewSOCKS5OverSSH(cfg *config.Config, log *logger.Logger, sshClient Dialer, r *router.Router) (*SOCKS5OverSSH, error) {
 	return &SOCKS5OverSSH{
 		cfg:    cfg,
 		logger: log,
@@ -46,12 +48,16 @@ func (s *SOCKS5OverSSH) Start() error {
 		return fmt.Errorf("SOCKS5 监听启动失败: %w", err)
 	}
 
+	s.logger.Infof("SOCKS5 代理已启动，监听地址: %s", addr)
+	return s.Serve(l)
+}
+
+// Serve 在给定的监听上提供 SOCKS5 服务，直到 Close 被调用或监听被关闭
+func (s *SOCKS5OverSSH) Serve(l net.Listener) error {
 	s.mu.Lock()
 	s.listener = l
 	s.mu.Unlock()
 
-	s.logger.Infof("SOCKS5 代理已启动，监听地址: %s", addr)
-
 	for {
 		conn, err := l.Accept()
 		if err != nil {
@@ -62,6 +68,10 @@ func (s *SOCKS5OverSSH) Start() error {
 			if closing {
 				return nil // 正常退出
 			}
+			// 监听已失效 (如远端监听随 SSH 连接断开)，重试没有意义
+			if errors.Is(err, net.ErrClosed) || errors.Is(err, io.EOF) {
+				return err
+			}
 			s.logger.Errorf("SOCKS5 Accept 错误: %v", err)
 			continue
 		}
@@ -101,7 +111,7 @@ func (s *SOCKS5OverSSH) handleConnection(conn net.Conn) {
 
 	// 2. 请求阶段 (Request)
 	// Client: [VER, CMD, RSV, ATYP, DST.ADDR, DST.PORT]
-	targetAddr, hostForRoute, err := s.readRequest(conn)
+	targetAddr, err := s.readRequest(conn)
 	if err != nil {
 		s.logger.Debugf("[%s] SOCKS5 请求解析失败: %v", clientAddr, err)
 		return
@@ -109,9 +119,16 @@ func (s *SOCKS5OverSSH) handleConnection(conn net.Conn) {
 
 	// 3. 路由与连接 (Dial)
 	start := time.Now()
-	destConn, ruleAction, err := s.dialTarget(targetAddr, hostForRoute)
+	destConn, ruleAction, err := s.dialTarget(targetAddr, clientAddr)
+	if errors.Is(err, errRuleRejected) {
+		s.reply(conn, 0x02) // 0x02: Connection not allowed by ruleset
+		return
+	}
+	if errors.Is(err, errRuleDropped) {
+		return
+	}
 	if err != nil {
-		s.logger.Warnf("[%SOCKS5] 连接目标 %s 失败: %v", targetAddr, err)
+		s.logger.Warnf("[SOCKS5] 连接目标 %s 失败: %v", targetAddr, err)
 		s.reply(conn, 0x05) // 0x05: Connection refused
 		return
 	}
@@ -121,7 +138,11 @@ func (s *SOCKS5OverSSH) handleConnection(conn net.Conn) {
 	// Server: [VER, REP, RSV, ATYP, BND.ADDR, BND.PORT]
 	s.reply(conn, 0x00) // 0x00: Succeeded
 
-	s.logger.Infof("[SOCKS5] 建立连接 -> %s (规则: %s)", targetAddr, ruleAction)
+	if s.local {
+		s.logger.Infof("[反向SOCKS5] 建立连接 -> %s (本地连接)", targetAddr)
+	} else {
+		s.logger.Infof("[SOCKS5] 建立连接 -> %s (规则: %s)", targetAddr, ruleAction)
+	}
 
 	// 5. 数据传输 (Transfer)
 	var wg sync.WaitGroup
@@ -171,16 +192,16 @@ func (s *SOCKS5OverSSH) handshake(conn net.Conn) error {
 	return err
 }
 
-// readRequest 读取并解析客户端请求，返回完整目标地址(host:port)和用于路由匹配的主机名
-func (s *SOCKS5OverSSH) readRequest(conn net.Conn) (string, string, error) {
+// readRequest 读取并解析客户端请求，返回完整目标地址(host:port)
+func (s *SOCKS5OverSSH) readRequest(conn net.Conn) (string, error) {
 	header := make([]byte, 4)
 	if _, err := io.ReadFull(conn, header); err != nil {
-		return "", "", err
+		return "", err
 	}
 
 	if header[1] != 0x01 { // CMD: 0x01 = CONNECT
 		s.reply(conn, 0x07) // Command not supported
-		return "", "", fmt.Errorf("不支持的命令: %d", header[1])
+		return "", fmt.Errorf("不支持的命令: %d", header[1])
 	}
 
 	var host string
@@ -188,62 +209,90 @@ func (s *SOCKS5OverSSH) readRequest(conn net.Conn) (string, string, error) {
 	case 0x01: // IPv4
 		ip := make([]byte, 4)
 		if _, err := io.ReadFull(conn, ip); err != nil {
-			return "", "", err
+			return "", err
 		}
 		host = net.IP(ip).String()
 	case 0x03: // Domain Name (关键：直接读取域名，不进行本地 DNS 解析)
 		lenBuf := make([]byte, 1)
 		if _, err := io.ReadFull(conn, lenBuf); err != nil {
-			return "", "", err
+			return "", err
 		}
 		domainLen := int(lenBuf[0])
 		domain := make([]byte, domainLen)
 		if _, err := io.ReadFull(conn, domain); err != nil {
-			return "", "", err
+			return "", err
 		}
 		host = string(domain)
 	case 0x04: // IPv6
 		ip := make([]byte, 16)
 		if _, err := io.ReadFull(conn, ip); err != nil {
-			return "", "", err
+			return "", err
 		}
 		host = net.IP(ip).String()
 	default:
 		s.reply(conn, 0x08) // Address type not supported
-		return "", "", fmt.Errorf("不支持的地址类型: %d", header[3])
+		return "", fmt.Errorf("不支持的地址类型: %d", header[3])
 	}
 
 	portBuf := make([]byte, 2)
 	if _, err := io.ReadFull(conn, portBuf); err != nil {
-		return "", "", err
+		return "", err
 	}
 	port := binary.BigEndian.Uint16(portBuf)
 
 	targetAddr := net.JoinHostPort(host, strconv.Itoa(int(port)))
-	return targetAddr, host, nil
+	return targetAddr, nil
 }
 
-// dialTarget 根据路由规则连接目标
-func (s *SOCKS5OverSSH) dialTarget(addr string, hostForRoute string) (net.Conn, string, error) {
+// 被 REJECT / REJECT-DROP 规则拒绝时 dialTarget 返回的错误
+var (
+	errRuleRejected = errors.New("被规则拒绝")
+	errRuleDropped  = errors.New("被规则丢弃")
+)
+
+// dialTarget 根据路由规则连接目标，clientAddr 用于来源地址和端口规则
+func (s *SOCKS5OverSSH) dialTarget(addr string, clientAddr string) (net.Conn, string, error) {
 	action := router.ActionProxy
+	rule := string(action)
+	var outbound string
+
+	if s.local {
+		conn, err := s.ssh.Dial("tcp", addr)
+		return conn, "本地连接", err
+	}
 
 	// 1. 路由判断
 	if s.router != nil {
-		action = s.router.Match(hostForRoute)
+		result := s.router.EvaluateRequest(router.Request{
+			Host:    addr,
+			Source:  clientAddr,
+			Network: "tcp",
+			Inbound: "socks5",
+		})
+		action = result.Action
+		outbound = result.Outbound
+		rule = fmt.Sprintf("%s, %s", result.Target(), result)
+		if action.IsReject() {
+			s.logger.Infof("[SOCKS5] 规则匹配: %s -> %s (%s)", addr, action, result)
+			if action == router.ActionRejectDrop {
+				return nil, rule, errRuleDropped
+			}
+			return nil, rule, errRuleRejected
+		}
 	}
 
 	// 2. 根据动作执行连接
 	if action == router.ActionDirect {
 		s.logger.Debugf("[SOCKS5] 路由直连: %s", addr)
 		conn, err := net.DialTimeout("tcp", addr, s.cfg.Timeout)
-		return conn, "DIRECT", err
+		return conn, rule, err
 	}
 
 	// 默认走 Proxy (SSH)
 	// SSH 服务器会在远端进行 DNS 解析，从而解决本地 DNS 污染和 HSTS 问题
 	s.logger.Debugf("[SOCKS5] SSH 转发: %s", addr)
-	conn, err := s.ssh.Dial("tcp", addr)
-	return conn, "PROXY", err
+	conn, err := dialOutbound(s.ssh, outbound, "tcp", addr)
+	return conn, rule, err
 }
 
 // reply 发送 SOCKS5 响应包
@@ -1,14 +1,17 @@
 package proxy
 
 import (
+	"errors"
 	"fmt"
 	"net"
 	"os"
 	"path/filepath"
-	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
 
 	"github.com/Sesame2/gotun/internal/config"
 	"github.com/Sesame2/gotun/internal/logger"
@@ -17,237 +20,625 @@ import (
 
 // SSHClient 管理SSH连接
 type SSHClient struct {
-	client      *ssh.Client   // 这个是最终目标机器的连接
-	jumpClients []*ssh.Client // 这里存储所有跳板机的连接
-	config      *ssh.ClientConfig
-	logger      *logger.Logger
+	links     []*sshLink // 到目标机器的并行连接 (各含完整的跳板机链)，断开后各自重连
+	config    *ssh.ClientConfig
+	cfg       *config.Config
+	hostKeys  *hostKeyChecker // 每一跳共用的主机密钥校验器
+	agent     agent.ExtendedAgent
+	agentConn net.Conn
+	keys      *keyStore // 已解密私钥的缓存，各跳共用
+	dialHop   hopDialer // 建立到第一跳的连接
+
+	remoteForwards []config.Forward // 远程端口转发 (-R)，只在主链路上建立
+	reverseDialer  *allowDialer     // 反向 SOCKS5 在本地连接目标
+	logger         *logger.Logger
+
+	pwMu      sync.Mutex
+	passwords map[string]string // 已输入的密码，重连时复用，键为 user@host:port
 }
 
 type AuthConfig struct {
 	User            string
 	Password        string
-	KeyFile         string
+	KeyFiles        []string // 明确指定的私钥 (-i 及 ~/.ssh/config 中的 IdentityFile)
+	CertFiles       []string // 明确指定的用户证书 (--certificate-file 及 CertificateFile)
+	IdentitiesOnly  bool     // 只使用 KeyFiles 中的私钥
 	ServerAddr      string
 	InteractiveAuth bool
+	Agent           agent.ExtendedAgent // 非空时优先尝试 ssh-agent 中的密钥
 }
 
-// getAuthMethods 根据配置生成ssh.AuthMethod列表
-func getAuthMethods(authCfg *AuthConfig, log *logger.Logger, passwordOnly bool) ([]ssh.AuthMethod, error) {
+// getAuthMethods 根据配置生成ssh.AuthMethod列表。
+// 所有方法放在同一次握手中，服务器在私钥认证部分成功后要求 OTP 等第二因素时也能继续
+func (s *SSHClient) getAuthMethods(authCfg *AuthConfig, dl *handshakeDeadline) ([]ssh.AuthMethod, error) {
 	var authMethods []ssh.AuthMethod
 
-	if !passwordOnly {
-		// 优先使用指定的私钥文件
-		if authCfg.KeyFile != "" {
-			log.Debugf("尝试使用指定的SSH私钥: %s", authCfg.KeyFile)
-			signer, err := loadPrivateKey(authCfg.KeyFile)
-			if err != nil {
-				return nil, fmt.Errorf("加载指定SSH私钥失败: %v", err)
-			}
-			authMethods = append(authMethods, ssh.PublicKeys(signer))
-		} else {
-			// 否则，尝试所有默认位置的私钥
-			home, _ := os.UserHomeDir()
-			keyDir := filepath.Join(home, ".ssh")
-			candidateKeys := []string{"id_rsa", "id_ed25519", "id_ecdsa", "id_dsa"}
-
-			for _, name := range candidateKeys {
-				keyPath := filepath.Join(keyDir, name)
-				signer, err := loadPrivateKey(keyPath)
-				if err != nil {
-					log.Debugf("跳过不可用私钥 %s: %v", keyPath, err)
-					continue
-				}
-				log.Debugf("找到并添加默认私钥进行尝试: %s", keyPath)
-				authMethods = append(authMethods, ssh.PublicKeys(signer))
-			}
-		}
+	signers, err := s.collectSigners(authCfg)
+	if err != nil {
+		s.logger.Debugf("获取私钥方法时出错: %v", err)
+	}
+	// 所有密钥放在同一个 publickey 方法中，否则失败一次后其余密钥不会再被尝试
+	if len(signers) > 0 {
+		authMethods = append(authMethods, ssh.PublicKeys(signers...))
 	}
 
-	// 如果启用了密码或交互式认证，则添加密码认证方法
-	if passwordOnly {
-		password, err := utils.GetSSHPassword(authCfg.Password, authCfg.InteractiveAuth, authCfg.User, authCfg.ServerAddr)
-		if err != nil {
-			return nil, fmt.Errorf("获取SSH密码失败: %v", err)
-		}
-		authMethods = append(authMethods, ssh.Password(password))
+	// 如果启用了密码或交互式认证，则添加键盘交互和密码认证方法，
+	// 顺序与 OpenSSH 默认的 PreferredAuthentications 一致
+	if authCfg.InteractiveAuth || authCfg.Password != "" {
+		authMethods = append(authMethods,
+			s.keyboardInteractiveMethod(authCfg, dl),
+			s.passwordMethod(authCfg, dl),
+		)
 	}
 
 	if len(authMethods) == 0 {
-		if passwordOnly {
-			return nil, fmt.Errorf("未配置密码或交互式认证")
+		if err != nil {
+			return nil, err
 		}
-		return nil, fmt.Errorf("未找到可用的SSH私钥")
+		return nil, fmt.Errorf("未找到可用的SSH私钥，且未配置密码或交互式认证")
 	}
 	return authMethods, nil
 }
 
+// password 返回缓存的密码，没有时通过命令行参数或终端获取。
+// 缓存使重连时无需再次输入密码
+func (s *SSHClient) password(authCfg *AuthConfig) (string, error) {
+	if password, ok := s.knownPassword(authCfg); ok {
+		return password, nil
+	}
+
+	if !s.canPrompt() {
+		return "", fmt.Errorf("服务器要求密码认证，但当前无法在终端上询问 (可使用 --pass)")
+	}
+
+	promptMu.Lock()
+	defer promptMu.Unlock()
+	password, err := utils.GetSSHPassword(authCfg.Password, authCfg.InteractiveAuth, authCfg.User, authCfg.ServerAddr)
+	if err != nil {
+		return "", fmt.Errorf("获取SSH密码失败: %v", err)
+	}
+	s.rememberPassword(authCfg, password)
+	return password, nil
+}
+
+// canPrompt 判断是否可以在终端上询问用户。后台建立的连接 (NoPrompt) 从不询问
+func (s *SSHClient) canPrompt() bool {
+	return !s.cfg.NoPrompt && utils.IsTerminal()
+}
+
+// knownPassword 返回无需询问即可使用的密码: 缓存的密码或 --pass 指定的密码
+func (s *SSHClient) knownPassword(authCfg *AuthConfig) (string, bool) {
+	s.pwMu.Lock()
+	defer s.pwMu.Unlock()
+	if password, ok := s.passwords[authCfg.User+"@"+authCfg.ServerAddr]; ok {
+		return password, true
+	}
+	if authCfg.Password != "" {
+		return authCfg.Password, true
+	}
+	return "", false
+}
+
+func (s *SSHClient) rememberPassword(authCfg *AuthConfig, password string) {
+	s.pwMu.Lock()
+	s.passwords[authCfg.User+"@"+authCfg.ServerAddr] = password
+	s.pwMu.Unlock()
+}
+
+// forgetPassword 认证失败时丢弃缓存的密码
+func (s *SSHClient) forgetPassword(user, addr string) {
+	s.pwMu.Lock()
+	delete(s.passwords, user+"@"+addr)
+	s.pwMu.Unlock()
+}
+
+// collectSigners 按 ssh-agent、指定私钥、默认私钥的顺序收集可用密钥。
+// 指定私钥的公钥已在 ssh-agent 中时直接使用 agent，避免重复解密
+func (s *SSHClient) collectSigners(authCfg *AuthConfig) ([]ssh.Signer, error) {
+	log := s.logger
+	agentKeys := agentSigners(authCfg.Agent, log)
+
+	// 未指定私钥时，尝试所有默认位置的私钥
+	keyFiles := authCfg.KeyFiles
+	explicit := len(keyFiles) > 0
+	if !explicit {
+		home, _ := os.UserHomeDir()
+		for _, name := range []string{"id_rsa", "id_ed25519", "id_ecdsa", "id_dsa"} {
+			keyFiles = append(keyFiles, filepath.Join(home, ".ssh", name))
+		}
+	}
+
+	var fileSigners []ssh.Signer
+	var loadErr error
+	for _, keyFile := range keyFiles {
+		if signer := matchAgentSigner(agentKeys, keyFile); signer != nil {
+			log.Debugf("私钥 %s 已在 ssh-agent 中", keyFile)
+			if authCfg.IdentitiesOnly {
+				fileSigners = append(fileSigners, signer)
+			}
+			continue
+		}
+		if !explicit {
+			if _, err := os.Stat(keyFile); err != nil {
+				continue
+			}
+		}
+		signer, err := s.keys.load(keyFile, s.cfg.KeyPassphraseFile, !s.cfg.NoPrompt)
+		if err != nil {
+			log.Debugf("跳过不可用私钥 %s: %v", keyFile, err)
+			if explicit {
+				loadErr = err
+			}
+			continue
+		}
+		log.Debugf("添加私钥进行尝试: %s", keyFile)
+		fileSigners = append(fileSigners, signer)
+	}
+
+	// IdentitiesOnly 时 agent 中只有与指定私钥对应的密钥会被使用 (已在上面加入)
+	var signers []ssh.Signer
+	if !authCfg.IdentitiesOnly {
+		signers = append(signers, agentKeys...)
+	}
+	signers = append(signers, fileSigners...)
+
+	// 与 OpenSSH 相同，证书排在对应的普通密钥之前
+	certs := s.certSigners(append(signers, agentKeys...), authCfg.CertFiles, keyFiles, authCfg.User)
+	signers = append(certs, signers...)
+
+	if len(signers) == 0 && loadErr != nil {
+		return nil, fmt.Errorf("加载指定SSH私钥失败: %v", loadErr)
+	}
+	return signers, nil
+}
+
 func NewSSHClient(cfg *config.Config, log *logger.Logger) (*SSHClient, error) {
+	return newSSHClient(cfg, log, nil)
+}
+
+// newSSHClient 创建 SSHClient，keys 非空时与其它客户端共用已解密的私钥
+func newSSHClient(cfg *config.Config, log *logger.Logger, keys *keyStore) (*SSHClient, error) {
+	if keys == nil {
+		keys = newKeyStore(log)
+	}
+	hostKeys, err := newHostKeyChecker(cfg.HostKeyCheck, cfg.KnownHostsFile, log)
+	if err != nil {
+		return nil, err
+	}
+	hostKeys.noPrompt = cfg.NoPrompt
+	dialHop, err := newHopDialer(cfg, log)
+	if err != nil {
+		return nil, err
+	}
+	var remoteForwards []config.Forward
+	var reverseDialer *allowDialer
+	for _, spec := range cfg.RemoteForwards {
+		fwd, err := config.ParseRemoteForward(spec)
+		if err != nil {
+			return nil, err
+		}
+		remoteForwards = append(remoteForwards, fwd)
+		if fwd.Dynamic && reverseDialer == nil {
+			if reverseDialer, err = newAllowDialer(cfg.RemoteSocksAllow, cfg.Timeout, log); err != nil {
+				return nil, err
+			}
+			if len(cfg.RemoteSocksAllow) == 0 {
+				log.Warn("未指定 --remote-socks-allow，反向 SOCKS5 将拒绝所有请求")
+			}
+		}
+	}
+
 	sshClient := &SSHClient{
-		logger:      log,
-		jumpClients: []*ssh.Client{},
+		cfg:      cfg,
+		logger:   log,
+		hostKeys: hostKeys,
+		keys:     keys,
+		dialHop:  dialHop,
+
+		remoteForwards: remoteForwards,
+		reverseDialer:  reverseDialer,
+		passwords:      make(map[string]string),
+	}
+	sshClient.agent, sshClient.agentConn = dialAgent(log)
+
+	// 第一个连接失败直接返回错误；其余连接复用已缓存的密码和私钥，失败时在后台重连
+	conns := cfg.SSHConns
+	if conns < 1 {
+		conns = 1
 	}
+	for i := 1; i <= conns; i++ {
+		if conns > 1 {
+			log.Infof("建立 SSH 连接 %d/%d", i, conns)
+		}
+		chain, err := sshClient.connectChain(i == 1)
+		if err != nil {
+			if i == 1 {
+				sshClient.Close()
+				return nil, err
+			}
+			log.Warnf("SSH 连接 #%d 建立失败: %v，将在后台重试", i, err)
+		}
+		sshClient.links = append(sshClient.links, newSSHLink(sshClient, i, chain))
+	}
+	return sshClient, nil
+}
+
+// connectChain 依次连接所有跳板机和目标服务器，建立一条完整的链路。
+// 连接池中只有 primary 链路转发 ssh-agent 和建立远程端口转发
+func (s *SSHClient) connectChain(primary bool) (*sshChain, error) {
+	cfg, log := s.cfg, s.logger
+	chain := &sshChain{dead: make(chan struct{})}
 
 	// 尝试连接所有跳板机
 	for i, jumpHostsStr := range cfg.JumpHosts {
-		user, host, port, err := cfg.GetJumpHostInfo(jumpHostsStr)
+		hop, err := cfg.GetJumpHostInfo(jumpHostsStr)
 		if err != nil {
 			log.Errorf("跳板机参数解析失败: %v", err)
-			sshClient.Close()
+			chain.close()
 			return nil, err
 		}
-		if user == "" {
-			user = cfg.SSHUser
-		}
-		addr := fmt.Sprintf("%s:%s", host, port)
+		user, addr := hop.User, hop.Addr()
 		log.Infof("准备连接跳板机 %d/%d: %s", i+1, len(cfg.JumpHosts), addr)
 
 		var lastClient *ssh.Client
-		if len(sshClient.jumpClients) > 0 {
-			lastClient = sshClient.jumpClients[len(sshClient.jumpClients)-1]
+		if len(chain.jumps) > 0 {
+			lastClient = chain.jumps[len(chain.jumps)-1]
 		}
 
-		client, err := connectToHost(cfg, log, user, addr, lastClient)
+		client, err := s.connectToHost(cfg, hop, lastClient)
 		if err != nil {
-			log.Errorf("连接跳板机 %s 失败: %v", addr, err)
-			sshClient.Close()
-			return nil, err
+			log.Errorf("连接跳板机 %d (%s@%s) 失败: %v", i+1, user, addr, err)
+			chain.close()
+			return nil, fmt.Errorf("跳板机 %d (%s@%s): %w", i+1, user, addr, err)
 		}
-		sshClient.jumpClients = append(sshClient.jumpClients, client)
+		chain.jumps = append(chain.jumps, client)
 		log.Infof("已连接跳板机 %d: %s@%s", i+1, user, addr)
 	}
 
 	// 准备连接最终目标服务器
 	log.Infof("准备连接目标服务器: %s", cfg.SSHServer)
 	var lastJumpClient *ssh.Client
-	if len(sshClient.jumpClients) > 0 {
-		lastJumpClient = sshClient.jumpClients[len(sshClient.jumpClients)-1]
+	if len(chain.jumps) > 0 {
+		lastJumpClient = chain.jumps[len(chain.jumps)-1]
 	}
 
-	finalClient, err := connectToHost(cfg, log, cfg.SSHUser, cfg.SSHServer, lastJumpClient)
+	finalClient, err := s.connectToHost(cfg, cfg.TargetHost(), lastJumpClient)
 	if err != nil {
-		log.Errorf("连接目标服务器 %s 失败: %v", cfg.SSHServer, err)
-		sshClient.Close()
-		return nil, err
+		log.Errorf("连接目标服务器 %s@%s 失败: %v", cfg.SSHUser, cfg.SSHServer, err)
+		chain.close()
+		return nil, fmt.Errorf("目标服务器 %s@%s: %w", cfg.SSHUser, cfg.SSHServer, err)
 	}
 
-	sshClient.client = finalClient
+	chain.client = finalClient
 	log.Infof("已连接到目标服务器: %s", cfg.SSHServer)
-	return sshClient, nil
+
+	if cfg.ForwardAgent && primary {
+		session, err := forwardAgent(finalClient, log)
+		if err != nil {
+			log.Warnf("ssh-agent 转发失败: %v", err)
+		} else {
+			chain.agentFwd = session
+		}
+	}
+	if primary {
+		chain.remote = s.startRemoteForwards(finalClient)
+	}
+	return chain, nil
 }
 
 // connectToHost 封装了连接单个主机（跳板机或最终目标）的完整逻辑
-func connectToHost(cfg *config.Config, log *logger.Logger, user, addr string, jumpVia *ssh.Client) (*ssh.Client, error) {
-	// 阶段一：仅尝试私钥认证
-	log.Debugf("阶段 1: 尝试使用私钥连接 %s", addr)
-	keyAuthCfg := &AuthConfig{User: user, ServerAddr: addr, KeyFile: cfg.SSHKeyFile}
-	keyAuths, err := getAuthMethods(keyAuthCfg, log, false) // false表示获取私钥
-	if err == nil && len(keyAuths) > 0 {
-		client, err := trySingleConnection(user, addr, cfg.Timeout, keyAuths, jumpVia)
-		if err == nil {
-			log.Debugf("私钥认证成功: %s", addr)
-			return client, nil // 私钥成功，直接返回
-		}
-		log.Warnf("私钥认证失败: %v。将尝试其他方法...", err)
-	} else if err != nil {
-		log.Debugf("获取私钥方法时出错: %v", err)
-	}
-
-	// 阶段二：如果私钥失败，并且配置了密码/交互模式，则尝试它们
-	if cfg.InteractiveAuth || cfg.SSHPassword != "" {
-		log.Debugf("阶段 2: 尝试使用密码/交互式认证连接 %s", addr)
-		passwordAuthCfg := &AuthConfig{User: user, ServerAddr: addr, Password: cfg.SSHPassword, InteractiveAuth: cfg.InteractiveAuth}
-		passwordAuths, err := getAuthMethods(passwordAuthCfg, log, true) // true表示仅获取密码
-		if err == nil && len(passwordAuths) > 0 {
-			client, err := trySingleConnection(user, addr, cfg.Timeout, passwordAuths, jumpVia)
-			if err == nil {
-				log.Debugf("密码/交互式认证成功: %s", addr)
-				return client, nil
-			}
-			log.Warnf("密码/交互式认证失败: %v", err)
-		} else if err != nil {
-			log.Debugf("获取密码方法时出错: %v", err)
+func (s *SSHClient) connectToHost(cfg *config.Config, host config.SSHHost, jumpVia *ssh.Client) (*ssh.Client, error) {
+	log := s.logger
+	hostKeys := s.hostKeys
+	user, addr := host.User, host.Addr()
+
+	// -J 中为该跳指定的私钥代替 -i，其次是 ~/.ssh/config 中的 IdentityFile
+	var keyFiles []string
+	if host.KeyFile != "" {
+		keyFiles = append(keyFiles, host.KeyFile)
+	} else if cfg.SSHKeyFile != "" {
+		keyFiles = append(keyFiles, cfg.SSHKeyFile)
+	}
+	keyFiles = append(keyFiles, host.IdentityFiles...)
+
+	var certFiles []string
+	if cfg.CertificateFile != "" {
+		certFiles = append(certFiles, cfg.CertificateFile)
+	}
+	certFiles = append(certFiles, host.CertificateFiles...)
+
+	password := cfg.SSHPassword
+	if host.PasswordFile != "" || host.PasswordEnv != "" {
+		hopPassword, err := host.HopPassword()
+		if err != nil {
+			return nil, fmt.Errorf("获取密码失败: %v", err)
+		}
+		password = hopPassword
+	}
+	timeout := cfg.Timeout
+	if host.Timeout > 0 {
+		timeout = host.Timeout
+	}
+
+	authCfg := &AuthConfig{
+		User:            user,
+		Password:        password,
+		KeyFiles:        keyFiles,
+		CertFiles:       certFiles,
+		IdentitiesOnly:  host.IdentitiesOnly,
+		ServerAddr:      addr,
+		InteractiveAuth: cfg.InteractiveAuth,
+		Agent:           s.agent,
+	}
+	dl := &handshakeDeadline{timeout: timeout}
+	auths, err := s.getAuthMethods(authCfg, dl)
+	if err != nil {
+		return nil, err
+	}
+
+	client, err := s.trySingleConnection(host, auths, jumpVia, hostKeys, dl)
+	if err != nil {
+		if isHostKeyError(err) || isDialError(err) {
+			return nil, err
 		}
+		s.forgetPassword(user, addr)
+		return nil, fmt.Errorf("认证失败: %w", err)
 	}
+	log.Debugf("认证成功: %s@%s", user, addr)
+	return client, nil
+}
+
+// dialError 表示无法建立到主机的传输连接，此时换用其它认证方式没有意义
+type dialError struct {
+	err error
+}
 
-	return nil, fmt.Errorf("所有认证方法均失败")
+func (e *dialError) Error() string { return e.err.Error() }
+func (e *dialError) Unwrap() error { return e.err }
+
+func isDialError(err error) bool {
+	var dErr *dialError
+	return errors.As(err, &dErr)
 }
 
 // trySingleConnection 尝试使用给定的认证方法进行一次连接
-func trySingleConnection(user, addr string, timeout time.Duration, auths []ssh.AuthMethod, jumpVia *ssh.Client) (*ssh.Client, error) {
+func (s *SSHClient) trySingleConnection(host config.SSHHost, auths []ssh.AuthMethod, jumpVia *ssh.Client, hostKeys *hostKeyChecker, dl *handshakeDeadline) (*ssh.Client, error) {
+	user, addr := host.User, host.Addr()
+	timeout := dl.timeout
+	var conn net.Conn
+	var err error
+
 	sshConfig := &ssh.ClientConfig{
-		User:            user,
-		Auth:            auths,
-		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
-		Timeout:         timeout,
+		User: user,
+		Auth: auths,
+		// 校验主机密钥时可能需要用户确认，期间暂停握手超时
+		HostKeyCallback: func(hostname string, remote net.Addr, key ssh.PublicKey) error {
+			dl.pause()
+			defer dl.resume()
+			return hostKeys.check(hostname, remote, key)
+		},
+		HostKeyAlgorithms: hostKeys.algorithms(addr),
+		Timeout:           timeout,
 	}
 
 	if jumpVia == nil {
-		// 直接连接
-		return ssh.Dial("tcp", addr, sshConfig)
+		// 第一跳: 直接连接或经由上游代理、ProxyCommand
+		conn, err = s.dialHop(host, timeout)
+		if err != nil {
+			return nil, &dialError{err: err}
+		}
+	} else {
+		// 通过跳板机连接
+		conn, err = jumpVia.Dial("tcp", addr)
+		if err != nil {
+			return nil, &dialError{err: fmt.Errorf("通过跳板机隧道连接到 %s 失败: %v", addr, err)}
+		}
 	}
 
-	// 通过跳板机连接
-	conn, err := jumpVia.Dial("tcp", addr)
-	if err != nil {
-		return nil, fmt.Errorf("通过跳板机隧道连接到 %s 失败: %v", addr, err)
-	}
+	// 握手阶段同样受超时限制，避免服务器无响应时一直阻塞
+	dl.start(conn)
 	c, chans, reqs, err := ssh.NewClientConn(conn, addr, sshConfig)
+	dl.stop()
 	if err != nil {
 		conn.Close()
-		return nil, fmt.Errorf("在跳板机隧道上建立SSH连接到 %s 失败: %v", addr, err)
+		if jumpVia != nil {
+			return nil, fmt.Errorf("在跳板机隧道上建立SSH连接到 %s 失败: %w", addr, err)
+		}
+		return nil, err
 	}
 	return ssh.NewClient(c, chans, reqs), nil
 }
 
-// Close 关闭所有连接（逆序关闭跳板机）
+// Close 关闭所有连接
 func (s *SSHClient) Close() error {
-	if s.client != nil {
-		s.logger.Debug("关闭目标SSH连接")
-		s.client.Close()
-	}
-	if s.jumpClients != nil {
-		for i := len(s.jumpClients) - 1; i >= 0; i-- {
-			if s.jumpClients[i] != nil {
-				s.logger.Debugf("关闭跳板机连接 %d", i+1)
-				s.jumpClients[i].Close()
-			}
-		}
+	for _, l := range s.links {
+		l.close()
+	}
+	if s.agentConn != nil {
+		s.agentConn.Close()
+		s.agentConn = nil
 	}
-	s.jumpClients = nil
 	return nil
 }
 
-func loadPrivateKey(path string) (ssh.Signer, error) {
-	expanded := path
-	if strings.HasPrefix(path, "~/") {
-		home, err := os.UserHomeDir()
+// 增加Dial方法的实现，使其满足常见的 Dialer 接口。
+// 连接正在重连时等待其恢复，最长等待 cfg.Timeout
+func (s *SSHClient) Dial(network, addr string) (net.Conn, error) {
+	if len(s.links) == 0 {
+		return nil, fmt.Errorf("ssh client not ready")
+	}
+	for retried := false; ; retried = true {
+		link := s.pickLink()
+		chain, err := link.get(s.cfg.Timeout)
 		if err != nil {
-			return nil, fmt.Errorf("无法展开 ~ 路径: %v", err)
+			return nil, err
+		}
+		conn, err := chain.client.Dial(network, addr)
+		if err == nil {
+			return link.track(conn), nil
 		}
-		expanded = filepath.Join(home, path[2:])
+
+		// 服务器拒绝打开通道说明连接本身正常，直接返回错误
+		var openErr *ssh.OpenChannelError
+		if retried || errors.As(err, &openErr) || !chain.waitDead(time.Second) {
+			return nil, err
+		}
+		s.logger.Debugf("连接已断开，等待重连后重试 %s: %v", addr, err)
 	}
+}
 
-	key, err := os.ReadFile(expanded)
-	if err != nil {
-		return nil, fmt.Errorf("读取私钥文件 '%s' 失败: %v", expanded, err)
+// Ready 判断是否至少有一个连接可用 (未在重连中)
+func (s *SSHClient) Ready() bool {
+	for _, l := range s.links {
+		if ready, _ := l.state(); ready {
+			return true
+		}
 	}
+	return false
+}
 
-	signer, err := ssh.ParsePrivateKey(key)
-	if err != nil {
-		// 为密码保护的私钥提供更友好的错误提示
-		if _, ok := err.(*ssh.PassphraseMissingError); ok {
-			return nil, fmt.Errorf("私钥 '%s' 受密码保护，暂不支持自动处理", expanded)
+// linkErr 在所有连接都不可用时返回原因: 放弃重连时的最终错误，或最近一次断开、重连失败的错误。
+// 至少有一个连接可用时返回 nil
+func (s *SSHClient) linkErr() error {
+	var firstErr error
+	for _, l := range s.links {
+		l.mu.Lock()
+		ready, err := l.chain != nil, l.err
+		if err == nil {
+			err = l.down
+		}
+		l.mu.Unlock()
+		if ready {
+			return nil
+		}
+		if firstErr == nil {
+			firstErr = err
 		}
-		return nil, fmt.Errorf("解析私钥文件 '%s' 失败: %v", expanded, err)
 	}
+	if firstErr == nil {
+		firstErr = fmt.Errorf("SSH 连接不可用")
+	}
+	return firstErr
+}
 
-	return signer, nil
+// Ping 通过可用连接发送 keepalive 请求，返回往返时间。
+// 该请求经过完整的跳板机链，反映的是到目标服务器的实际延迟。某个连接无响应时尝试其余连接
+func (s *SSHClient) Ping() (time.Duration, error) {
+	lastErr := fmt.Errorf("SSH 连接不可用")
+	for _, l := range s.links {
+		l.mu.Lock()
+		chain := l.chain
+		l.mu.Unlock()
+		if chain == nil {
+			continue
+		}
+		rtt, err := pingChain(chain, s.cfg.Timeout)
+		if err == nil {
+			return rtt, nil
+		}
+		lastErr = err
+	}
+	return 0, lastErr
 }
 
-// 增加Dial方法的实现，使其满足常见的 Dialer 接口
-func (s *SSHClient) Dial(network, addr string) (net.Conn, error) {
-	if s.client == nil {
-		return nil, fmt.Errorf("ssh client not ready")
+// pingChain 在链路上发送一次 keepalive 请求
+func pingChain(chain *sshChain, timeout time.Duration) (time.Duration, error) {
+	start := time.Now()
+	result := make(chan error, 1)
+	go func() {
+		_, _, err := chain.client.SendRequest("keepalive@openssh.com", true, nil)
+		result <- err
+	}()
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case err := <-result:
+		if err != nil {
+			return 0, err
+		}
+		return time.Since(start), nil
+	case <-timer.C:
+		return 0, fmt.Errorf("等待响应超时")
+	}
+}
+
+// HandshakeLatency 新建一条到目标服务器的传输连接并完成 SSH 密钥交换，返回所用的时间。
+// 收到主机密钥后立即断开，不进行认证，因此不会询问密码。经由跳板机时通过已建立的跳板机连接，
+// 测量的是最后一跳到目标服务器的延迟
+func (s *SSHClient) HandshakeLatency() (time.Duration, error) {
+	target := s.cfg.TargetHost()
+	addr := target.Addr()
+	timeout := s.cfg.Timeout
+
+	start := time.Now()
+	var conn net.Conn
+	var err error
+	if len(s.cfg.JumpHosts) == 0 {
+		conn, err = s.dialHop(target, timeout)
+	} else {
+		conn, err = s.dialViaJumps(addr)
+	}
+	if err != nil {
+		return 0, err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(timeout))
+
+	// 回调在 ssh 包的密钥交换 goroutine 中执行
+	var latency atomic.Int64
+	sshConfig := &ssh.ClientConfig{
+		User: target.User,
+		HostKeyCallback: func(string, net.Addr, ssh.PublicKey) error {
+			latency.Store(int64(time.Since(start)))
+			return errHandshakeProbe
+		},
+		HostKeyAlgorithms: s.hostKeys.algorithms(addr),
+		Timeout:           timeout,
+	}
+	if _, _, _, err := ssh.NewClientConn(conn, addr, sshConfig); latency.Load() == 0 {
+		return 0, fmt.Errorf("SSH 握手失败: %w", err)
+	}
+	return time.Duration(latency.Load()), nil
+}
+
+// errHandshakeProbe 在收到主机密钥后中止 HandshakeLatency 的握手
+var errHandshakeProbe = errors.New("握手探测完成")
+
+// dialViaJumps 通过任一可用链路的最后一个跳板机连接 addr
+func (s *SSHClient) dialViaJumps(addr string) (net.Conn, error) {
+	for _, l := range s.links {
+		l.mu.Lock()
+		chain := l.chain
+		l.mu.Unlock()
+		if chain == nil || len(chain.jumps) == 0 {
+			continue
+		}
+		return chain.jumps[len(chain.jumps)-1].Dial("tcp", addr)
+	}
+	return nil, fmt.Errorf("跳板机连接不可用")
+}
+
+// pickLink 选择活动通道最少的可用连接；都在重连时返回第一个仍在重连的连接
+func (s *SSHClient) pickLink() *sshLink {
+	var best, fallback *sshLink
+	for _, l := range s.links {
+		ready, failed := l.state()
+		if failed {
+			continue
+		}
+		if fallback == nil {
+			fallback = l
+		}
+		if ready && (best == nil || l.active.Load() < best.active.Load()) {
+			best = l
+		}
+	}
+	if best != nil {
+		return best
+	}
+	if fallback != nil {
+		return fallback
 	}
-	return s.client.Dial(network, addr)
+	return s.links[0]
 }
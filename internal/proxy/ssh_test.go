@@ -0,0 +1,280 @@
+package proxy
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"io"
+	"net"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+
+	"github.com/Sesame2/gotun/internal/config"
+	"github.com/Sesame2/gotun/internal/logger"
+)
+
+// testSSHServer 是测试用的 SSH 服务器，接受密码 "secret"，支持 direct-tcpip 以便作为跳板机
+type testSSHServer struct {
+	addr    string
+	hostKey ssh.Signer
+	auths   atomic.Int32 // 认证尝试次数
+}
+
+func startTestSSHServer(t *testing.T) *testSSHServer {
+	t.Helper()
+	return startTestSSHServerWithKey(t, newTestSigner(t))
+}
+
+// startTestSSHServerWithKey 使用指定的主机密钥 (可以是证书) 启动测试服务器
+func startTestSSHServerWithKey(t *testing.T, signer ssh.Signer) *testSSHServer {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+
+	s := &testSSHServer{addr: ln.Addr().String(), hostKey: signer}
+	cfg := &ssh.ServerConfig{
+		PasswordCallback: func(_ ssh.ConnMetadata, password []byte) (*ssh.Permissions, error) {
+			s.auths.Add(1)
+			if string(password) == "secret" {
+				return nil, nil
+			}
+			return nil, io.EOF
+		},
+	}
+	cfg.AddHostKey(signer)
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go s.serve(conn, cfg)
+		}
+	}()
+	return s
+}
+
+func newTestSigner(t *testing.T) ssh.Signer {
+	t.Helper()
+	_, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signer, err := ssh.NewSignerFromKey(priv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signer
+}
+
+func (s *testSSHServer) serve(conn net.Conn, cfg *ssh.ServerConfig) {
+	sconn, chans, reqs, err := ssh.NewServerConn(conn, cfg)
+	if err != nil {
+		conn.Close()
+		return
+	}
+	defer sconn.Close()
+	go ssh.DiscardRequests(reqs)
+	for nc := range chans {
+		if nc.ChannelType() != "direct-tcpip" {
+			nc.Reject(ssh.UnknownChannelType, "不支持")
+			continue
+		}
+		var target struct {
+			Host     string
+			Port     uint32
+			OrigHost string
+			OrigPort uint32
+		}
+		if err := ssh.Unmarshal(nc.ExtraData(), &target); err != nil {
+			nc.Reject(ssh.ConnectionFailed, err.Error())
+			continue
+		}
+		out, err := net.Dial("tcp", net.JoinHostPort(target.Host, strconv.Itoa(int(target.Port))))
+		if err != nil {
+			nc.Reject(ssh.ConnectionFailed, err.Error())
+			continue
+		}
+		ch, creqs, err := nc.Accept()
+		if err != nil {
+			out.Close()
+			continue
+		}
+		go ssh.DiscardRequests(creqs)
+		go func() {
+			io.Copy(ch, out)
+			ch.CloseWrite()
+		}()
+		go func() {
+			io.Copy(out, ch)
+			out.Close()
+		}()
+	}
+}
+
+// testClientConfig 返回连接测试服务器的配置，不使用本机的私钥、ssh-agent 和 known_hosts
+func testClientConfig(t *testing.T, addr string) *config.Config {
+	t.Helper()
+	t.Setenv("HOME", t.TempDir())
+	t.Setenv("SSH_AUTH_SOCK", "")
+	cfg := config.NewConfig()
+	cfg.SSHServer = addr
+	cfg.SSHUser = "test"
+	cfg.SSHPassword = "secret"
+	cfg.InteractiveAuth = false
+	cfg.HostKeyCheck = HostKeyCheckNo
+	cfg.KeepAliveInterval = 0
+	cfg.Reconnect = false
+	cfg.Timeout = 2 * time.Second
+	return cfg
+}
+
+func newTestSSHClient(t *testing.T, cfg *config.Config) *SSHClient {
+	t.Helper()
+	c, err := newSSHClient(cfg, logger.NewLogger(false), nil)
+	if err != nil {
+		t.Fatalf("连接测试服务器失败: %v", err)
+	}
+	t.Cleanup(func() { c.Close() })
+	return c
+}
+
+func TestHandshakeLatency(t *testing.T) {
+	jump := startTestSSHServer(t)
+	target := startTestSSHServer(t)
+
+	direct := newTestSSHClient(t, testClientConfig(t, target.addr))
+	viaJump := testClientConfig(t, target.addr)
+	viaJump.JumpHosts = []string{"test@" + jump.addr}
+	chained := newTestSSHClient(t, viaJump)
+
+	for name, c := range map[string]*SSHClient{"直接连接": direct, "经由跳板机": chained} {
+		before := target.auths.Load()
+		latency, err := c.HandshakeLatency()
+		if err != nil {
+			t.Fatalf("%s: HandshakeLatency 失败: %v", name, err)
+		}
+		if latency <= 0 {
+			t.Errorf("%s: 延迟 = %v", name, latency)
+		}
+		// 探测只做密钥交换，不发送认证
+		if got := target.auths.Load(); got != before {
+			t.Errorf("%s: 探测时进行了 %d 次认证", name, got-before)
+		}
+	}
+
+	if _, err := direct.Ping(); err != nil {
+		t.Errorf("Ping 失败: %v", err)
+	}
+}
+
+// TestUpstreamProbeParallel 确认无响应的上游不会拖慢其它上游的探测
+func TestUpstreamProbeParallel(t *testing.T) {
+	good := startTestSSHServer(t)
+	cfg := testClientConfig(t, good.addr)
+	cfg.Timeout = 500 * time.Millisecond
+
+	// 接受连接但从不响应的服务器
+	var mu sync.Mutex
+	var held []net.Conn
+	hang, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer hang.Close()
+	go func() {
+		for {
+			conn, err := hang.Accept()
+			if err != nil {
+				return
+			}
+			mu.Lock()
+			held = append(held, conn)
+			mu.Unlock()
+		}
+	}()
+	defer func() {
+		mu.Lock()
+		for _, c := range held {
+			c.Close()
+		}
+		mu.Unlock()
+	}()
+
+	log := logger.NewLogger(false)
+	g := &UpstreamGroup{logger: log, keys: newKeyStore(log), done: make(chan struct{})}
+	defer g.Close()
+	for i := 0; i < 3; i++ {
+		c := *cfg
+		c.SSHServer = hang.Addr().String()
+		g.upstreams = append(g.upstreams, &upstream{cfg: &c, name: "hang" + strconv.Itoa(i)})
+	}
+	fine := &upstream{cfg: cfg, name: "good", client: newTestSSHClient(t, cfg)}
+	g.upstreams = append(g.upstreams, fine)
+
+	start := time.Now()
+	g.probe()
+	if elapsed := time.Since(start); elapsed > 3*cfg.Timeout/2 {
+		t.Errorf("探测用时 %v, 各上游应同时探测", elapsed)
+	}
+	if !fine.healthy || fine.latency <= 0 {
+		t.Errorf("正常的上游探测结果: healthy=%v latency=%v", fine.healthy, fine.latency)
+	}
+	if g.active != fine {
+		t.Errorf("当前上游应为 good")
+	}
+}
+
+// TestUpstreamProbeLinkDown 确认已建立的连接断开后，即使服务器仍能完成握手，
+// 该上游也被视为不可用并切换到其它上游
+func TestUpstreamProbeLinkDown(t *testing.T) {
+	srvA := startTestSSHServer(t)
+	srvB := startTestSSHServer(t)
+	log := logger.NewLogger(false)
+	g := &UpstreamGroup{logger: log, keys: newKeyStore(log), done: make(chan struct{})}
+	defer g.Close()
+	a := &upstream{cfg: testClientConfig(t, srvA.addr), name: "a"}
+	a.client = newTestSSHClient(t, a.cfg)
+	b := &upstream{cfg: testClientConfig(t, srvB.addr), name: "b"}
+	b.client = newTestSSHClient(t, b.cfg)
+	g.upstreams = []*upstream{a, b}
+
+	g.probe()
+	if !a.healthy || !b.healthy {
+		t.Fatalf("探测结果: a=%v b=%v, 期望都可用", a.healthy, b.healthy)
+	}
+	g.mu.Lock()
+	g.active = a
+	g.mu.Unlock()
+
+	// 断开 a 已建立的连接 (未开启重连)，服务器本身仍然正常
+	a.client.links[0].mu.Lock()
+	a.client.links[0].chain.client.Close()
+	a.client.links[0].mu.Unlock()
+	deadline := time.Now().Add(2 * time.Second)
+	for a.client.linkErr() == nil {
+		if time.Now().After(deadline) {
+			t.Fatal("连接断开后 linkErr 仍为 nil")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	// 服务器仍能握手，单靠握手探测无法发现连接已断开
+	if _, err := a.client.HandshakeLatency(); err != nil {
+		t.Fatalf("HandshakeLatency 失败: %v", err)
+	}
+
+	g.probe()
+	if a.healthy {
+		t.Error("连接已断开的上游应不可用")
+	}
+	if g.active != b {
+		t.Errorf("当前上游应切换到 b")
+	}
+}
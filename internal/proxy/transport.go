@@ -0,0 +1,236 @@
+package proxy
+
+import (
+	"bufio"
+	"context"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"runtime"
+	"time"
+
+	xproxy "golang.org/x/net/proxy"
+
+	"github.com/Sesame2/gotun/internal/config"
+	"github.com/Sesame2/gotun/internal/logger"
+	"github.com/Sesame2/gotun/internal/sshconfig"
+)
+
+// hopDialer 建立到第一跳的传输连接，之后的各跳经由前一跳的 SSH 隧道连接
+type hopDialer func(host config.SSHHost, timeout time.Duration) (net.Conn, error)
+
+// newHopDialer 按配置选择第一跳的连接方式，优先级为 --proxy-command、--proxy、
+// 第一跳在 ~/.ssh/config 中的 ProxyCommand，都未配置时直接连接
+func newHopDialer(cfg *config.Config, log *logger.Logger) (hopDialer, error) {
+	var dial hopDialer
+	if cfg.Proxy != "" {
+		u, err := config.ParseProxyURL(cfg.Proxy)
+		if err != nil {
+			return nil, err
+		}
+		log.Infof("通过上游代理 %s://%s 连接第一跳", u.Scheme, u.Host)
+		if u.Scheme == "http" {
+			dial = httpConnectDialer(u)
+		} else {
+			dial = socks5Dialer(u)
+		}
+	}
+
+	return func(host config.SSHHost, timeout time.Duration) (net.Conn, error) {
+		command := host.ProxyCommand
+		if cfg.ProxyCommand != "" {
+			// %n 为命令行或 -J 中给出的原始主机名，%h 为解析后的 HostName
+			alias := host.Alias
+			if alias == "" {
+				alias = host.Host
+			}
+			hc := &sshconfig.Host{Alias: alias}
+			command = hc.ExpandTokens(cfg.ProxyCommand, host.Host, host.User, host.Port)
+		} else if dial != nil {
+			return dial(host, timeout)
+		}
+		if command != "" {
+			log.Debugf("通过 ProxyCommand 连接 %s: %s", host.Addr(), command)
+			return dialCommand(command, host.Addr(), timeout, log)
+		}
+		return net.DialTimeout("tcp", host.Addr(), timeout)
+	}, nil
+}
+
+// httpConnectDialer 通过 HTTP CONNECT 代理建立隧道
+func httpConnectDialer(u *url.URL) hopDialer {
+	return func(host config.SSHHost, timeout time.Duration) (net.Conn, error) {
+		addr := host.Addr()
+		conn, err := net.DialTimeout("tcp", u.Host, timeout)
+		if err != nil {
+			return nil, fmt.Errorf("连接 HTTP 代理 %s 失败: %w", u.Host, err)
+		}
+		conn.SetDeadline(time.Now().Add(timeout))
+
+		req := &http.Request{
+			Method: http.MethodConnect,
+			URL:    &url.URL{Opaque: addr},
+			Host:   addr,
+			Header: make(http.Header),
+		}
+		if u.User != nil {
+			password, _ := u.User.Password()
+			cred := base64.StdEncoding.EncodeToString([]byte(u.User.Username() + ":" + password))
+			req.Header.Set("Proxy-Authorization", "Basic "+cred)
+		}
+		if err := req.Write(conn); err != nil {
+			conn.Close()
+			return nil, fmt.Errorf("发送 CONNECT 请求失败: %w", err)
+		}
+
+		br := bufio.NewReader(conn)
+		resp, err := http.ReadResponse(br, req)
+		if err != nil {
+			conn.Close()
+			return nil, fmt.Errorf("读取 HTTP 代理响应失败: %w", err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			conn.Close()
+			return nil, fmt.Errorf("HTTP 代理拒绝连接到 %s: %s", addr, resp.Status)
+		}
+		conn.SetDeadline(time.Time{})
+
+		// SSH 服务器会立即发送版本信息，可能已被读入缓冲区
+		return &bufferedConn{Conn: conn, r: br}, nil
+	}
+}
+
+// bufferedConn 先读取 bufio.Reader 中已缓冲的数据
+type bufferedConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (c *bufferedConn) Read(p []byte) (int, error) {
+	return c.r.Read(p)
+}
+
+// socks5Dialer 通过 SOCKS5 代理连接，支持用户名密码认证
+func socks5Dialer(u *url.URL) hopDialer {
+	var auth *xproxy.Auth
+	if u.User != nil {
+		password, _ := u.User.Password()
+		auth = &xproxy.Auth{User: u.User.Username(), Password: password}
+	}
+	return func(host config.SSHHost, timeout time.Duration) (net.Conn, error) {
+		d, err := xproxy.SOCKS5("tcp", u.Host, auth, &net.Dialer{Timeout: timeout})
+		if err != nil {
+			return nil, err
+		}
+		// SOCKS5 握手同样受超时限制
+		ctx, cancel := context.WithTimeout(context.Background(), timeout)
+		defer cancel()
+		conn, err := d.(xproxy.ContextDialer).DialContext(ctx, "tcp", host.Addr())
+		if err != nil {
+			return nil, fmt.Errorf("通过 SOCKS5 代理 %s 连接失败: %w", u.Host, err)
+		}
+		return conn, nil
+	}
+}
+
+// dialCommand 启动 ProxyCommand，用其标准输入输出承载 SSH 连接。
+// 命令的标准错误直接输出到终端，与 OpenSSH 一致。
+// 命令在 timeout 内没有任何输出 (SSH 服务器会先发送版本信息) 时结束命令
+func dialCommand(command, addr string, timeout time.Duration, log *logger.Logger) (net.Conn, error) {
+	var cmd *exec.Cmd
+	if runtime.GOOS == "windows" {
+		cmd = exec.Command("cmd", "/C", command)
+	} else {
+		cmd = exec.Command("/bin/sh", "-c", command)
+	}
+	cmd.Stderr = os.Stderr
+
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return nil, err
+	}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+	if err := cmd.Start(); err != nil {
+		return nil, fmt.Errorf("启动 ProxyCommand 失败: %w", err)
+	}
+
+	// 通过 net.Pipe 转接，使握手超时等 deadline 设置对命令同样有效
+	local, remote := net.Pipe()
+	go func() {
+		io.Copy(stdin, remote)
+		stdin.Close()
+	}()
+
+	c := &commandConn{Conn: local, cmd: cmd, addr: addr, exited: make(chan struct{})}
+	var output io.Reader = stdout
+	if timeout > 0 {
+		timer := time.AfterFunc(timeout, func() {
+			log.Warnf("ProxyCommand 在 %v 内没有输出，已结束: %s", timeout, command)
+			cmd.Process.Kill()
+		})
+		output = &firstReadReader{r: stdout, first: func() { timer.Stop() }}
+	}
+	go func() {
+		// 读完标准输出后才能调用 Wait
+		io.Copy(remote, output)
+		remote.Close()
+		if err := cmd.Wait(); err != nil {
+			log.Debugf("ProxyCommand 已退出: %v", err)
+		}
+		close(c.exited)
+	}()
+	return c, nil
+}
+
+// firstReadReader 在第一次读到数据时调用 first
+type firstReadReader struct {
+	r     io.Reader
+	first func()
+	done  bool
+}
+
+func (r *firstReadReader) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	if n > 0 && !r.done {
+		r.done = true
+		r.first()
+	}
+	return n, err
+}
+
+// commandConn 是 ProxyCommand 的连接，关闭时结束命令
+type commandConn struct {
+	net.Conn
+	cmd    *exec.Cmd
+	addr   string
+	exited chan struct{}
+}
+
+func (c *commandConn) Close() error {
+	err := c.Conn.Close()
+	select {
+	case <-c.exited:
+	default:
+		c.cmd.Process.Kill()
+	}
+	return err
+}
+
+// RemoteAddr 返回目标地址，known_hosts 校验需要 host:port 形式的地址
+func (c *commandConn) RemoteAddr() net.Addr {
+	return commandAddr(c.addr)
+}
+
+type commandAddr string
+
+func (a commandAddr) Network() string { return "proxy-command" }
+func (a commandAddr) String() string  { return string(a) }
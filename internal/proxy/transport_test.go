@@ -0,0 +1,252 @@
+package proxy
+
+import (
+	"bufio"
+	"encoding/binary"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Sesame2/gotun/internal/config"
+	"github.com/Sesame2/gotun/internal/logger"
+	"github.com/Sesame2/gotun/internal/sshconfig"
+)
+
+// startTestProxy 启动一个测试代理，handshake 完成握手并返回客户端请求的目标地址
+func startTestProxy(t *testing.T, handshake func(conn net.Conn, br *bufio.Reader) (string, bool)) string {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				br := bufio.NewReader(conn)
+				target, ok := handshake(conn, br)
+				if !ok {
+					return
+				}
+				out, err := net.Dial("tcp", target)
+				if err != nil {
+					return
+				}
+				defer out.Close()
+				go io.Copy(out, br)
+				io.Copy(conn, out)
+			}()
+		}
+	}()
+	return ln.Addr().String()
+}
+
+// httpConnectHandshake 处理 CONNECT 请求，要求 Basic 认证 user:pass
+func httpConnectHandshake(conn net.Conn, br *bufio.Reader) (string, bool) {
+	req, err := http.ReadRequest(br)
+	if err != nil || req.Method != http.MethodConnect {
+		return "", false
+	}
+	user, pass, ok := (&http.Request{Header: http.Header{"Authorization": req.Header["Proxy-Authorization"]}}).BasicAuth()
+	if !ok || user != "user" || pass != "pass" {
+		io.WriteString(conn, "HTTP/1.1 407 Proxy Authentication Required\r\n\r\n")
+		return "", false
+	}
+	io.WriteString(conn, "HTTP/1.1 200 Connection established\r\n\r\n")
+	return req.Host, true
+}
+
+// socks5Handshake 处理 SOCKS5 CONNECT 请求，要求用户名密码认证 user:pass
+func socks5Handshake(conn net.Conn, br *bufio.Reader) (string, bool) {
+	head := make([]byte, 2)
+	if _, err := io.ReadFull(br, head); err != nil {
+		return "", false
+	}
+	methods := make([]byte, head[1])
+	if _, err := io.ReadFull(br, methods); err != nil {
+		return "", false
+	}
+	conn.Write([]byte{0x05, 0x02})
+
+	// RFC 1929 用户名密码认证
+	readField := func() string {
+		n, err := br.ReadByte()
+		if err != nil {
+			return ""
+		}
+		b := make([]byte, n)
+		io.ReadFull(br, b)
+		return string(b)
+	}
+	if v, err := br.ReadByte(); err != nil || v != 0x01 {
+		return "", false
+	}
+	if readField() != "user" || readField() != "pass" {
+		conn.Write([]byte{0x01, 0x01})
+		return "", false
+	}
+	conn.Write([]byte{0x01, 0x00})
+
+	req := make([]byte, 4)
+	if _, err := io.ReadFull(br, req); err != nil || req[1] != 0x01 {
+		return "", false
+	}
+	var host string
+	switch req[3] {
+	case 0x01:
+		ip := make([]byte, 4)
+		io.ReadFull(br, ip)
+		host = net.IP(ip).String()
+	case 0x03:
+		host = readField()
+	default:
+		return "", false
+	}
+	port := make([]byte, 2)
+	if _, err := io.ReadFull(br, port); err != nil {
+		return "", false
+	}
+	conn.Write([]byte{0x05, 0x00, 0x00, 0x01, 0, 0, 0, 0, 0, 0})
+	return net.JoinHostPort(host, strconv.Itoa(int(binary.BigEndian.Uint16(port)))), true
+}
+
+func TestUpstreamProxy(t *testing.T) {
+	srv := startTestSSHServer(t)
+	proxies := map[string]string{
+		"http":   startTestProxy(t, httpConnectHandshake),
+		"socks5": startTestProxy(t, socks5Handshake),
+	}
+	for scheme, addr := range proxies {
+		cfg := testClientConfig(t, srv.addr)
+		cfg.Proxy = scheme + "://user:pass@" + addr
+		c := newTestSSHClient(t, cfg)
+		if _, err := c.Ping(); err != nil {
+			t.Errorf("%s: 经由代理连接后 Ping 失败: %v", scheme, err)
+		}
+
+		cfg = testClientConfig(t, srv.addr)
+		cfg.Proxy = scheme + "://user:wrong@" + addr
+		if c, err := newSSHClient(cfg, logger.NewLogger(false), nil); err == nil {
+			c.Close()
+			t.Errorf("%s: 代理认证失败时连接应失败", scheme)
+		} else if !isDialError(err) {
+			t.Errorf("%s: 错误 = %v, 期望连接错误", scheme, err)
+		}
+	}
+}
+
+func TestProxyCommandTokens(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("使用 /bin/sh")
+	}
+	cfg := config.NewConfig()
+	cfg.ProxyCommand = "echo %n %h %p %r"
+	dial, err := newHopDialer(cfg, logger.NewLogger(false))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		host config.SSHHost
+		want string
+	}{
+		{
+			host: config.SSHHost{User: "u", Host: "10.0.0.1", Alias: "web", Port: "2222"},
+			want: "web 10.0.0.1 2222 u",
+		},
+		{
+			host: config.SSHHost{User: "u", Host: "10.0.0.1", Port: "22"},
+			want: "10.0.0.1 10.0.0.1 22 u",
+		},
+	}
+	for _, tt := range tests {
+		conn, err := dial(tt.host, time.Second)
+		if err != nil {
+			t.Fatal(err)
+		}
+		out, _ := io.ReadAll(conn)
+		conn.Close()
+		if got := strings.TrimSpace(string(out)); got != tt.want {
+			t.Errorf("ProxyCommand 输出 %q, 期望 %q", got, tt.want)
+		}
+	}
+}
+
+// TestProxyCommandTimeout 确认没有输出的 ProxyCommand 在超时后被结束
+func TestProxyCommandTimeout(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("使用 /bin/sh")
+	}
+	conn, err := dialCommand("exec sleep 10", "127.0.0.1:22", 200*time.Millisecond, logger.NewLogger(false))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	start := time.Now()
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := conn.Read(make([]byte, 1)); err != io.EOF {
+		t.Errorf("读取错误 = %v, 期望 EOF", err)
+	}
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Errorf("命令在 %v 后才结束", elapsed)
+	}
+
+	// 有输出的命令不受超时影响
+	conn, err = dialCommand("echo hi; sleep 0.5; echo bye", "127.0.0.1:22", 200*time.Millisecond, logger.NewLogger(false))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if out, _ := io.ReadAll(conn); string(out) != "hi\nbye\n" {
+		t.Errorf("输出 = %q", out)
+	}
+}
+
+// TestProxyCommandAlias 确认 ~/.ssh/config 中的 ProxyCommand 用原始别名展开 %n
+func TestProxyCommandAlias(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("使用 /bin/sh")
+	}
+	path := filepath.Join(t.TempDir(), "config")
+	if err := os.WriteFile(path, []byte("Host web\n  HostName 10.0.0.1\n  Port 2222\n  ProxyCommand echo %n %h %p\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	sshCfg, err := sshconfig.Load(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	base := config.NewConfig()
+	base.SSHConfig = sshCfg
+	base.SSHServer = "127.0.0.1:22"
+
+	// 规则文件中的出站使用 ~/.ssh/config 中的别名
+	out, err := base.ForOutbound("u@web", nil, config.SSHHost{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	dial, err := newHopDialer(out, logger.NewLogger(false))
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn, err := dial(out.TargetHost(), time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	got, _ := io.ReadAll(conn)
+	if want := "web 10.0.0.1 2222"; strings.TrimSpace(string(got)) != want {
+		t.Errorf("ProxyCommand 输出 %q, 期望 %q", got, want)
+	}
+}
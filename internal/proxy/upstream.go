@@ -0,0 +1,301 @@
+package proxy
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+
+	"github.com/Sesame2/gotun/internal/config"
+	"github.com/Sesame2/gotun/internal/logger"
+)
+
+// Dialer 通过远端建立连接，HTTP、SOCKS5 代理和 TUN 服务都只依赖这个接口。
+// SSHClient 和 UpstreamGroup 都实现了它
+type Dialer interface {
+	Dial(network, addr string) (net.Conn, error)
+}
+
+// 新上游的延迟至少低于当前上游的这个比例才切换，避免在延迟相近的上游间来回切换
+const switchThreshold = 0.8
+
+// UpstreamGroup 管理多个能到达同一网络的 SSH 上游，
+// 定期探测延迟，新连接总是交给最健康的上游，当前上游失效时自动切换
+type UpstreamGroup struct {
+	interval time.Duration
+	logger   *logger.Logger
+	keys     *keyStore // 各上游共用，同一私钥只需解密一次，密码来源取自各上游的配置
+
+	mu        sync.Mutex
+	upstreams []*upstream
+	active    *upstream
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+// upstream 是组中的一个 SSH 上游
+type upstream struct {
+	cfg     *config.Config
+	name    string
+	client  *SSHClient    // 尚未连接成功时为 nil
+	latency time.Duration // 最近一次探测的延迟
+	healthy bool
+}
+
+// NewUpstreamGroup 连接所有上游，至少有一个成功即可，其余在后台重试
+func NewUpstreamGroup(cfgs []*config.Config, interval time.Duration, log *logger.Logger) (*UpstreamGroup, error) {
+	g := &UpstreamGroup{
+		interval: interval,
+		logger:   log,
+		keys:     newKeyStore(log),
+		done:     make(chan struct{}),
+	}
+
+	connected := 0
+	for _, cfg := range cfgs {
+		u := &upstream{cfg: cfg, name: cfg.SSHUser + "@" + cfg.SSHServer}
+		g.upstreams = append(g.upstreams, u)
+
+		log.Infof("连接 SSH 上游 %s", u.name)
+		client, err := newSSHClient(cfg, log, g.keys)
+		if err != nil {
+			log.Warnf("SSH 上游 %s 连接失败: %v，将在后台重试", u.name, err)
+			continue
+		}
+		u.client = client
+		connected++
+	}
+	if connected == 0 {
+		return nil, fmt.Errorf("所有 SSH 上游均连接失败")
+	}
+
+	g.probe()
+	if g.interval > 0 {
+		go g.probeLoop()
+	}
+	return g, nil
+}
+
+// probeLoop 定期探测所有上游
+func (g *UpstreamGroup) probeLoop() {
+	ticker := time.NewTicker(g.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-g.done:
+			return
+		case <-ticker.C:
+			g.probe()
+		}
+	}
+}
+
+// probe 同时测量所有上游的握手延迟，在后台重试尚未连接成功的上游，然后重新选择当前上游。
+// 一个上游无响应只影响它自己，最多等待 cfg.Timeout
+func (g *UpstreamGroup) probe() {
+	var wg sync.WaitGroup
+	for _, u := range g.snapshot() {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			g.probeUpstream(u)
+		}()
+	}
+	wg.Wait()
+
+	g.mu.Lock()
+	g.selectActive()
+	g.mu.Unlock()
+}
+
+// probeUpstream 检查一个上游是否可用并测量延迟，尚未连接时先以不询问用户的方式连接。
+// 是否可用以已建立的连接为准: 连接已断开、正在重连或不响应 keepalive 的上游不可用，
+// 即使还能建立新的连接。延迟取新建连接的握手时间，握手失败时使用 keepalive 的往返时间
+func (g *UpstreamGroup) probeUpstream(u *upstream) {
+	g.mu.Lock()
+	client := u.client
+	g.mu.Unlock()
+	if client == nil {
+		// 后台重连不在终端上询问密码、私钥密码或未知主机
+		cfg := *u.cfg
+		cfg.NoPrompt = true
+		c, err := newSSHClient(&cfg, g.logger, g.keys)
+		if err != nil {
+			g.logger.Debugf("SSH 上游 %s 仍无法连接: %v", u.name, err)
+			return
+		}
+		g.logger.Infof("SSH 上游 %s 已连接", u.name)
+		client = c
+	}
+
+	err := client.linkErr()
+	var latency time.Duration
+	if err == nil {
+		latency, err = client.Ping()
+	}
+	if err == nil {
+		if handshake, hsErr := client.HandshakeLatency(); hsErr == nil {
+			latency = handshake
+		} else {
+			g.logger.Debugf("SSH 上游 %s 握手探测失败，使用 keepalive 往返时间: %v", u.name, hsErr)
+		}
+	}
+
+	g.mu.Lock()
+	if g.closed() {
+		fresh := u.client == nil
+		g.mu.Unlock()
+		if fresh {
+			client.Close()
+		}
+		return
+	}
+	u.client = client
+	u.healthy = err == nil
+	if err == nil {
+		u.latency = latency
+	}
+	g.mu.Unlock()
+
+	if err != nil {
+		g.logger.Debugf("SSH 上游 %s 探测失败: %v", u.name, err)
+	} else {
+		g.logger.Debugf("SSH 上游 %s 延迟 %v", u.name, latency)
+	}
+}
+
+// snapshot 返回上游列表的副本，探测时不持有锁
+func (g *UpstreamGroup) snapshot() []*upstream {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return append([]*upstream(nil), g.upstreams...)
+}
+
+func (g *UpstreamGroup) closed() bool {
+	select {
+	case <-g.done:
+		return true
+	default:
+		return false
+	}
+}
+
+// selectActive 选择延迟最低的健康上游作为当前上游，调用时需持有 g.mu
+func (g *UpstreamGroup) selectActive() {
+	var best *upstream
+	for _, u := range g.upstreams {
+		if u.healthy && (best == nil || u.latency < best.latency) {
+			best = u
+		}
+	}
+	if best == nil || best == g.active {
+		return
+	}
+
+	prev := g.active
+	switch {
+	case prev == nil:
+		g.logger.Infof("使用 SSH 上游 %s (延迟 %v)", best.name, best.latency)
+	case !prev.healthy:
+		g.logger.Warnf("SSH 上游 %s 不可用，切换到 %s (延迟 %v)", prev.name, best.name, best.latency)
+	case float64(best.latency) < float64(prev.latency)*switchThreshold:
+		g.logger.Infof("SSH 上游 %s 延迟更低 (%v < %v)，从 %s 切换", best.name, best.latency, prev.latency, prev.name)
+	default:
+		return
+	}
+	g.active = best
+}
+
+// markDown 在上游上建立连接失败时将其标记为不健康，必要时立即切换
+func (g *UpstreamGroup) markDown(u *upstream, err error) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if !u.healthy {
+		return
+	}
+	u.healthy = false
+	g.logger.Warnf("SSH 上游 %s 连接失败: %v", u.name, err)
+	g.selectActive()
+}
+
+// candidates 返回本次 Dial 依次尝试的上游: 当前上游优先，其余按延迟排序。
+// 没有可用上游时返回所有已连接的上游，由 SSHClient 等待其重连
+func (g *UpstreamGroup) candidates() []*upstream {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	var ready, waiting []*upstream
+	for _, u := range g.upstreams {
+		if u.client == nil {
+			continue
+		}
+		if u.healthy && u.client.Ready() {
+			ready = append(ready, u)
+		} else {
+			waiting = append(waiting, u)
+		}
+	}
+	sort.SliceStable(ready, func(i, j int) bool {
+		if ready[i] == g.active || ready[j] == g.active {
+			return ready[i] == g.active
+		}
+		return ready[i].latency < ready[j].latency
+	})
+	if len(ready) > 0 {
+		return ready
+	}
+	return waiting
+}
+
+// Dial 通过当前上游建立连接，失败时依次尝试其余上游
+func (g *UpstreamGroup) Dial(network, addr string) (net.Conn, error) {
+	var lastErr error
+	for _, u := range g.candidates() {
+		conn, err := u.client.Dial(network, addr)
+		if err == nil {
+			return conn, nil
+		}
+		// 目标拒绝连接与上游无关，换上游也无济于事
+		var openErr *ssh.OpenChannelError
+		if errors.As(err, &openErr) {
+			return nil, err
+		}
+		lastErr = err
+		g.markDown(u, err)
+	}
+	if lastErr == nil {
+		lastErr = fmt.Errorf("没有可用的 SSH 上游")
+	}
+	return nil, lastErr
+}
+
+// String 返回所有上游的名称，用于展示
+func (g *UpstreamGroup) String() string {
+	var names []string
+	for _, u := range g.snapshot() {
+		names = append(names, u.name)
+	}
+	return strings.Join(names, ", ")
+}
+
+// Close 停止探测并关闭所有上游
+func (g *UpstreamGroup) Close() error {
+	g.closeOnce.Do(func() {
+		close(g.done)
+	})
+	for _, u := range g.snapshot() {
+		g.mu.Lock()
+		client := u.client
+		u.client = nil
+		g.mu.Unlock()
+		if client != nil {
+			client.Close()
+		}
+	}
+	return nil
+}
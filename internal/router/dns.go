@@ -0,0 +1,334 @@
+package router
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math/rand"
+	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// 解析器类型，决定 IP 类规则在哪里解析域名
+const (
+	resolverLocal  = "local"  // 在本机解析
+	resolverRemote = "remote" // 通过 SSH 连接在服务器端解析
+)
+
+const (
+	defaultDNSTTL  = time.Minute      // 系统解析器不返回 TTL，按此时间缓存
+	negativeDNSTTL = 10 * time.Second // 解析失败时的缓存时间，避免反复查询
+	dnsTimeout     = 5 * time.Second
+	maxDNSCache    = 4096 // 缓存超过此数量时清理过期的条目
+)
+
+// DialFunc 用于建立到 DNS 服务器的连接，通常为 SSH 客户端的 Dial
+type DialFunc func(network, addr string) (net.Conn, error)
+
+// dnsConfig 是规则文件中的 dns 部分
+type dnsConfig struct {
+	Resolver    string   `yaml:"resolver"`    // local 或 remote
+	Nameservers []string `yaml:"nameservers"` // DNS 服务器，端口默认 53
+	TTL         int      `yaml:"ttl"`         // 使用系统解析器时的缓存时间 (秒)
+}
+
+// resolver 为 IP 类规则解析域名，并按记录的 TTL 缓存结果
+type resolver struct {
+	remote      bool
+	nameservers []string
+	ttl         time.Duration
+	dial        *atomic.Pointer[DialFunc] // 由 Router 设置，remote 解析时使用
+
+	// resolve 执行一次实际的查询，返回地址和缓存时间
+	resolve func(host string) ([]net.IP, time.Duration, error)
+
+	mu    sync.Mutex
+	cache map[string]dnsEntry
+}
+
+type dnsEntry struct {
+	ips     []net.IP
+	expires time.Time
+}
+
+// newResolver 按 dns 配置创建解析器
+func newResolver(cfg dnsConfig) (*resolver, error) {
+	r := &resolver{
+		ttl:   defaultDNSTTL,
+		cache: make(map[string]dnsEntry),
+	}
+	if cfg.TTL > 0 {
+		r.ttl = time.Duration(cfg.TTL) * time.Second
+	}
+	for _, ns := range cfg.Nameservers {
+		if _, _, err := net.SplitHostPort(ns); err != nil {
+			ns = net.JoinHostPort(strings.Trim(ns, "[]"), "53")
+		}
+		if _, _, err := net.SplitHostPort(ns); err != nil {
+			return nil, fmt.Errorf("dns: 无效的服务器地址 %s", ns)
+		}
+		r.nameservers = append(r.nameservers, ns)
+	}
+
+	switch strings.ToLower(cfg.Resolver) {
+	case resolverLocal, "":
+	case resolverRemote:
+		if len(r.nameservers) == 0 {
+			return nil, fmt.Errorf("dns: resolver 为 remote 时需要在 nameservers 中指定服务器端可以访问的 DNS 服务器")
+		}
+		r.remote = true
+	default:
+		return nil, fmt.Errorf("dns: 未知的 resolver %q (可选 local、remote)", cfg.Resolver)
+	}
+	r.resolve = r.query
+	return r, nil
+}
+
+// lookup 返回域名的地址，优先使用缓存。解析失败时返回 nil
+func (r *resolver) lookup(host string) []net.IP {
+	now := time.Now()
+	r.mu.Lock()
+	if e, ok := r.cache[host]; ok && now.Before(e.expires) {
+		r.mu.Unlock()
+		return e.ips
+	}
+	r.mu.Unlock()
+
+	ips, ttl, err := r.resolve(host)
+	if err != nil || len(ips) == 0 {
+		ips, ttl = nil, negativeDNSTTL
+	}
+
+	r.mu.Lock()
+	if len(r.cache) >= maxDNSCache {
+		for k, e := range r.cache {
+			if !now.Before(e.expires) {
+				delete(r.cache, k)
+			}
+		}
+	}
+	r.cache[host] = dnsEntry{ips: ips, expires: now.Add(ttl)}
+	r.mu.Unlock()
+	return ips
+}
+
+// query 按配置查询域名: 指定了服务器时直接发送 DNS 请求以获得记录的 TTL，
+// 否则使用系统解析器。remote 模式下还没有可用的 SSH 连接时 (如 gotun rules test) 在本机查询
+func (r *resolver) query(host string) ([]net.IP, time.Duration, error) {
+	var dial DialFunc
+	if r.remote && r.dial != nil {
+		if d := r.dial.Load(); d != nil {
+			dial = *d
+		}
+	}
+	if len(r.nameservers) == 0 || (r.remote && dial == nil) {
+		ctx, cancel := context.WithTimeout(context.Background(), dnsTimeout)
+		defer cancel()
+		ips, err := net.DefaultResolver.LookupIP(ctx, "ip", host)
+		return ips, r.ttl, err
+	}
+
+	var lastErr error
+	for _, ns := range r.nameservers {
+		var ips []net.IP
+		var ttl time.Duration
+		var err error
+		if dial != nil {
+			ips, ttl, err = exchangeTCP(dial, ns, host)
+		} else {
+			ips, ttl, err = exchangeUDP(ns, host)
+		}
+		if err == nil {
+			return ips, ttl, nil
+		}
+		lastErr = err
+	}
+	return nil, 0, lastErr
+}
+
+// exchangeUDP 通过 UDP 查询 A 和 AAAA 记录，响应被截断时改用 TCP
+func exchangeUDP(ns, host string) ([]net.IP, time.Duration, error) {
+	conn, err := net.DialTimeout("udp", ns, dnsTimeout)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(dnsTimeout))
+
+	var answers []dnsAnswer
+	for _, qtype := range []dnsmessage.Type{dnsmessage.TypeA, dnsmessage.TypeAAAA} {
+		msg, id, err := buildQuery(host, qtype)
+		if err != nil {
+			return nil, 0, err
+		}
+		if _, err := conn.Write(msg); err != nil {
+			return nil, 0, err
+		}
+		buf := make([]byte, 4096)
+		for {
+			n, err := conn.Read(buf)
+			if err != nil {
+				return nil, 0, err
+			}
+			answer, err := parseAnswer(buf[:n], id)
+			if err == errDNSMismatch {
+				continue // 之前超时的请求的响应
+			}
+			if err == errDNSTruncated {
+				return exchangeTCP(net.Dial, ns, host)
+			}
+			if err != nil {
+				return nil, 0, err
+			}
+			answers = append(answers, answer)
+			break
+		}
+	}
+	return mergeAnswers(host, answers)
+}
+
+// exchangeTCP 在一个 TCP 连接上依次查询 A 和 AAAA 记录，每个消息前带两字节长度
+func exchangeTCP(dial DialFunc, ns, host string) ([]net.IP, time.Duration, error) {
+	conn, err := dial("tcp", ns)
+	if err != nil {
+		return nil, 0, fmt.Errorf("连接 DNS 服务器 %s 失败: %w", ns, err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(dnsTimeout))
+
+	var answers []dnsAnswer
+	for _, qtype := range []dnsmessage.Type{dnsmessage.TypeA, dnsmessage.TypeAAAA} {
+		msg, id, err := buildQuery(host, qtype)
+		if err != nil {
+			return nil, 0, err
+		}
+		packet := make([]byte, 2+len(msg))
+		binary.BigEndian.PutUint16(packet, uint16(len(msg)))
+		copy(packet[2:], msg)
+		if _, err := conn.Write(packet); err != nil {
+			return nil, 0, err
+		}
+
+		var length [2]byte
+		if _, err := io.ReadFull(conn, length[:]); err != nil {
+			return nil, 0, err
+		}
+		resp := make([]byte, binary.BigEndian.Uint16(length[:]))
+		if _, err := io.ReadFull(conn, resp); err != nil {
+			return nil, 0, err
+		}
+		answer, err := parseAnswer(resp, id)
+		if err != nil {
+			return nil, 0, err
+		}
+		answers = append(answers, answer)
+	}
+	return mergeAnswers(host, answers)
+}
+
+var (
+	errDNSMismatch  = fmt.Errorf("DNS 响应与请求不匹配")
+	errDNSTruncated = fmt.Errorf("DNS 响应被截断")
+)
+
+// dnsAnswer 是一次查询的结果，ttl 为所有应答记录中最小的 TTL
+type dnsAnswer struct {
+	ips []net.IP
+	ttl uint32
+}
+
+func buildQuery(host string, qtype dnsmessage.Type) ([]byte, uint16, error) {
+	name, err := dnsmessage.NewName(strings.TrimSuffix(host, ".") + ".")
+	if err != nil {
+		return nil, 0, fmt.Errorf("无效的域名 %s", host)
+	}
+	id := uint16(rand.Uint32())
+	msg := dnsmessage.Message{
+		Header:    dnsmessage.Header{ID: id, RecursionDesired: true},
+		Questions: []dnsmessage.Question{{Name: name, Type: qtype, Class: dnsmessage.ClassINET}},
+	}
+	b, err := msg.Pack()
+	return b, id, err
+}
+
+func parseAnswer(b []byte, id uint16) (dnsAnswer, error) {
+	var p dnsmessage.Parser
+	h, err := p.Start(b)
+	if err != nil {
+		return dnsAnswer{}, err
+	}
+	if h.ID != id || !h.Response {
+		return dnsAnswer{}, errDNSMismatch
+	}
+	if h.Truncated {
+		return dnsAnswer{}, errDNSTruncated
+	}
+	switch h.RCode {
+	case dnsmessage.RCodeSuccess, dnsmessage.RCodeNameError:
+	default:
+		return dnsAnswer{}, fmt.Errorf("DNS 服务器返回 %s", h.RCode)
+	}
+	if err := p.SkipAllQuestions(); err != nil {
+		return dnsAnswer{}, err
+	}
+
+	answer := dnsAnswer{ttl: uint32(defaultDNSTTL / time.Second)}
+	first := true
+	for {
+		rh, err := p.AnswerHeader()
+		if err == dnsmessage.ErrSectionDone {
+			break
+		}
+		if err != nil {
+			return dnsAnswer{}, err
+		}
+		if first || rh.TTL < answer.ttl {
+			answer.ttl = rh.TTL
+			first = false
+		}
+		switch rh.Type {
+		case dnsmessage.TypeA:
+			r, err := p.AResource()
+			if err != nil {
+				return dnsAnswer{}, err
+			}
+			answer.ips = append(answer.ips, net.IP(r.A[:]))
+		case dnsmessage.TypeAAAA:
+			r, err := p.AAAAResource()
+			if err != nil {
+				return dnsAnswer{}, err
+			}
+			answer.ips = append(answer.ips, net.IP(r.AAAA[:]))
+		default:
+			if err := p.SkipAnswer(); err != nil {
+				return dnsAnswer{}, err
+			}
+		}
+	}
+	return answer, nil
+}
+
+// mergeAnswers 合并 A 和 AAAA 的结果，缓存时间取有结果的查询中最小的 TTL
+func mergeAnswers(host string, answers []dnsAnswer) ([]net.IP, time.Duration, error) {
+	var ips []net.IP
+	ttl := time.Duration(-1)
+	for _, a := range answers {
+		if len(a.ips) == 0 {
+			continue
+		}
+		ips = append(ips, a.ips...)
+		if d := time.Duration(a.ttl) * time.Second; ttl < 0 || d < ttl {
+			ttl = d
+		}
+	}
+	if len(ips) == 0 {
+		return nil, 0, fmt.Errorf("%s 没有解析结果", host)
+	}
+	return ips, ttl, nil
+}
@@ -0,0 +1,218 @@
+package router
+
+import (
+	"encoding/binary"
+	"io"
+	"net"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+func TestResolveIPRules(t *testing.T) {
+	r := newTestRouter(t, `
+rules:
+  - DOMAIN-SUFFIX,example.com,PROXY
+  - IP-CIDR,192.168.0.0/16,REJECT,no-resolve
+  - IP-CIDR,10.0.0.0/8,DIRECT
+  - MATCH,PROXY
+`)
+	calls := stubResolve(r, map[string]string{
+		"intranet.corp": "10.1.2.3",
+		"nas.corp":      "192.168.1.10",
+		"example.com":   "10.0.0.1",
+	})
+
+	tests := []struct {
+		host   string
+		index  int
+		reason string
+		calls  int
+	}{
+		// 排在 IP 规则之前的规则命中时不解析
+		{host: "www.example.com", index: 1, calls: 0},
+		{host: "intranet.corp:443", index: 3, reason: "intranet.corp (10.1.2.3) 属于网段 10.0.0.0/8", calls: 1},
+		// no-resolve 的规则不使用解析结果
+		{host: "nas.corp", index: 4, calls: 2},
+		// 结果已缓存
+		{host: "intranet.corp", index: 3, calls: 2},
+		{host: "192.168.1.10", index: 2, calls: 2},
+	}
+	for _, tt := range tests {
+		got := r.Evaluate(tt.host)
+		if got.Index != tt.index {
+			t.Errorf("Evaluate(%q) 命中 #%d (%s), 期望 #%d", tt.host, got.Index, got.Reason, tt.index)
+		}
+		if tt.reason != "" && got.Reason != tt.reason {
+			t.Errorf("Evaluate(%q) 原因 = %q, 期望 %q", tt.host, got.Reason, tt.reason)
+		}
+		if *calls != tt.calls {
+			t.Errorf("Evaluate(%q) 后解析了 %d 次, 期望 %d 次", tt.host, *calls, tt.calls)
+		}
+	}
+}
+
+// TestResolverReload 确认重新加载规则后解析缓存仍然有效，dns 配置变化时才重建解析器
+func TestResolverReload(t *testing.T) {
+	path := writeRules(t, "rules:\n  - IP-CIDR,10.0.0.0/8,DIRECT\n")
+	r, err := NewRouter(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	calls := stubResolve(r, map[string]string{"intranet.corp": "10.1.2.3"})
+	if got := r.Match("intranet.corp"); got != ActionDirect {
+		t.Fatalf("Match = %s, 期望 DIRECT", got)
+	}
+
+	if err := os.WriteFile(path, []byte("rules:\n  - IP-CIDR,10.0.0.0/8,REJECT\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.Reload(); err != nil {
+		t.Fatal(err)
+	}
+	if got := r.Match("intranet.corp"); got != ActionReject {
+		t.Errorf("重新加载后 Match = %s, 期望 REJECT", got)
+	}
+	if *calls != 1 {
+		t.Errorf("解析了 %d 次, 重新加载后应使用缓存", *calls)
+	}
+
+	before := r.resolver.Load()
+	if err := os.WriteFile(path, []byte("dns:\n  ttl: 30\nrules:\n  - IP-CIDR,10.0.0.0/8,REJECT\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.Reload(); err != nil {
+		t.Fatal(err)
+	}
+	if after := r.resolver.Load(); after == before || after.ttl != 30*time.Second {
+		t.Error("dns 配置变化后应使用新的解析器")
+	}
+}
+
+func TestResolverConfig(t *testing.T) {
+	tests := []struct {
+		rules string
+		want  string
+	}{
+		{rules: "dns:\n  resolver: remote\n", want: "dns: resolver 为 remote 时需要在 nameservers 中指定"},
+		{rules: "dns:\n  resolver: doh\n", want: `dns: 未知的 resolver "doh"`},
+	}
+	for _, tt := range tests {
+		_, err := NewRouter(writeRules(t, tt.rules))
+		if err == nil || !strings.Contains(err.Error(), tt.want) {
+			t.Errorf("NewRouter 错误 = %v, 期望包含 %q", err, tt.want)
+		}
+	}
+
+	r, err := newResolver(dnsConfig{Resolver: "remote", Nameservers: []string{"10.0.0.53", "[fd00::53]:5353"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := strings.Join(r.nameservers, ","); got != "10.0.0.53:53,[fd00::53]:5353" {
+		t.Errorf("nameservers = %s", got)
+	}
+}
+
+// dnsReply 为查询构造应答: A 记录返回 10.9.8.7，AAAA 没有记录
+func dnsReply(t *testing.T, query []byte) []byte {
+	var msg dnsmessage.Message
+	if err := msg.Unpack(query); err != nil {
+		t.Errorf("解析查询失败: %v", err)
+		return nil
+	}
+	msg.Header.Response = true
+	q := msg.Questions[0]
+	if q.Type == dnsmessage.TypeA {
+		msg.Answers = []dnsmessage.Resource{{
+			Header: dnsmessage.ResourceHeader{Name: q.Name, Type: q.Type, Class: q.Class, TTL: 30},
+			Body:   &dnsmessage.AResource{A: [4]byte{10, 9, 8, 7}},
+		}}
+	}
+	b, err := msg.Pack()
+	if err != nil {
+		t.Error(err)
+	}
+	return b
+}
+
+func TestResolverExchange(t *testing.T) {
+	// UDP，用于 local 模式
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pc.Close()
+	go func() {
+		buf := make([]byte, 512)
+		for {
+			n, addr, err := pc.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			pc.WriteTo(dnsReply(t, buf[:n]), addr)
+		}
+	}()
+
+	// TCP，用于 remote 模式
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				var length [2]byte
+				for {
+					if _, err := io.ReadFull(conn, length[:]); err != nil {
+						return
+					}
+					query := make([]byte, binary.BigEndian.Uint16(length[:]))
+					if _, err := io.ReadFull(conn, query); err != nil {
+						return
+					}
+					reply := dnsReply(t, query)
+					binary.BigEndian.PutUint16(length[:], uint16(len(reply)))
+					conn.Write(append(length[:], reply...))
+				}
+			}()
+		}
+	}()
+
+	local, err := newResolver(dnsConfig{Nameservers: []string{pc.LocalAddr().String()}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	remote, err := newResolver(dnsConfig{Resolver: "remote", Nameservers: []string{ln.Addr().String()}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var dialed int
+	router := &Router{}
+	router.SetRemoteDialer(func(network, addr string) (net.Conn, error) {
+		dialed++
+		return net.Dial(network, addr)
+	})
+	remote.dial = &router.dial
+
+	for name, r := range map[string]*resolver{"local": local, "remote": remote} {
+		ips, ttl, err := r.query("intranet.corp")
+		if err != nil {
+			t.Fatalf("%s: 查询失败: %v", name, err)
+		}
+		if len(ips) != 1 || !ips[0].Equal(net.IPv4(10, 9, 8, 7)) || ttl != 30*time.Second {
+			t.Errorf("%s: 查询结果 %v (TTL %v), 期望 [10.9.8.7] (TTL 30s)", name, ips, ttl)
+		}
+	}
+	if dialed != 1 {
+		t.Errorf("remote 模式通过 dialer 连接了 %d 次, 期望 1 次", dialed)
+	}
+}
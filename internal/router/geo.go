@@ -0,0 +1,277 @@
+package router
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/oschwald/maxminddb-golang"
+)
+
+// 数据库按路径缓存，文件未变化时重新加载规则不会重复读取。数据库只读，可以被多个规则集共享。
+// 文件更新后缓存项被替换，旧的数据在不再被规则集引用后由 GC 回收
+var (
+	geoMu      sync.Mutex
+	geoIPDBs   = make(map[string]*geoIPFile)
+	geoSiteDBs = make(map[string]*geoSiteFile)
+)
+
+// fileVersion 用修改时间和大小判断文件是否变化
+type fileVersion struct {
+	modTime time.Time
+	size    int64
+}
+
+func statVersion(path string) (fileVersion, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return fileVersion{}, err
+	}
+	return fileVersion{modTime: info.ModTime(), size: info.Size()}, nil
+}
+
+type geoIPFile struct {
+	version fileVersion
+	db      *maxminddb.Reader
+}
+
+type geoSiteFile struct {
+	version fileVersion
+	sites   map[string]*geoSite // 键为大写的分类代码
+}
+
+// openGeoIP 打开 mmdb 格式的 GeoIP 数据库 (如 GeoLite2-Country.mmdb)。
+// 数据库读入内存而不是 mmap，被替换的旧数据库可能仍在被当前的规则集使用，不能主动关闭
+func openGeoIP(path string) (*maxminddb.Reader, error) {
+	geoMu.Lock()
+	defer geoMu.Unlock()
+
+	version, err := statVersion(path)
+	if err != nil {
+		delete(geoIPDBs, path)
+		return nil, fmt.Errorf("打开 GeoIP 数据库 %s 失败: %w", path, err)
+	}
+	if f, ok := geoIPDBs[path]; ok && f.version == version {
+		return f.db, nil
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("打开 GeoIP 数据库 %s 失败: %w", path, err)
+	}
+	db, err := maxminddb.FromBytes(data)
+	if err != nil {
+		return nil, fmt.Errorf("打开 GeoIP 数据库 %s 失败: %w", path, err)
+	}
+	geoIPDBs[path] = &geoIPFile{version: version, db: db}
+	return db, nil
+}
+
+// geoIPRecord 是 mmdb 中与国家相关的字段
+type geoIPRecord struct {
+	Country struct {
+		ISOCode string `maxminddb:"iso_code"`
+	} `maxminddb:"country"`
+	RegisteredCountry struct {
+		ISOCode string `maxminddb:"iso_code"`
+	} `maxminddb:"registered_country"`
+}
+
+// countryOf 返回 IP 所属国家的 ISO 代码，查不到时返回空字符串
+func countryOf(db *maxminddb.Reader, ip net.IP) string {
+	var record geoIPRecord
+	if err := db.Lookup(ip, &record); err != nil {
+		return ""
+	}
+	if record.Country.ISOCode != "" {
+		return record.Country.ISOCode
+	}
+	return record.RegisteredCountry.ISOCode
+}
+
+// isLAN 判断是否为局域网地址，对应 GEOIP,LAN
+func isLAN(ip net.IP) bool {
+	return ip.IsPrivate() || ip.IsLoopback() || ip.IsLinkLocalUnicast() || ip.IsUnspecified()
+}
+
+// geoSite 是 geosite.dat 中一个分类 (如 cn、google) 的域名列表
+type geoSite struct {
+	full    map[string]bool
+	suffix  []string
+	keyword []string
+	regex   []*regexp.Regexp
+}
+
+// match 判断域名是否属于该分类，返回命中的条目
+func (g *geoSite) match(host string) (string, bool) {
+	if g.full[host] {
+		return host, true
+	}
+	for _, s := range g.suffix {
+		if host == s || strings.HasSuffix(host, "."+s) {
+			return s, true
+		}
+	}
+	for _, k := range g.keyword {
+		if strings.Contains(host, k) {
+			return k, true
+		}
+	}
+	for _, re := range g.regex {
+		if re.MatchString(host) {
+			return re.String(), true
+		}
+	}
+	return "", false
+}
+
+// loadGeoSite 从 v2ray 格式的 geosite.dat 中读取一个分类
+func loadGeoSite(path, code string) (*geoSite, error) {
+	code = strings.ToUpper(code)
+
+	geoMu.Lock()
+	defer geoMu.Unlock()
+	version, err := statVersion(path)
+	if err != nil {
+		delete(geoSiteDBs, path)
+		return nil, fmt.Errorf("读取 GeoSite 数据库失败: %w", err)
+	}
+	cached, ok := geoSiteDBs[path]
+	if !ok || cached.version != version {
+		// 文件已更新，之前读取的分类全部作废
+		cached = &geoSiteFile{version: version, sites: make(map[string]*geoSite)}
+		geoSiteDBs[path] = cached
+	}
+	if site, ok := cached.sites[code]; ok {
+		return site, nil
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("读取 GeoSite 数据库失败: %w", err)
+	}
+
+	// GeoSiteList { repeated GeoSite entry = 1; }
+	// GeoSite { string country_code = 1; repeated Domain domain = 2; }
+	for len(data) > 0 {
+		num, entry, rest, err := readBytesField(data)
+		if err != nil {
+			return nil, fmt.Errorf("解析 GeoSite 数据库 %s 失败: %v", path, err)
+		}
+		data = rest
+		if num != 1 {
+			continue
+		}
+
+		var domains [][]byte
+		matched := false
+		for len(entry) > 0 {
+			num, value, rest, err := readBytesField(entry)
+			if err != nil {
+				return nil, fmt.Errorf("解析 GeoSite 数据库 %s 失败: %v", path, err)
+			}
+			entry = rest
+			switch num {
+			case 1:
+				matched = strings.EqualFold(string(value), code)
+			case 2:
+				domains = append(domains, value)
+			}
+		}
+		if !matched {
+			continue
+		}
+
+		site, err := parseGeoSiteDomains(domains)
+		if err != nil {
+			return nil, fmt.Errorf("解析 GeoSite 分类 %s 失败: %v", code, err)
+		}
+		cached.sites[code] = site
+		return site, nil
+	}
+	return nil, fmt.Errorf("GeoSite 数据库中没有分类 %s", code)
+}
+
+// parseGeoSiteDomains 解析 Domain { Type type = 1; string value = 2; }，
+// Type 为 Plain(关键字)=0、Regex=1、Domain(后缀)=2、Full(完整域名)=3
+func parseGeoSiteDomains(domains [][]byte) (*geoSite, error) {
+	site := &geoSite{full: make(map[string]bool)}
+	for _, d := range domains {
+		var typ uint64
+		var value string
+		for len(d) > 0 {
+			num, wire, rest, err := readTag(d)
+			if err != nil {
+				return nil, err
+			}
+			switch wire {
+			case 0:
+				v, n := binary.Uvarint(rest)
+				if n <= 0 {
+					return nil, fmt.Errorf("无效的 varint")
+				}
+				if num == 1 {
+					typ = v
+				}
+				d = rest[n:]
+			case 2:
+				_, b, rest, err := readBytesField(d)
+				if err != nil {
+					return nil, err
+				}
+				if num == 2 {
+					value = strings.ToLower(string(b))
+				}
+				d = rest
+			default:
+				return nil, fmt.Errorf("不支持的字段类型 %d", wire)
+			}
+		}
+
+		switch typ {
+		case 0:
+			site.keyword = append(site.keyword, value)
+		case 1:
+			re, err := regexp.Compile(value)
+			if err != nil {
+				return nil, err
+			}
+			site.regex = append(site.regex, re)
+		case 2:
+			site.suffix = append(site.suffix, value)
+		case 3:
+			site.full[value] = true
+		}
+	}
+	return site, nil
+}
+
+// readTag 读取 protobuf 字段头，返回字段号、类型和剩余数据
+func readTag(b []byte) (int, int, []byte, error) {
+	tag, n := binary.Uvarint(b)
+	if n <= 0 {
+		return 0, 0, nil, fmt.Errorf("无效的字段头")
+	}
+	return int(tag >> 3), int(tag & 7), b[n:], nil
+}
+
+// readBytesField 读取一个 length-delimited 字段
+func readBytesField(b []byte) (int, []byte, []byte, error) {
+	num, wire, rest, err := readTag(b)
+	if err != nil {
+		return 0, nil, nil, err
+	}
+	if wire != 2 {
+		return 0, nil, nil, fmt.Errorf("字段 %d 类型为 %d, 期望 length-delimited", num, wire)
+	}
+	size, n := binary.Uvarint(rest)
+	if n <= 0 || uint64(len(rest)-n) < size {
+		return 0, nil, nil, fmt.Errorf("字段 %d 长度无效", num)
+	}
+	rest = rest[n:]
+	return num, rest[:size], rest[size:], nil
+}
@@ -0,0 +1,194 @@
+package router
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// mmdbEntry 是测试数据库中的一个网段: field 为 country 或 registered_country
+type mmdbEntry struct {
+	cidr  string
+	field string
+	code  string
+}
+
+// buildMMDB 生成只包含 IPv4 网段的最小 mmdb 文件 (record_size 24)
+func buildMMDB(t *testing.T, entries []mmdbEntry) []byte {
+	t.Helper()
+	str := func(s string) []byte { return append([]byte{0x40 | byte(len(s))}, s...) }
+	uint32v := func(v uint32) []byte { return []byte{0xC4, byte(v >> 24), byte(v >> 16), byte(v >> 8), byte(v)} }
+	uint16v := func(v uint16) []byte { return []byte{0xA2, byte(v >> 8), byte(v)} }
+	mapOf := func(pairs ...[]byte) []byte {
+		b := []byte{0xE0 | byte(len(pairs)/2)}
+		for _, p := range pairs {
+			b = append(b, p...)
+		}
+		return b
+	}
+
+	// 搜索树: 记录值 >= 0 指向节点，-1 表示没有数据，-(i+2) 指向第 i 条数据
+	nodes := [][2]int{{-1, -1}}
+	var data []byte
+	var offsets []int
+	for i, e := range entries {
+		_, ipNet, err := net.ParseCIDR(e.cidr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		offsets = append(offsets, len(data))
+		data = append(data, mapOf(str(e.field), mapOf(str("iso_code"), str(e.code)))...)
+
+		ones, _ := ipNet.Mask.Size()
+		ip := ipNet.IP.To4()
+		node := 0
+		for bit := 0; bit < ones; bit++ {
+			side := int(ip[bit/8]>>(7-bit%8)) & 1
+			if bit == ones-1 {
+				nodes[node][side] = -(i + 2)
+				break
+			}
+			if nodes[node][side] <= 0 {
+				nodes = append(nodes, [2]int{-1, -1})
+				nodes[node][side] = len(nodes) - 1
+			}
+			node = nodes[node][side]
+		}
+	}
+
+	count := len(nodes)
+	var db []byte
+	for _, n := range nodes {
+		for _, r := range n {
+			v := count
+			switch {
+			case r >= 0:
+				v = r
+			case r < -1:
+				v = count + 16 + offsets[-r-2]
+			}
+			db = append(db, byte(v>>16), byte(v>>8), byte(v))
+		}
+	}
+	db = append(db, make([]byte, 16)...)
+	db = append(db, data...)
+	db = append(db, "\xAB\xCD\xEFMaxMind.com"...)
+	db = append(db, mapOf(
+		str("node_count"), uint32v(uint32(count)),
+		str("record_size"), uint16v(24),
+		str("ip_version"), uint16v(4),
+		str("binary_format_major_version"), uint16v(2),
+	)...)
+	return db
+}
+
+// writeFileAt 写入文件并设置修改时间，保证更新后的文件与缓存的版本不同
+func writeFileAt(t *testing.T, path string, data []byte, modTime time.Time) {
+	t.Helper()
+	if err := os.WriteFile(path, data, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chtimes(path, modTime, modTime); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestGeoIP(t *testing.T) {
+	dir := t.TempDir()
+	db := filepath.Join(dir, "country.mmdb")
+	now := time.Now()
+	writeFileAt(t, db, buildMMDB(t, []mmdbEntry{
+		{cidr: "1.2.0.0/16", field: "country", code: "CN"},
+		{cidr: "8.8.8.0/24", field: "registered_country", code: "US"},
+	}), now.Add(-time.Hour))
+
+	path := filepath.Join(dir, "rules.yaml")
+	rules := "geoip: country.mmdb\nrules:\n  - GEOIP,CN,DIRECT\n  - GEOIP,US,REJECT\n"
+	if err := os.WriteFile(path, []byte(rules), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	r, err := NewRouter(path)
+	if err != nil {
+		t.Fatalf("NewRouter 失败: %v", err)
+	}
+	stubResolve(r, map[string]string{"cn.test": "1.2.3.4"})
+
+	tests := []struct {
+		host   string
+		action Action
+	}{
+		{host: "1.2.3.4", action: ActionDirect},
+		{host: "cn.test", action: ActionDirect},
+		{host: "1.3.0.1", action: ActionProxy},
+		{host: "8.8.8.8:53", action: ActionReject}, // 没有 country 时使用 registered_country
+		{host: "8.8.4.4", action: ActionProxy},
+	}
+	for _, tt := range tests {
+		if got := r.Match(tt.host); got != tt.action {
+			t.Errorf("Match(%q) = %s, 期望 %s", tt.host, got, tt.action)
+		}
+	}
+
+	// 文件未变化时重新加载规则使用缓存的数据库
+	before := r.set.Load().rules[0].geoip
+	if err := r.Reload(); err != nil {
+		t.Fatalf("Reload 失败: %v", err)
+	}
+	if r.set.Load().rules[0].geoip != before {
+		t.Error("数据库未变化时不应重新读取")
+	}
+
+	// 数据库更新后重新加载规则使用新的数据
+	writeFileAt(t, db, buildMMDB(t, []mmdbEntry{
+		{cidr: "1.2.0.0/16", field: "country", code: "US"},
+	}), now)
+	if err := r.Reload(); err != nil {
+		t.Fatalf("Reload 失败: %v", err)
+	}
+	if got := r.Match("1.2.3.4"); got != ActionReject {
+		t.Errorf("数据库更新后 Match(1.2.3.4) = %s, 期望 REJECT", got)
+	}
+	if got := countryOf(before, net.ParseIP("1.2.3.4")); got != "CN" {
+		t.Errorf("旧的数据库在替换后仍应可用, 查询结果为 %q", got)
+	}
+}
+
+func TestGeoSiteUpdate(t *testing.T) {
+	field := func(num int, data []byte) []byte {
+		return append([]byte{byte(num<<3 | 2), byte(len(data))}, data...)
+	}
+	site := func(code, suffix string) []byte {
+		domain := field(2, append([]byte{1 << 3, 2}, field(2, []byte(suffix))...))
+		return field(1, append(field(1, []byte(code)), domain...))
+	}
+	path := filepath.Join(t.TempDir(), "geosite.dat")
+	now := time.Now()
+	writeFileAt(t, path, site("CN", "baidu.com"), now.Add(-time.Hour))
+
+	first, err := loadGeoSite(path, "cn")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if again, _ := loadGeoSite(path, "CN"); again != first {
+		t.Error("文件未变化时应使用缓存")
+	}
+
+	writeFileAt(t, path, site("CN", "qq.com"), now)
+	updated, err := loadGeoSite(path, "cn")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := updated.match("www.qq.com"); !ok {
+		t.Error("文件更新后应读取新的分类")
+	}
+	if _, ok := updated.match("www.baidu.com"); ok {
+		t.Error("文件更新后仍使用了旧的分类")
+	}
+
+	os.Remove(path)
+	if _, err := loadGeoSite(path, "cn"); err == nil {
+		t.Error("文件删除后应返回错误")
+	}
+}
@@ -0,0 +1,289 @@
+package router
+
+import (
+	"math"
+	"net"
+	"strings"
+)
+
+// noRule 表示索引中没有命中的规则
+const noRule = math.MaxInt
+
+// ruleIndex 是加载规则时预先编译的索引，用于在大量规则中快速找到第一条命中的规则。
+// 只索引 DOMAIN、DOMAIN-SUFFIX、DOMAIN-KEYWORD 和 IP-CIDR 规则，
+// 其余规则仍按顺序检查，但只检查排在索引结果之前的部分，以保证第一条命中的规则生效
+type ruleIndex struct {
+	domains  *domainTrie
+	keywords *keywordMatcher
+	ipv4     *cidrTrie
+	ipv6     *cidrTrie
+	linear   []int // 未被索引的规则位置，按顺序排列
+
+	// 第一条需要解析域名的 IP-CIDR 规则 (没有 no-resolve) 的位置
+	firstResolve int
+}
+
+func buildIndex(rules []Rule) *ruleIndex {
+	x := &ruleIndex{
+		domains:  newDomainTrie(),
+		keywords: newKeywordMatcher(),
+		ipv4:     newCIDRTrie(),
+		ipv6:     newCIDRTrie(),
+
+		firstResolve: noRule,
+	}
+	for pos := range rules {
+		rule := &rules[pos]
+		switch rule.Type {
+		case Domain:
+			x.domains.insert(rule.Payload, pos, false)
+		case DomainSuffix:
+			x.domains.insert(rule.Payload, pos, true)
+		case DomainKeyword:
+			x.keywords.insert(rule.Payload, pos)
+		case IPCIDR, IPCIDR6:
+			ones, _ := rule.cidr.Mask.Size()
+			if len(rule.cidr.IP) == net.IPv4len {
+				x.ipv4.insert(rule.cidr.IP, ones, pos, !rule.NoResolve)
+			} else {
+				x.ipv6.insert(rule.cidr.IP, ones, pos, !rule.NoResolve)
+			}
+			if !rule.NoResolve {
+				x.firstResolve = min(x.firstResolve, pos)
+			}
+		default:
+			x.linear = append(x.linear, pos)
+		}
+	}
+	x.keywords.build()
+	return x
+}
+
+// first 返回被索引的规则中第一条命中的位置，没有命中时返回 noRule
+func (x *ruleIndex) first(c *matchContext) int {
+	best := min(x.domains.lookup(c.hostname), x.keywords.lookup(c.hostname))
+	if c.ip != nil {
+		best = min(best, x.lookupIP(c.ip, false))
+	}
+	return best
+}
+
+// resolved 返回解析出的地址命中的第一条 IP-CIDR 规则的位置，忽略带 no-resolve 的规则
+func (x *ruleIndex) resolved(ips []net.IP) int {
+	best := noRule
+	for _, ip := range ips {
+		best = min(best, x.lookupIP(ip, true))
+	}
+	return best
+}
+
+func (x *ruleIndex) lookupIP(ip net.IP, resolved bool) int {
+	if ip4 := ip.To4(); ip4 != nil {
+		return x.ipv4.lookup(ip4, resolved)
+	}
+	return x.ipv6.lookup(ip.To16(), resolved)
+}
+
+// domainTrie 是按标签逆序存储的域名树，如 www.google.com 存储为 com -> google -> www
+type domainTrie struct {
+	root *domainNode
+}
+
+type domainNode struct {
+	children map[string]*domainNode
+	exact    int // 以此结尾的 DOMAIN 规则位置
+	suffix   int // 以此结尾的 DOMAIN-SUFFIX 规则位置
+}
+
+func newDomainNode() *domainNode {
+	return &domainNode{exact: noRule, suffix: noRule}
+}
+
+func newDomainTrie() *domainTrie {
+	return &domainTrie{root: newDomainNode()}
+}
+
+func (t *domainTrie) insert(domain string, pos int, suffix bool) {
+	node := t.root
+	for rest := domain; rest != ""; {
+		var label string
+		rest, label = lastLabel(rest)
+		child := node.children[label]
+		if child == nil {
+			if node.children == nil {
+				node.children = make(map[string]*domainNode)
+			}
+			child = newDomainNode()
+			node.children[label] = child
+		}
+		node = child
+	}
+	// 同一域名出现多次时保留排在前面的规则
+	if suffix {
+		node.suffix = min(node.suffix, pos)
+	} else {
+		node.exact = min(node.exact, pos)
+	}
+}
+
+// lookup 返回命中 host 的 DOMAIN / DOMAIN-SUFFIX 规则中最靠前的位置
+func (t *domainTrie) lookup(host string) int {
+	best := noRule
+	node := t.root
+	for rest := host; rest != ""; {
+		var label string
+		rest, label = lastLabel(rest)
+		if node = node.children[label]; node == nil {
+			return best
+		}
+		best = min(best, node.suffix)
+	}
+	return min(best, node.exact)
+}
+
+// lastLabel 拆出域名的最后一个标签
+func lastLabel(domain string) (rest, label string) {
+	i := strings.LastIndexByte(domain, '.')
+	if i < 0 {
+		return "", domain
+	}
+	return domain[:i], domain[i+1:]
+}
+
+// keywordMatcher 用 Aho-Corasick 自动机同时匹配所有 DOMAIN-KEYWORD，
+// 每个状态记录经由失败链可达的关键字中最靠前的规则位置
+type keywordMatcher struct {
+	nodes []acNode
+}
+
+type acNode struct {
+	next map[byte]int32
+	fail int32
+	out  int
+}
+
+func newKeywordMatcher() *keywordMatcher {
+	return &keywordMatcher{nodes: []acNode{{out: noRule}}}
+}
+
+func (m *keywordMatcher) insert(keyword string, pos int) {
+	state := int32(0)
+	for i := 0; i < len(keyword); i++ {
+		next, ok := m.nodes[state].next[keyword[i]]
+		if !ok {
+			next = int32(len(m.nodes))
+			m.nodes = append(m.nodes, acNode{out: noRule})
+			if m.nodes[state].next == nil {
+				m.nodes[state].next = make(map[byte]int32)
+			}
+			m.nodes[state].next[keyword[i]] = next
+		}
+		state = next
+	}
+	m.nodes[state].out = min(m.nodes[state].out, pos)
+}
+
+// build 按广度优先计算失败链接
+func (m *keywordMatcher) build() {
+	queue := make([]int32, 0, len(m.nodes))
+	for _, child := range m.nodes[0].next {
+		queue = append(queue, child)
+	}
+	for len(queue) > 0 {
+		state := queue[0]
+		queue = queue[1:]
+		for c, child := range m.nodes[state].next {
+			fail := m.nodes[state].fail
+			for {
+				if next, ok := m.nodes[fail].next[c]; ok {
+					m.nodes[child].fail = next
+					break
+				}
+				if fail == 0 {
+					break
+				}
+				fail = m.nodes[fail].fail
+			}
+			target := m.nodes[child].fail
+			m.nodes[child].out = min(m.nodes[child].out, m.nodes[target].out)
+			queue = append(queue, child)
+		}
+	}
+}
+
+// lookup 返回 host 中包含的关键字对应的最靠前的规则位置
+func (m *keywordMatcher) lookup(host string) int {
+	if len(m.nodes) == 1 {
+		return noRule
+	}
+	best := noRule
+	state := int32(0)
+	for i := 0; i < len(host); i++ {
+		for {
+			if next, ok := m.nodes[state].next[host[i]]; ok {
+				state = next
+				break
+			}
+			if state == 0 {
+				break
+			}
+			state = m.nodes[state].fail
+		}
+		best = min(best, m.nodes[state].out)
+	}
+	return best
+}
+
+// cidrTrie 是按位存储网段的二叉前缀树
+type cidrTrie struct {
+	nodes []cidrNode
+}
+
+type cidrNode struct {
+	child   [2]int32
+	pos     int // 以此为前缀的 IP-CIDR 规则位置
+	resolve int // 同上，但只包括没有 no-resolve 的规则
+}
+
+func newCIDRTrie() *cidrTrie {
+	return &cidrTrie{nodes: []cidrNode{{pos: noRule, resolve: noRule}}}
+}
+
+func (t *cidrTrie) insert(ip net.IP, ones int, pos int, resolve bool) {
+	node := int32(0)
+	for i := 0; i < ones; i++ {
+		bit := ip[i/8] >> (7 - i%8) & 1
+		next := t.nodes[node].child[bit]
+		if next == 0 {
+			next = int32(len(t.nodes))
+			t.nodes = append(t.nodes, cidrNode{pos: noRule, resolve: noRule})
+			t.nodes[node].child[bit] = next
+		}
+		node = next
+	}
+	t.nodes[node].pos = min(t.nodes[node].pos, pos)
+	if resolve {
+		t.nodes[node].resolve = min(t.nodes[node].resolve, pos)
+	}
+}
+
+// lookup 返回包含 ip 的网段中最靠前的规则位置，resolved 为 true 时 ip 是由域名解析得到的，
+// 只考虑没有 no-resolve 的规则
+func (t *cidrTrie) lookup(ip net.IP, resolved bool) int {
+	at := func(node int32) int {
+		if resolved {
+			return t.nodes[node].resolve
+		}
+		return t.nodes[node].pos
+	}
+	node := int32(0)
+	best := at(0)
+	for i := 0; i < len(ip)*8; i++ {
+		bit := ip[i/8] >> (7 - i%8) & 1
+		if node = t.nodes[node].child[bit]; node == 0 {
+			break
+		}
+		best = min(best, at(node))
+	}
+	return best
+}
@@ -0,0 +1,158 @@
+package router
+
+import (
+	"fmt"
+	"math/rand"
+	"net"
+	"strings"
+	"testing"
+)
+
+// benchRules 生成与社区规则列表规模相当的规则文件
+func benchRules(n int) string {
+	rnd := rand.New(rand.NewSource(1))
+	var b strings.Builder
+	b.WriteString("rules:\n")
+	for i := 0; i < n; i++ {
+		switch i % 10 {
+		case 0:
+			fmt.Fprintf(&b, "  - DOMAIN-KEYWORD,kw%d,REJECT\n", i)
+		case 1, 2:
+			fmt.Fprintf(&b, "  - IP-CIDR,%d.%d.%d.0/24,DIRECT\n", 1+rnd.Intn(223), rnd.Intn(256), rnd.Intn(256))
+		case 3:
+			fmt.Fprintf(&b, "  - DOMAIN,host%d.example.org,DIRECT\n", i)
+		case 4:
+			fmt.Fprintf(&b, "  - IP-CIDR6,2001:db8:%x::/48,DIRECT\n", i)
+		default:
+			fmt.Fprintf(&b, "  - DOMAIN-SUFFIX,site%d.com,PROXY\n", i)
+		}
+		if i == n/2 {
+			b.WriteString("  - AND,((DST-PORT,8443),(DOMAIN-KEYWORD,site1)),REJECT\n")
+		}
+	}
+	b.WriteString("  - MATCH,DIRECT\n")
+	return b.String()
+}
+
+var benchHosts = []string{
+	"www.site15.com:443",      // 排在前面的后缀
+	"a.b.site29995.com",       // 排在最后的后缀
+	"host29993.example.org",   // 完整域名
+	"xkw29990y.net",           // 关键字
+	"www.site15.com:8443",     // 被前面的 AND 规则截住
+	"unknown.example.net:443", // 只命中 MATCH
+	"203.0.113.9:22",          // IPv4
+	"[2001:db8:7539::1]:443",  // IPv6
+	"notsite15.com",           // 不应命中 site15.com
+	"WWW.Site15.com:443",      // 大小写混合且带端口
+	"Host29993.Example.ORG:80",
+	"XKW29990Y.net:443",
+}
+
+// TestIndexMatchesLinear 确认索引与逐条匹配的结果完全一致
+func TestIndexMatchesLinear(t *testing.T) {
+	r := newTestRouter(t, benchRules(30000))
+	set := r.set.Load()
+	linear := *set
+	linear.index = nil
+
+	hosts := append([]string{}, benchHosts...)
+	resolve := make(map[string]string)
+	for i, rule := range set.rules[:2000] {
+		// 用规则本身构造能命中的主机
+		switch rule.Type {
+		case DomainSuffix, Domain:
+			hosts = append(hosts, "x."+rule.Payload, rule.Payload)
+		case DomainKeyword:
+			hosts = append(hosts, "a"+rule.Payload+"b.com")
+		case IPCIDR, IPCIDR6:
+			// 以及解析到该网段的域名
+			host := fmt.Sprintf("ip%d.example.net", i)
+			resolve[host] = rule.cidr.IP.String()
+			hosts = append(hosts, rule.cidr.IP.String(), host)
+		}
+	}
+	stubResolve(r, resolve)
+	for _, host := range hosts {
+		req := Request{Host: host}
+		want, wantReason := linear.first(newMatchContext(r.resolver.Load(), req))
+		got, gotReason := set.first(newMatchContext(r.resolver.Load(), req))
+		if want != got || wantReason != gotReason {
+			t.Errorf("%s: 索引命中 %v (%s), 逐条匹配命中 %v (%s)", host, got, gotReason, want, wantReason)
+		}
+	}
+}
+
+func benchmarkFirst(b *testing.B, indexed bool) {
+	path := writeRules(b, benchRules(30000))
+	r, err := NewRouter(path)
+	if err != nil {
+		b.Fatal(err)
+	}
+	stubResolve(r, nil)
+	set := r.set.Load()
+	res := r.resolver.Load()
+	if !indexed {
+		linear := *set
+		linear.index = nil
+		set = &linear
+	}
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		req := Request{Host: benchHosts[i%len(benchHosts)]}
+		set.first(newMatchContext(res, req))
+	}
+}
+
+// BenchmarkMatchLinear 逐条检查预先编译过的规则，不使用索引
+func BenchmarkMatchLinear(b *testing.B) { benchmarkFirst(b, false) }
+
+func BenchmarkMatchIndexed(b *testing.B) { benchmarkFirst(b, true) }
+
+// matchBaseline 是引入索引之前 Router.Match 的实现: 逐条检查规则，
+// 每次都重新解析 IP-CIDR 规则的网段。它不支持的规则类型视为不命中
+func matchBaseline(rules []Rule, host string) Action {
+	hostname := host
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		hostname = h
+	}
+	ip := net.ParseIP(hostname)
+	for _, rule := range rules {
+		match := false
+		switch rule.Type {
+		case DomainSuffix:
+			match = strings.HasSuffix(hostname, rule.Payload)
+		case DomainKeyword:
+			match = strings.Contains(hostname, rule.Payload)
+		case Domain:
+			match = hostname == rule.Payload
+		case IPCIDR, IPCIDR6:
+			if ip != nil {
+				_, cidr, err := net.ParseCIDR(rule.Payload)
+				if err == nil && cidr.Contains(ip) {
+					match = true
+				}
+			}
+		case Match:
+			match = true
+		}
+		if match {
+			return rule.Target
+		}
+	}
+	return ActionProxy
+}
+
+// BenchmarkMatchBaseline 是引入索引之前的原有实现
+func BenchmarkMatchBaseline(b *testing.B) {
+	path := writeRules(b, benchRules(30000))
+	r, err := NewRouter(path)
+	if err != nil {
+		b.Fatal(err)
+	}
+	rules := r.set.Load().rules
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		matchBaseline(rules, benchHosts[i%len(benchHosts)])
+	}
+}
@@ -0,0 +1,195 @@
+package router
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+)
+
+// OutboundType 是命名出站的类型
+type OutboundType string
+
+const (
+	OutboundSSH         OutboundType = "ssh"          // 独立的 SSH 目标 (可带跳板机链)
+	OutboundSelect      OutboundType = "select"       // 使用 selected 指定的成员
+	OutboundFallback    OutboundType = "fallback"     // 按顺序使用第一个可用的成员
+	OutboundURLTest     OutboundType = "url-test"     // 使用延迟最低的成员
+	OutboundLoadBalance OutboundType = "load-balance" // 按目标主机将连接分散到各成员
+)
+
+// 出站组默认的探测间隔
+const defaultGroupInterval = 5 * time.Minute
+
+// Outbound 是规则文件中 outbounds 或 proxy-groups 定义的命名出站，
+// 规则的动作可以是它的名称。连接由 proxy 包按定义建立
+type Outbound struct {
+	Name string
+	Type OutboundType
+
+	// SSH 出站: 目标服务器 ([user@]host[:port] 或 ~/.ssh/config 中的别名)、跳板机和私钥
+	Server   string
+	Jump     []string
+	Identity string
+	// SSH 出站的密码来源，与 -J 的 password-file / password-env 含义相同。
+	// 命令行的 --pass 只用于主目标，不会发送给命名出站
+	PasswordFile string
+	PasswordEnv  string
+
+	// 出站组: 成员可以是其他命名出站、出站组、PROXY 或 DIRECT
+	Members  []string
+	URL      string        // 探测延迟使用的地址，为空时测量 SSH keepalive 的往返时间
+	Interval time.Duration // 探测间隔
+	Selected string        // select 组使用的成员
+}
+
+// IsGroup 判断是否为出站组
+func (o *Outbound) IsGroup() bool {
+	return o.Type != OutboundSSH
+}
+
+// outboundConfig 是 outbounds 中的一项
+type outboundConfig struct {
+	Server       string   `yaml:"server"`
+	Jump         []string `yaml:"jump"`
+	Identity     string   `yaml:"identity"`
+	PasswordFile string   `yaml:"password-file"`
+	PasswordEnv  string   `yaml:"password-env"`
+}
+
+// groupConfig 是 proxy-groups 中的一项
+type groupConfig struct {
+	Type      string   `yaml:"type"`
+	Outbounds []string `yaml:"outbounds"`
+	URL       string   `yaml:"url"`
+	Interval  int      `yaml:"interval"` // 秒
+	Selected  string   `yaml:"selected"`
+}
+
+// builtinOutbound 判断名称是否为内置动作 (不区分大小写)
+func builtinOutbound(name string) bool {
+	switch Action(strings.ToUpper(name)) {
+	case ActionProxy, ActionDirect, ActionReject, ActionRejectDrop:
+		return true
+	}
+	return false
+}
+
+// loadOutbounds 校验 outbounds 和 proxy-groups，返回按名称索引的出站
+func loadOutbounds(cfg *routerConfig) (map[string]*Outbound, error) {
+	outbounds := make(map[string]*Outbound, len(cfg.Outbounds)+len(cfg.Groups))
+	for name, oc := range cfg.Outbounds {
+		if builtinOutbound(name) {
+			return nil, fmt.Errorf("出站 %s: 名称与内置动作冲突", name)
+		}
+		if oc.Server == "" {
+			return nil, fmt.Errorf("出站 %s: 缺少 server", name)
+		}
+		if oc.PasswordFile != "" && oc.PasswordEnv != "" {
+			return nil, fmt.Errorf("出站 %s: password-file 和 password-env 不能同时使用", name)
+		}
+		outbounds[name] = &Outbound{
+			Name:         name,
+			Type:         OutboundSSH,
+			Server:       oc.Server,
+			Jump:         oc.Jump,
+			Identity:     oc.Identity,
+			PasswordFile: oc.PasswordFile,
+			PasswordEnv:  oc.PasswordEnv,
+		}
+	}
+
+	for name, gc := range cfg.Groups {
+		if builtinOutbound(name) {
+			return nil, fmt.Errorf("出站组 %s: 名称与内置动作冲突", name)
+		}
+		if _, ok := outbounds[name]; ok {
+			return nil, fmt.Errorf("出站组 %s: 与 outbounds 中的出站重名", name)
+		}
+		g := &Outbound{
+			Name:     name,
+			Type:     OutboundType(strings.ToLower(gc.Type)),
+			Members:  gc.Outbounds,
+			URL:      gc.URL,
+			Interval: time.Duration(gc.Interval) * time.Second,
+			Selected: gc.Selected,
+		}
+		switch g.Type {
+		case OutboundSelect, OutboundFallback, OutboundURLTest, OutboundLoadBalance:
+		default:
+			return nil, fmt.Errorf("出站组 %s: 未知的类型 %q (可选 select、fallback、url-test、load-balance)", name, gc.Type)
+		}
+		if len(g.Members) == 0 {
+			return nil, fmt.Errorf("出站组 %s: outbounds 不能为空", name)
+		}
+		if g.Interval <= 0 {
+			g.Interval = defaultGroupInterval
+		}
+		if g.Selected == "" {
+			g.Selected = g.Members[0]
+		}
+		outbounds[name] = g
+	}
+
+	// 成员必须已定义，且出站组之间不能循环引用
+	names := make([]string, 0, len(outbounds))
+	for name := range outbounds {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		g := outbounds[name]
+		if !g.IsGroup() {
+			continue
+		}
+		selected := false
+		for i, m := range g.Members {
+			if builtinOutbound(m) {
+				m = strings.ToUpper(m)
+				if Action(m).IsReject() {
+					return nil, fmt.Errorf("出站组 %s: 成员不能为 %s", name, m)
+				}
+				g.Members[i] = m
+			} else if outbounds[m] == nil {
+				return nil, fmt.Errorf("出站组 %s: 成员 %s 未定义", name, m)
+			}
+			selected = selected || strings.EqualFold(g.Selected, m)
+		}
+		if !selected {
+			return nil, fmt.Errorf("出站组 %s: selected 指定的 %s 不是组成员", name, g.Selected)
+		}
+		if builtinOutbound(g.Selected) {
+			g.Selected = strings.ToUpper(g.Selected)
+		}
+		if err := checkGroupCycle(outbounds, name, nil); err != nil {
+			return nil, err
+		}
+	}
+	return outbounds, nil
+}
+
+// checkGroupCycle 检查从 name 出发的成员引用中是否存在循环，path 为已经过的出站组
+func checkGroupCycle(outbounds map[string]*Outbound, name string, path []string) error {
+	for i, p := range path {
+		if p == name {
+			return fmt.Errorf("出站组循环引用: %s", strings.Join(append(path[i:], name), " -> "))
+		}
+	}
+	g := outbounds[name]
+	if g == nil || !g.IsGroup() {
+		return nil
+	}
+	path = append(path, name)
+	for _, m := range g.Members {
+		if err := checkGroupCycle(outbounds, m, path); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Outbound 返回当前规则文件中定义的命名出站
+func (r *Router) Outbound(name string) (*Outbound, bool) {
+	o, ok := r.set.Load().outbounds[name]
+	return o, ok
+}
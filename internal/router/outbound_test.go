@@ -0,0 +1,104 @@
+package router
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestOutbounds(t *testing.T) {
+	r := newTestRouter(t, `
+outbounds:
+  corp-ssh:
+    server: alice@bastion.corp.com
+    jump: [jump.corp.com]
+  lab-ssh:
+    server: lab
+proxy-groups:
+  auto:
+    type: url-test
+    outbounds: [corp-ssh, lab-ssh, direct]
+  manual:
+    type: select
+    outbounds: [auto, proxy]
+    selected: proxy
+rules:
+  - DOMAIN-SUFFIX,lab.internal,lab-ssh
+  - DOMAIN-SUFFIX,corp.com,auto
+  - MATCH,manual
+`)
+
+	tests := []struct {
+		host     string
+		outbound string
+		rule     string
+	}{
+		{host: "git.lab.internal", outbound: "lab-ssh", rule: "DOMAIN-SUFFIX,lab.internal,lab-ssh"},
+		{host: "www.corp.com", outbound: "auto", rule: "DOMAIN-SUFFIX,corp.com,auto"},
+		{host: "example.com", outbound: "manual", rule: "MATCH,manual"},
+	}
+	set := r.set.Load()
+	for _, tt := range tests {
+		got := r.Evaluate(tt.host)
+		if got.Action != ActionProxy || got.Outbound != tt.outbound || got.Target() != tt.outbound {
+			t.Errorf("Evaluate(%q) = %s/%s, 期望 PROXY/%s", tt.host, got.Action, got.Outbound, tt.outbound)
+		}
+		if s := set.rules[got.Index-1].String(); s != tt.rule {
+			t.Errorf("规则 #%d = %q, 期望 %q", got.Index, s, tt.rule)
+		}
+	}
+
+	auto, ok := r.Outbound("auto")
+	if !ok || auto.Type != OutboundURLTest || auto.Interval != defaultGroupInterval {
+		t.Fatalf("Outbound(auto) = %+v", auto)
+	}
+	if strings.Join(auto.Members, ",") != "corp-ssh,lab-ssh,DIRECT" {
+		t.Errorf("auto 的成员 = %v", auto.Members)
+	}
+	if manual, _ := r.Outbound("manual"); manual.Selected != "PROXY" {
+		t.Errorf("manual 选中 %s, 期望 PROXY", manual.Selected)
+	}
+}
+
+func TestOutboundErrors(t *testing.T) {
+	tests := []struct {
+		rules string
+		want  string
+	}{
+		{
+			rules: "outbounds:\n  a:\n    server: a.test\nrules:\n  - DOMAIN,x.test,b\n",
+			want:  "规则文件第 5 行第 5 列: 未知的动作或出站 b",
+		},
+		{
+			rules: "outbounds:\n  direct:\n    server: a.test\n",
+			want:  "出站 direct: 名称与内置动作冲突",
+		},
+		{
+			rules: "proxy-groups:\n  g:\n    type: fallback\n    outbounds: [missing]\n",
+			want:  "出站组 g: 成员 missing 未定义",
+		},
+		{
+			rules: "proxy-groups:\n  g:\n    type: random\n    outbounds: [PROXY]\n",
+			want:  `出站组 g: 未知的类型 "random"`,
+		},
+		{
+			rules: "proxy-groups:\n  a:\n    type: select\n    outbounds: [b]\n  b:\n    type: fallback\n    outbounds: [a]\n",
+			want:  "出站组循环引用: a -> b -> a",
+		},
+		{
+			rules: "proxy-groups:\n  g:\n    type: select\n    outbounds: [PROXY]\n    selected: DIRECT\n",
+			want:  "出站组 g: selected 指定的 DIRECT 不是组成员",
+		},
+	}
+	for _, tt := range tests {
+		_, err := NewRouter(writeRules(t, tt.rules))
+		if err == nil || !strings.Contains(err.Error(), tt.want) {
+			t.Errorf("NewRouter 错误 = %v, 期望包含 %q", err, tt.want)
+		}
+	}
+
+	// 没有定义命名出站时，未知的动作仍按 PROXY 处理
+	r := newTestRouter(t, "rules:\n  - DOMAIN,x.test,Proxy-Group\n")
+	if got := r.Evaluate("x.test"); got.Action != ActionProxy || got.Outbound != "" {
+		t.Errorf("Evaluate(x.test) = %s/%s, 期望 PROXY", got.Action, got.Outbound)
+	}
+}
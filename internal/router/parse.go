@@ -0,0 +1,352 @@
+package router
+
+import (
+	"fmt"
+	"net"
+	"regexp"
+	"strings"
+)
+
+// parseError 是规则语法或内容错误，col 为出错位置在规则中的列号 (从 1 开始)
+type parseError struct {
+	col int
+	msg string
+}
+
+func (e *parseError) Error() string {
+	return fmt.Sprintf("第 %d 列: %s", e.col, e.msg)
+}
+
+// ruleParser 解析单条规则，支持逻辑规则的嵌套:
+//
+//	TYPE,PAYLOAD[,TARGET][,no-resolve]
+//	AND,((TYPE,PAYLOAD),(OR,((TYPE,PAYLOAD),(TYPE,PAYLOAD)))),TARGET
+//	NOT,((TYPE,PAYLOAD)),TARGET
+//	MATCH,TARGET
+type ruleParser struct {
+	s   string
+	pos int
+}
+
+// parseRule 解析规则文件中的一行，只检查语法，规则内容由 ruleBuilder.compile 校验
+func parseRule(s string) (Rule, error) {
+	p := &ruleParser{s: s}
+	rule, err := p.condition(false)
+	if err != nil {
+		return rule, err
+	}
+
+	// 未指定动作时默认使用 PROXY
+	rule.Target = ActionProxy
+	if rule.Type == Match {
+		rule.setTarget(rule.Payload)
+		rule.Payload = ""
+	} else if p.accept(',') {
+		target, pos := p.token(",")
+		if target == "" {
+			return rule, p.errorf(pos, "缺少动作")
+		}
+		rule.setTarget(target)
+	}
+	if err := p.options(&rule, ","); err != nil {
+		return rule, err
+	}
+	if p.skipSpace(); p.pos < len(p.s) {
+		return rule, p.errorf(p.pos, "多余的内容: %s", p.s[p.pos:])
+	}
+	return rule, nil
+}
+
+// parseCondition 解析不含动作的规则，如 classical 规则集中的 "DOMAIN-KEYWORD,ads,no-resolve"
+func parseCondition(s string) (Rule, error) {
+	p := &ruleParser{s: s}
+	rule, err := p.condition(false)
+	if err != nil {
+		return rule, err
+	}
+	if rule.Type == Match {
+		return rule, p.errorf(rule.col-1, "规则集中不能使用 MATCH")
+	}
+	if err := p.options(&rule, ","); err != nil {
+		return rule, err
+	}
+	if p.skipSpace(); p.pos < len(p.s) {
+		return rule, p.errorf(p.pos, "多余的内容: %s", p.s[p.pos:])
+	}
+	return rule, nil
+}
+
+// condition 解析 "类型,内容"。逻辑规则的内容为括号中的子规则列表，
+// sub 为 true 时表示正在解析子规则，内容在逗号或右括号处结束
+func (p *ruleParser) condition(sub bool) (Rule, error) {
+	name, start := p.token(",()")
+	if name == "" {
+		return Rule{}, p.errorf(start, "缺少规则类型")
+	}
+	rule := Rule{Type: RuleType(strings.ToUpper(name)), col: start + 1}
+	if !rule.Type.valid() {
+		return rule, p.errorf(start, "未知的规则类型: %s", name)
+	}
+	if sub && rule.Type == Match {
+		return rule, p.errorf(start, "MATCH 不能作为子规则")
+	}
+	if err := p.expect(','); err != nil {
+		return rule, err
+	}
+
+	if !rule.Type.logical() {
+		stop := ","
+		if sub {
+			stop = ",)"
+		}
+		var payload string
+		var pos int
+		if rule.Type == DomainRegex {
+			payload, pos = p.regexToken(stop)
+		} else {
+			payload, pos = p.token(stop)
+		}
+		if payload == "" {
+			return rule, p.errorf(pos, "%s 规则缺少内容", rule.Type)
+		}
+		rule.Payload = payload
+		return rule, nil
+	}
+
+	p.skipSpace()
+	start = p.pos
+	if err := p.expect('('); err != nil {
+		return rule, err
+	}
+	for {
+		if err := p.expect('('); err != nil {
+			return rule, err
+		}
+		child, err := p.condition(true)
+		if err != nil {
+			return rule, err
+		}
+		if err := p.options(&child, ",)"); err != nil {
+			return rule, err
+		}
+		if err := p.expect(')'); err != nil {
+			return rule, err
+		}
+		rule.sub = append(rule.sub, child)
+		if !p.accept(',') {
+			break
+		}
+	}
+	if err := p.expect(')'); err != nil {
+		return rule, err
+	}
+	rule.Payload = p.s[start:p.pos]
+	if rule.Type == Not && len(rule.sub) != 1 {
+		return rule, p.errorf(start, "NOT 只能包含一条子规则")
+	}
+	return rule, nil
+}
+
+// options 解析规则末尾的选项，目前只有 no-resolve
+func (p *ruleParser) options(rule *Rule, stop string) error {
+	for p.accept(',') {
+		opt, pos := p.token(stop)
+		if !strings.EqualFold(opt, "no-resolve") {
+			return p.errorf(pos, "未知的规则选项 %s", opt)
+		}
+		rule.NoResolve = true
+	}
+	return nil
+}
+
+// token 读取到 stop 中的任一字符为止的内容，返回去掉首尾空格的内容和起始位置
+func (p *ruleParser) token(stop string) (string, int) {
+	p.skipSpace()
+	start := p.pos
+	for p.pos < len(p.s) && !strings.ContainsRune(stop, rune(p.s[p.pos])) {
+		p.pos++
+	}
+	return strings.TrimSpace(p.s[start:p.pos]), start
+}
+
+// regexToken 与 token 相同，但只在括号、花括号和字符类之外的 stop 字符处结束，
+// 转义的字符不作为分隔符。DOMAIN-REGEX 的内容因此可以包含 (a|b)、{1,3} 和 [,)]
+func (p *ruleParser) regexToken(stop string) (string, int) {
+	p.skipSpace()
+	start := p.pos
+	depth, class := 0, false
+	for ; p.pos < len(p.s); p.pos++ {
+		c := p.s[p.pos]
+		switch {
+		case c == '\\':
+			p.pos++
+		case class:
+			class = c != ']'
+		case c == '[':
+			class = true
+		case c == '(' || c == '{':
+			depth++
+		case depth > 0 && (c == ')' || c == '}'):
+			depth--
+		case depth == 0 && strings.IndexByte(stop, c) >= 0:
+			return strings.TrimSpace(p.s[start:p.pos]), start
+		}
+	}
+	p.pos = len(p.s)
+	return strings.TrimSpace(p.s[start:p.pos]), start
+}
+
+func (p *ruleParser) skipSpace() {
+	for p.pos < len(p.s) && p.s[p.pos] == ' ' {
+		p.pos++
+	}
+}
+
+func (p *ruleParser) accept(c byte) bool {
+	p.skipSpace()
+	if p.pos < len(p.s) && p.s[p.pos] == c {
+		p.pos++
+		return true
+	}
+	return false
+}
+
+func (p *ruleParser) expect(c byte) error {
+	if p.accept(c) {
+		return nil
+	}
+	if p.pos >= len(p.s) {
+		return p.errorf(p.pos, "缺少 '%c'", c)
+	}
+	return p.errorf(p.pos, "应为 '%c', 得到 '%c'", c, p.s[p.pos])
+}
+
+func (p *ruleParser) errorf(pos int, format string, args ...any) error {
+	return &parseError{col: pos + 1, msg: fmt.Sprintf(format, args...)}
+}
+
+// setTarget 设置规则的动作，不是内置动作时记录为命名出站，由 ruleBuilder 校验
+func (r *Rule) setTarget(target string) {
+	r.Target = parseAction(target)
+	if !builtinOutbound(target) {
+		r.Outbound = target
+	}
+}
+
+// wildcardRegexp 将通配符转换为正则表达式: * 匹配任意字符 (包括 .)，? 匹配单个字符
+func wildcardRegexp(pattern string) *regexp.Regexp {
+	var b strings.Builder
+	b.WriteString("^")
+	for _, c := range pattern {
+		switch c {
+		case '*':
+			b.WriteString(".*")
+		case '?':
+			b.WriteString(".")
+		default:
+			b.WriteString(regexp.QuoteMeta(string(c)))
+		}
+	}
+	b.WriteString("$")
+	return regexp.MustCompile(b.String())
+}
+
+// parseAction 解析规则的动作，预期之外的动作统一视为 PROXY
+func parseAction(s string) Action {
+	switch strings.ToUpper(s) {
+	case "DIRECT":
+		return ActionDirect
+	case "REJECT":
+		return ActionReject
+	case "REJECT-DROP":
+		return ActionRejectDrop
+	default:
+		return ActionProxy
+	}
+}
+
+// ruleBuilder 校验规则内容并预先编译网段、端口和 Geo 数据
+type ruleBuilder struct {
+	path  string // 规则文件路径，用于解析数据库的相对路径
+	cfg   *routerConfig
+	set   *ruleSet
+	fetch bool // 远程规则集没有缓存时是否立即下载，只在首次加载时为 true
+}
+
+// compile 校验规则及其子规则，错误中包含出错规则的列号
+func (b *ruleBuilder) compile(rule *Rule) error {
+	fail := func(format string, args ...any) error {
+		return &parseError{col: rule.col, msg: fmt.Sprintf(format, args...)}
+	}
+
+	// 没有定义任何命名出站时，与之前一样将未知的动作视为 PROXY
+	if rule.Outbound != "" && b.set.outbounds[rule.Outbound] == nil {
+		if len(b.set.outbounds) > 0 {
+			return fail("未知的动作或出站 %s", rule.Outbound)
+		}
+		rule.Outbound = ""
+	}
+
+	var err error
+	switch rule.Type {
+	case Domain, DomainKeyword:
+		rule.Payload = strings.ToLower(rule.Payload)
+	case DomainSuffix:
+		rule.Payload = strings.TrimPrefix(strings.ToLower(rule.Payload), ".")
+	case DomainRegex:
+		if rule.regex, err = regexp.Compile(rule.Payload); err != nil {
+			return fail("无效的正则表达式 %s: %v", rule.Payload, err)
+		}
+	case DomainWildcard:
+		rule.Payload = strings.ToLower(rule.Payload)
+		rule.regex = wildcardRegexp(rule.Payload)
+	case IPCIDR, IPCIDR6, SrcIPCIDR:
+		if _, rule.cidr, err = net.ParseCIDR(rule.Payload); err != nil {
+			return fail("无效的网段 %s", rule.Payload)
+		}
+	case DstPort, SrcPort:
+		if rule.ports, err = parsePortRange(rule.Payload); err != nil {
+			return fail("%v", err)
+		}
+	case Network:
+		rule.Payload = strings.ToLower(rule.Payload)
+		if rule.Payload != "tcp" && rule.Payload != "udp" {
+			return fail("NETWORK 只能为 tcp 或 udp")
+		}
+	case InName:
+		rule.Payload = strings.ToLower(rule.Payload)
+	case RuleSet:
+		if rule.provider = b.set.providers[rule.Payload]; rule.provider == nil {
+			return fail("规则集 %s 未在 rule-providers 中定义", rule.Payload)
+		}
+	case GeoIP:
+		rule.Payload = strings.ToUpper(rule.Payload)
+		// GEOIP,LAN 只检查是否为局域网地址，不需要数据库
+		if rule.Payload == "LAN" {
+			break
+		}
+		if b.cfg.GeoIP == "" {
+			return fail("使用 GEOIP 规则需要在规则文件中通过 geoip 指定 mmdb 数据库")
+		}
+		// 数据库保存在规则中: 规则集在后台更新时同样用 b 编译，不能修改已在使用的 b.set
+		if rule.geoip, err = openGeoIP(relativeTo(b.path, b.cfg.GeoIP)); err != nil {
+			return fail("%v", err)
+		}
+	case GeoSite:
+		if b.cfg.GeoSite == "" {
+			return fail("使用 GEOSITE 规则需要在规则文件中通过 geosite 指定 geosite.dat")
+		}
+		if rule.site, err = loadGeoSite(relativeTo(b.path, b.cfg.GeoSite), rule.Payload); err != nil {
+			return fail("%v", err)
+		}
+	case And, Or, Not:
+		for i := range rule.sub {
+			// 逻辑规则上的 no-resolve 作用于所有子规则
+			rule.sub[i].NoResolve = rule.sub[i].NoResolve || rule.NoResolve
+			if err := b.compile(&rule.sub[i]); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
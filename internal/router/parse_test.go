@@ -0,0 +1,128 @@
+package router
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestParseRule(t *testing.T) {
+	tests := []struct {
+		line    string
+		want    string // 解析结果的 String()
+		subs    int
+		wantErr string // 期望错误中包含的内容
+	}{
+		{line: "DOMAIN-SUFFIX,google.com,PROXY", want: "DOMAIN-SUFFIX,google.com,PROXY"},
+		{line: "domain,a.test,direct", want: "DOMAIN,a.test,DIRECT"},
+		{line: "DOMAIN,a.test", want: "DOMAIN,a.test,PROXY"},
+		{line: "IP-CIDR,10.0.0.0/8,DIRECT,no-resolve", want: "IP-CIDR,10.0.0.0/8,DIRECT,no-resolve"},
+		{line: "MATCH,DIRECT", want: "MATCH,DIRECT"},
+		{
+			line: "AND,((DOMAIN-SUFFIX,corp.com),(DST-PORT,443)),DIRECT",
+			want: "AND,((DOMAIN-SUFFIX,corp.com),(DST-PORT,443)),DIRECT",
+			subs: 2,
+		},
+		{
+			line: "OR,((DOMAIN,a.test),(NOT,((NETWORK,tcp)))),REJECT",
+			want: "OR,((DOMAIN,a.test),(NOT,((NETWORK,tcp)))),REJECT",
+			subs: 2,
+		},
+		{
+			line: "AND, ((IP-CIDR,10.0.0.0/8,no-resolve), (DST-PORT,22)), DIRECT",
+			want: "AND,((IP-CIDR,10.0.0.0/8,no-resolve), (DST-PORT,22)),DIRECT",
+			subs: 2,
+		},
+		{line: "NOT,((DOMAIN,a.test)),DIRECT", want: "NOT,((DOMAIN,a.test)),DIRECT", subs: 1},
+		{line: `DOMAIN-REGEX,^(a|b)\.com$,REJECT`, want: `DOMAIN-REGEX,^(a|b)\.com$,REJECT`},
+		{line: `DOMAIN-REGEX,^cdn[0-9]{1,3}\.test$,DIRECT`, want: `DOMAIN-REGEX,^cdn[0-9]{1,3}\.test$,DIRECT`},
+		{line: `DOMAIN-REGEX,^a[,)]\,b$,DIRECT,no-resolve`, want: `DOMAIN-REGEX,^a[,)]\,b$,DIRECT,no-resolve`},
+		{
+			line: `AND,((DOMAIN-REGEX,^(a|b)\.com$),(DST-PORT,443)),REJECT`,
+			want: `AND,((DOMAIN-REGEX,^(a|b)\.com$),(DST-PORT,443)),REJECT`,
+			subs: 2,
+		},
+		{
+			line: `OR,((DOMAIN-REGEX,^x{1,3}\.test$,no-resolve),(DOMAIN,a.test)),DIRECT`,
+			want: `OR,((DOMAIN-REGEX,^x{1,3}\.test$,no-resolve),(DOMAIN,a.test)),DIRECT`,
+			subs: 2,
+		},
+
+		{line: "FOO,a.test,DIRECT", wantErr: "第 1 列: 未知的规则类型: FOO"},
+		{line: "MATCH", wantErr: "第 6 列: 缺少 ','"},
+		{line: "DOMAIN,,DIRECT", wantErr: "第 8 列: DOMAIN 规则缺少内容"},
+		{line: "DOMAIN,a.test,DIRECT,resolve", wantErr: "第 22 列: 未知的规则选项 resolve"},
+		{line: "AND,(DOMAIN,a.test),DIRECT", wantErr: "第 6 列: 应为 '(', 得到 'D'"},
+		{line: "AND,((DOMAIN,a.test),(DST-PORT,443),DIRECT", wantErr: "第 37 列: 应为 '(', 得到 'D'"},
+		{line: "AND,((DOMAIN,a.test)", wantErr: "第 21 列: 缺少 ')'"},
+		{line: "OR,((DOMAIN,a.test),(MATCH,x)),DIRECT", wantErr: "第 22 列: MATCH 不能作为子规则"},
+		{line: "NOT,((DOMAIN,a),(DOMAIN,b)),DIRECT", wantErr: "第 5 列: NOT 只能包含一条子规则"},
+		{line: "AND,((DOMAIN,a.test)) x,DIRECT", wantErr: "第 23 列: 多余的内容"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.line, func(t *testing.T) {
+			rule, err := parseRule(tt.line)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("parseRule(%q) 错误 = %v, 期望包含 %q", tt.line, err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("parseRule(%q) 失败: %v", tt.line, err)
+			}
+			if got := rule.String(); got != tt.want {
+				t.Errorf("parseRule(%q) = %q, 期望 %q", tt.line, got, tt.want)
+			}
+			if len(rule.sub) != tt.subs {
+				t.Errorf("parseRule(%q) 有 %d 条子规则, 期望 %d", tt.line, len(rule.sub), tt.subs)
+			}
+		})
+	}
+}
+
+func TestLogicalRules(t *testing.T) {
+	r := newTestRouter(t, `
+rules:
+  - AND,((DOMAIN-SUFFIX,corp.com),(DST-PORT,443)),DIRECT
+  - OR,((DOMAIN,a.test),(DOMAIN,b.test)),REJECT
+  - NOT,((NETWORK,tcp)),REJECT-DROP
+  - AND,((DOMAIN-REGEX,^(api|www)\.x{1,3}\.test$),(DST-PORT,443)),REJECT
+  - MATCH,PROXY
+`)
+
+	tests := []struct {
+		req    Request
+		action Action
+	}{
+		{req: Request{Host: "git.corp.com:443"}, action: ActionDirect},
+		{req: Request{Host: "git.corp.com:22"}, action: ActionProxy},
+		{req: Request{Host: "b.test:80"}, action: ActionReject},
+		{req: Request{Host: "8.8.8.8:53", Network: "udp"}, action: ActionRejectDrop},
+		{req: Request{Host: "api.xx.test:443"}, action: ActionReject},
+		{req: Request{Host: "cdn.xx.test:443"}, action: ActionProxy},
+		{req: Request{Host: "www.xxxx.test:443"}, action: ActionProxy},
+	}
+	for _, tt := range tests {
+		if got := r.EvaluateRequest(tt.req); got.Action != tt.action {
+			t.Errorf("EvaluateRequest(%+v) = %s (%s), 期望 %s", tt.req, got.Action, got, tt.action)
+		}
+	}
+}
+
+func TestRuleErrorPosition(t *testing.T) {
+	tests := []struct {
+		rules string
+		want  string
+	}{
+		{rules: "rules:\n  - AND,((DOMAIN,a),(DST-PORT,99999)),DIRECT\n", want: "规则文件第 2 行第 22 列: 无效的端口 99999"},
+		{rules: "rules:\n  - DOMAIN,a,DIRECT\n  - \"IP-CIDR,10.0.0/8\"\n", want: "规则文件第 3 行第 6 列: 无效的网段 10.0.0/8"},
+	}
+	for _, tt := range tests {
+		path := writeRules(t, tt.rules)
+		_, err := NewRouter(path)
+		if err == nil || err.Error() != tt.want {
+			t.Errorf("NewRouter 错误 = %v, 期望 %q", err, tt.want)
+		}
+	}
+}
@@ -0,0 +1,150 @@
+package router
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// findProcess 查找本机上使用 ip:port 作为本地地址的进程，返回其可执行文件路径。
+// 先在 /proc/net/tcp (或 udp) 中找到 socket 的 inode，再在各进程的 fd 中找到持有它的进程。
+// 读取其他用户进程的 fd 需要 root 权限
+func findProcess(network string, ip net.IP, port int) (string, error) {
+	inode, err := socketInode(network, ip, port)
+	if err != nil {
+		return "", err
+	}
+	pid, ok := socketOwner("socket:[" + inode + "]")
+	if !ok {
+		return "", fmt.Errorf("找不到使用 %s 的进程", net.JoinHostPort(ip.String(), fmt.Sprint(port)))
+	}
+	exe, err := os.Readlink(filepath.Join("/proc", pid, "exe"))
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSuffix(exe, " (deleted)"), nil
+}
+
+// socketOwnerTTL 是 socket 所属进程的缓存时间
+const socketOwnerTTL = 10 * time.Second
+
+// socketOwners 缓存最近找到的 socket 所属进程。同一连接再次匹配 (如 HTTP keep-alive 上的
+// 后续请求) 时不必遍历所有进程；新的 socket 先在最近找到过的进程中查找，它们往往会继续发起连接
+var socketOwners = struct {
+	sync.Mutex
+	pids map[string]ownerEntry // socket:[inode] -> 进程
+}{pids: make(map[string]ownerEntry)}
+
+type ownerEntry struct {
+	pid     string
+	expires time.Time
+}
+
+// socketOwner 返回持有 target (socket:[inode]) 的进程号
+func socketOwner(target string) (string, bool) {
+	now := time.Now()
+	socketOwners.Lock()
+	cached, ok := socketOwners.pids[target]
+	var recent []string
+	tried := make(map[string]bool)
+	for key, e := range socketOwners.pids {
+		if now.After(e.expires) {
+			delete(socketOwners.pids, key)
+			continue
+		}
+		if !tried[e.pid] {
+			tried[e.pid] = true
+			recent = append(recent, e.pid)
+		}
+	}
+	socketOwners.Unlock()
+
+	// 缓存的结果需确认进程仍持有该 socket，inode 可能已被释放并分配给其它 socket
+	if ok && now.Before(cached.expires) && ownsSocket(cached.pid, target) {
+		return cached.pid, true
+	}
+	for _, pid := range recent {
+		if ownsSocket(pid, target) {
+			rememberOwner(target, pid, now)
+			return pid, true
+		}
+	}
+
+	procs, err := os.ReadDir("/proc")
+	if err != nil {
+		return "", false
+	}
+	for _, proc := range procs {
+		pid := proc.Name()
+		if pid[0] < '0' || pid[0] > '9' || tried[pid] {
+			continue
+		}
+		if ownsSocket(pid, target) {
+			rememberOwner(target, pid, now)
+			return pid, true
+		}
+	}
+	return "", false
+}
+
+func rememberOwner(target, pid string, now time.Time) {
+	socketOwners.Lock()
+	socketOwners.pids[target] = ownerEntry{pid: pid, expires: now.Add(socketOwnerTTL)}
+	socketOwners.Unlock()
+}
+
+// ownsSocket 判断进程 pid 的 fd 中是否有 target
+func ownsSocket(pid, target string) bool {
+	fds, err := os.ReadDir(filepath.Join("/proc", pid, "fd"))
+	if err != nil {
+		return false
+	}
+	for _, fd := range fds {
+		if link, _ := os.Readlink(filepath.Join("/proc", pid, "fd", fd.Name())); link == target {
+			return true
+		}
+	}
+	return false
+}
+
+// socketInode 在 /proc/net 中查找本地地址为 ip:port 的 socket，返回其 inode
+func socketInode(network string, ip net.IP, port int) (string, error) {
+	if network != "udp" {
+		network = "tcp"
+	}
+	for _, name := range []string{network, network + "6"} {
+		// 地址按 32 位一组、以主机字节序 (小端) 的十六进制表示
+		addr := ip.To16()
+		if name == network {
+			if addr = ip.To4(); addr == nil {
+				continue
+			}
+		}
+		var b strings.Builder
+		for i := 0; i < len(addr); i += 4 {
+			fmt.Fprintf(&b, "%02X%02X%02X%02X", addr[i+3], addr[i+2], addr[i+1], addr[i])
+		}
+		want := fmt.Sprintf("%s:%04X", b.String(), port)
+
+		f, err := os.Open(filepath.Join("/proc/net", name))
+		if err != nil {
+			continue
+		}
+		scanner := bufio.NewScanner(f)
+		for scanner.Scan() {
+			// sl local_address rem_address st tx_queue:rx_queue tr:tm->when retrnsmt uid timeout inode
+			fields := strings.Fields(scanner.Text())
+			if len(fields) > 9 && fields[1] == want && fields[9] != "0" {
+				f.Close()
+				return fields[9], nil
+			}
+		}
+		f.Close()
+	}
+	return "", fmt.Errorf("/proc/net 中没有 %s 连接 %s", network, net.JoinHostPort(ip.String(), fmt.Sprint(port)))
+}
@@ -0,0 +1,69 @@
+package router
+
+import (
+	"net"
+	"os"
+	"strconv"
+	"testing"
+)
+
+// TestFindProcess 通过本进程发起的连接查找进程
+func TestFindProcess(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	conn, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	local := conn.LocalAddr().(*net.TCPAddr)
+	got, err := findProcess("tcp", local.IP, local.Port)
+	if err != nil {
+		t.Fatalf("findProcess 失败: %v", err)
+	}
+	want, _ := os.Executable()
+	if got != want {
+		t.Errorf("findProcess = %s, 期望 %s", got, want)
+	}
+}
+
+// TestSocketOwnerCache 确认找到的 socket 所属进程被缓存，缓存的进程不再持有该 socket 时重新查找
+func TestSocketOwnerCache(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	conn, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	local := conn.LocalAddr().(*net.TCPAddr)
+	inode, err := socketInode("tcp", local.IP, local.Port)
+	if err != nil {
+		t.Fatal(err)
+	}
+	target := "socket:[" + inode + "]"
+	pid := strconv.Itoa(os.Getpid())
+	if got, ok := socketOwner(target); !ok || got != pid {
+		t.Fatalf("socketOwner = %q, %v, 期望 %s", got, ok, pid)
+	}
+	socketOwners.Lock()
+	cached := socketOwners.pids[target]
+	socketOwners.Unlock()
+	if cached.pid != pid {
+		t.Errorf("缓存的进程为 %q, 期望 %s", cached.pid, pid)
+	}
+
+	// 缓存指向不持有该 socket 的进程 (这里是不存在的进程 0) 时不能直接使用
+	rememberOwner(target, "0", cached.expires.Add(-socketOwnerTTL))
+	if got, ok := socketOwner(target); !ok || got != pid {
+		t.Errorf("缓存失效后 socketOwner = %q, %v, 期望 %s", got, ok, pid)
+	}
+}
@@ -0,0 +1,13 @@
+//go:build !linux
+
+package router
+
+import (
+	"fmt"
+	"net"
+)
+
+// findProcess 当前只支持 Linux
+func findProcess(network string, ip net.IP, port int) (string, error) {
+	return "", fmt.Errorf("当前系统不支持按进程匹配")
+}
@@ -0,0 +1,383 @@
+package router
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"gopkg.in/yaml.v3"
+
+	"github.com/Sesame2/gotun/internal/logger"
+)
+
+// 规则集的行为，决定文件中每一项的含义
+const (
+	behaviorDomain    = "domain"    // 每行一个域名，+.example.com 或 .example.com 表示后缀，含 * 时为通配符
+	behaviorIPCIDR    = "ipcidr"    // 每行一个网段或 IP
+	behaviorClassical = "classical" // 每行一条不含动作的规则，如 DOMAIN-KEYWORD,ads
+)
+
+// 远程规则集默认每天更新一次，下载失败后过一段时间再重试
+const (
+	defaultProviderInterval = 24 * time.Hour
+	providerRetryInterval   = 5 * time.Minute
+	providerDownloadTimeout = 30 * time.Second // 包括读取响应内容
+)
+
+// providerConfig 是 rule-providers 中的一项
+type providerConfig struct {
+	Type     string `yaml:"type"`     // file 或 http
+	Behavior string `yaml:"behavior"` // domain、ipcidr 或 classical
+	Path     string `yaml:"path"`     // 本地文件，http 类型时为缓存文件
+	URL      string `yaml:"url"`
+	Interval int    `yaml:"interval"` // http 类型的更新间隔 (秒)
+}
+
+// ruleProvider 是从外部文件加载的规则集，规则中通过 RULE-SET,名称,动作 引用。
+// 内容更新时原子地替换，不需要重新加载整个规则文件
+type ruleProvider struct {
+	name     string
+	behavior string
+	path     string
+	url      string
+	interval time.Duration
+	builder  *ruleBuilder // 用于编译 classical 规则
+
+	set      atomic.Pointer[ruleSet]
+	updating atomic.Bool
+
+	mu      sync.Mutex
+	modTime time.Time // 已加载的文件的修改时间
+	retryAt time.Time // 下载失败后，在此之前不再重试
+}
+
+// loadProviders 加载规则文件中的所有规则集。http 类型优先使用本地缓存，没有缓存时:
+// 首次加载立即下载；重新加载时先视为空的规则集，由 refresh 在后台下载，
+// 避免 Watch 在网络请求上阻塞
+func (b *ruleBuilder) loadProviders() (map[string]*ruleProvider, error) {
+	providers := make(map[string]*ruleProvider, len(b.cfg.RuleProviders))
+	for name, pc := range b.cfg.RuleProviders {
+		p := &ruleProvider{
+			name:     name,
+			behavior: strings.ToLower(pc.Behavior),
+			url:      pc.URL,
+			interval: time.Duration(pc.Interval) * time.Second,
+			builder:  b,
+		}
+		switch p.behavior {
+		case behaviorDomain, behaviorIPCIDR, behaviorClassical:
+		default:
+			return nil, fmt.Errorf("规则集 %s: 未知的 behavior %q (可选 domain、ipcidr、classical)", name, pc.Behavior)
+		}
+
+		switch strings.ToLower(pc.Type) {
+		case "file", "":
+			if pc.Path == "" {
+				return nil, fmt.Errorf("规则集 %s: 缺少 path", name)
+			}
+			p.url = ""
+		case "http":
+			if pc.URL == "" {
+				return nil, fmt.Errorf("规则集 %s: 缺少 url", name)
+			}
+			if pc.Path == "" {
+				pc.Path = filepath.Join("providers", name+".yaml")
+			}
+			if p.interval <= 0 {
+				p.interval = defaultProviderInterval
+			}
+		default:
+			return nil, fmt.Errorf("规则集 %s: 未知的 type %q (可选 file、http)", name, pc.Type)
+		}
+		p.path = relativeTo(b.path, pc.Path)
+
+		if p.url != "" {
+			if _, err := os.Stat(p.path); err != nil {
+				if b.fetch {
+					if err := p.update(); err != nil {
+						return nil, err
+					}
+				} else {
+					p.set.Store(&ruleSet{})
+				}
+				providers[name] = p
+				continue
+			}
+		}
+		if err := p.load(); err != nil {
+			return nil, err
+		}
+		providers[name] = p
+	}
+	return providers, nil
+}
+
+// load 读取并编译规则集文件，成功后替换当前内容
+func (p *ruleProvider) load() error {
+	info, err := os.Stat(p.path)
+	if err != nil {
+		return fmt.Errorf("规则集 %s: %w", p.name, err)
+	}
+	// 解析失败时同样记录修改时间，文件再次变化前不再重试
+	p.mu.Lock()
+	p.modTime = info.ModTime()
+	p.mu.Unlock()
+
+	set, err := p.build(p.path)
+	if err != nil {
+		return err
+	}
+	p.set.Store(set)
+	return nil
+}
+
+// build 读取并编译规则集文件，不修改当前内容
+func (p *ruleProvider) build(path string) (*ruleSet, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("规则集 %s: %w", p.name, err)
+	}
+	entries, lines := providerEntries(data)
+	set := &ruleSet{rules: make([]Rule, 0, len(entries))}
+	for i, entry := range entries {
+		rule, err := p.parseEntry(entry)
+		if err != nil {
+			if pe, ok := err.(*parseError); ok {
+				return nil, fmt.Errorf("规则集 %s 第 %d 行第 %d 列: %s", p.name, lines[i], pe.col, pe.msg)
+			}
+			return nil, fmt.Errorf("规则集 %s 第 %d 行: %v", p.name, lines[i], err)
+		}
+		rule.Index = i + 1
+		rule.Line = lines[i]
+		set.rules = append(set.rules, rule)
+	}
+	set.index = buildIndex(set.rules)
+	return set, nil
+}
+
+// parseEntry 按规则集的行为将一项转换为规则
+func (p *ruleProvider) parseEntry(entry string) (Rule, error) {
+	var rule Rule
+	switch p.behavior {
+	case behaviorDomain:
+		if !validDomainEntry(entry) {
+			return rule, &parseError{col: 1, msg: fmt.Sprintf("无效的域名 %s", entry)}
+		}
+		rule = Rule{Type: Domain, Payload: entry, col: 1}
+		if strings.ContainsAny(entry, "*?") {
+			rule.Type = DomainWildcard
+		} else if suffix, ok := strings.CutPrefix(entry, "+."); ok {
+			rule.Type, rule.Payload = DomainSuffix, suffix
+		} else if strings.HasPrefix(entry, ".") {
+			rule.Type = DomainSuffix
+		}
+	case behaviorIPCIDR:
+		rule = Rule{Type: IPCIDR, Payload: entry, col: 1}
+		if !strings.Contains(entry, "/") {
+			// 单个 IP
+			if strings.Contains(entry, ":") {
+				rule.Payload += "/128"
+			} else {
+				rule.Payload += "/32"
+			}
+		}
+	case behaviorClassical:
+		var err error
+		if rule, err = parseCondition(entry); err != nil {
+			return rule, err
+		}
+		if col := ruleSetCol(&rule); col > 0 {
+			return rule, &parseError{col: col, msg: "规则集中不能引用其他规则集"}
+		}
+	}
+	if err := p.builder.compile(&rule); err != nil {
+		return rule, err
+	}
+	return rule, nil
+}
+
+// validDomainEntry 判断 domain 规则集中的一项是否只包含域名、后缀和通配符可用的字符，
+// 用于发现下载到的 HTML 错误页等内容
+func validDomainEntry(entry string) bool {
+	for i := 0; i < len(entry); i++ {
+		c := entry[i]
+		switch {
+		case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', c >= '0' && c <= '9':
+		case strings.IndexByte("-._*?+", c) >= 0:
+		default:
+			return false
+		}
+	}
+	return entry != ""
+}
+
+// ruleSetCol 返回规则及其子规则中 RULE-SET 的列号，没有时返回 0
+func ruleSetCol(rule *Rule) int {
+	if rule.Type == RuleSet {
+		return rule.col
+	}
+	for i := range rule.sub {
+		if col := ruleSetCol(&rule.sub[i]); col > 0 {
+			return col
+		}
+	}
+	return 0
+}
+
+// providerEntries 读取规则集文件的内容。支持 Clash 的 YAML 格式 (payload 列表)
+// 和每行一项的文本格式，文本格式中以 # 开头的行为注释。同时返回每项所在的行号
+func providerEntries(data []byte) ([]string, []int) {
+	var doc struct {
+		Payload []yaml.Node `yaml:"payload"`
+	}
+	var entries []string
+	var lines []int
+	if err := yaml.Unmarshal(data, &doc); err == nil && len(doc.Payload) > 0 {
+		for _, node := range doc.Payload {
+			entries = append(entries, strings.TrimSpace(node.Value))
+			lines = append(lines, node.Line)
+		}
+		return entries, lines
+	}
+
+	for i, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		entries = append(entries, line)
+		lines = append(lines, i+1)
+	}
+	return entries, lines
+}
+
+// download 下载远程规则集
+func (p *ruleProvider) download() ([]byte, error) {
+	client := &http.Client{Timeout: providerDownloadTimeout}
+	resp, err := client.Get(p.url)
+	if err != nil {
+		return nil, fmt.Errorf("下载 %s 失败: %w", p.url, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("下载 %s 失败: %s", p.url, resp.Status)
+	}
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("下载 %s 失败: %w", p.url, err)
+	}
+	return data, nil
+}
+
+// update 下载远程规则集，先写入临时文件并编译，成功后才替换缓存文件和当前内容。
+// 下载的内容无效时保留原有的缓存和规则
+func (p *ruleProvider) update() error {
+	data, err := p.download()
+	if err != nil {
+		return fmt.Errorf("规则集 %s: %w", p.name, err)
+	}
+	if err := os.MkdirAll(filepath.Dir(p.path), 0o755); err != nil {
+		return fmt.Errorf("规则集 %s: 创建缓存目录失败: %w", p.name, err)
+	}
+	tmp := p.path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o644); err != nil {
+		return fmt.Errorf("规则集 %s: 写入缓存失败: %w", p.name, err)
+	}
+	set, err := p.build(tmp)
+	if err == nil && len(set.rules) == 0 {
+		err = fmt.Errorf("规则集 %s: 下载的内容中没有规则", p.name)
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	if err := os.Rename(tmp, p.path); err != nil {
+		os.Remove(tmp)
+		return fmt.Errorf("规则集 %s: 写入缓存失败: %w", p.name, err)
+	}
+	if info, err := os.Stat(p.path); err == nil {
+		p.mu.Lock()
+		p.modTime = info.ModTime()
+		p.mu.Unlock()
+	}
+	p.set.Store(set)
+	return nil
+}
+
+// refresh 由 Router.Watch 定期调用: 本地文件变化时重新加载，远程规则集到期或没有缓存时在后台更新
+func (p *ruleProvider) refresh(log *logger.Logger) {
+	info, err := os.Stat(p.path)
+	missing := err != nil && p.url != "" && os.IsNotExist(err)
+	if err != nil && !missing {
+		log.Debugf("检查规则集 %s 失败: %v", p.name, err)
+		return
+	}
+	var changed, expired bool
+	p.mu.Lock()
+	if missing {
+		expired = time.Now().After(p.retryAt)
+	} else {
+		changed = !info.ModTime().Equal(p.modTime)
+		expired = time.Since(info.ModTime()) >= p.interval && time.Now().After(p.retryAt)
+	}
+	p.mu.Unlock()
+
+	if p.url == "" {
+		if changed {
+			p.reload(log)
+		}
+		return
+	}
+
+	if !changed && !expired {
+		return
+	}
+	if !p.updating.CompareAndSwap(false, true) {
+		return
+	}
+	go func() {
+		defer p.updating.Store(false)
+		if !expired {
+			p.reload(log)
+			return
+		}
+		log.Infof("更新规则集 %s: %s", p.name, p.url)
+		if err := p.update(); err != nil {
+			// 下载失败或内容无效时继续使用缓存
+			p.mu.Lock()
+			p.retryAt = time.Now().Add(providerRetryInterval)
+			p.mu.Unlock()
+			log.Warnf("更新规则集失败，继续使用缓存: %v", err)
+			return
+		}
+		log.Infof("规则集 %s 已更新 (%d 条规则)", p.name, len(p.set.Load().rules))
+	}()
+}
+
+func (p *ruleProvider) reload(log *logger.Logger) {
+	if err := p.load(); err != nil {
+		log.Errorf("重新加载规则集失败，继续使用原有规则: %v", err)
+		return
+	}
+	log.Infof("规则集 %s 已重新加载 (%d 条规则)", p.name, len(p.set.Load().rules))
+}
+
+// refreshProviders 检查当前规则文件引用的所有规则集
+func (r *Router) refreshProviders(log *logger.Logger) {
+	set := r.set.Load()
+	names := make([]string, 0, len(set.providers))
+	for name := range set.providers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		set.providers[name].refresh(log)
+	}
+}
@@ -0,0 +1,315 @@
+package router
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/Sesame2/gotun/internal/logger"
+)
+
+func TestRuleProviders(t *testing.T) {
+	path := writeRules(t, `
+rule-providers:
+  ads:
+    type: file
+    behavior: domain
+    path: ads.txt
+  lan:
+    behavior: ipcidr
+    path: lan.yaml
+  corp:
+    behavior: classical
+    path: corp.yaml
+rules:
+  - RULE-SET,ads,REJECT
+  - RULE-SET,lan,DIRECT
+  - RULE-SET,corp,DIRECT
+`)
+	dir := filepath.Dir(path)
+	files := map[string]string{
+		"ads.txt":   "# 广告域名\nads.example.com\n+.tracker.test\n.doubleclick.net\nad-*.cdn.test\n",
+		"lan.yaml":  "payload:\n  - 192.168.0.0/16\n  - 10.1.1.1\n",
+		"corp.yaml": "payload:\n  - DOMAIN-SUFFIX,corp.com\n  - AND,((DOMAIN-KEYWORD,git),(DST-PORT,22))\n",
+	}
+	for name, content := range files {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(content), 0o600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	r, err := NewRouter(path)
+	if err != nil {
+		t.Fatalf("NewRouter 失败: %v", err)
+	}
+	stubResolve(r, nil)
+
+	tests := []struct {
+		host   string
+		action Action
+		index  int
+	}{
+		{host: "ads.example.com", action: ActionReject, index: 1},
+		{host: "ad-eu.cdn.test", action: ActionReject, index: 1},
+		{host: "www.ads.example.com", action: ActionProxy},
+		{host: "tracker.test", action: ActionReject, index: 1},
+		{host: "a.doubleclick.net", action: ActionReject, index: 1},
+		{host: "192.168.1.1", action: ActionDirect, index: 2},
+		{host: "10.1.1.1:80", action: ActionDirect, index: 2},
+		{host: "10.1.1.2", action: ActionProxy},
+		{host: "www.corp.com", action: ActionDirect, index: 3},
+		{host: "github.com:22", action: ActionDirect, index: 3},
+		{host: "github.com:443", action: ActionProxy},
+	}
+	for _, tt := range tests {
+		got := r.Evaluate(tt.host)
+		if got.Action != tt.action || got.Index != tt.index {
+			t.Errorf("Evaluate(%q) = %s #%d (%s), 期望 %s #%d", tt.host, got.Action, got.Index, got.Reason, tt.action, tt.index)
+		}
+	}
+
+	// 规则集文件变化后可以单独重新加载
+	if err := os.WriteFile(filepath.Join(dir, "ads.txt"), []byte("github.com\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.set.Load().providers["ads"].load(); err != nil {
+		t.Fatalf("重新加载规则集失败: %v", err)
+	}
+	if got := r.Evaluate("github.com"); got.Action != ActionReject {
+		t.Errorf("重新加载后 Evaluate(github.com) = %s, 期望 REJECT", got.Action)
+	}
+}
+
+func TestRuleProviderErrors(t *testing.T) {
+	tests := []struct {
+		rules   string
+		payload string
+		want    string
+	}{
+		{
+			rules: "rules:\n  - RULE-SET,ads,REJECT\n",
+			want:  "规则文件第 2 行第 5 列: 规则集 ads 未在 rule-providers 中定义",
+		},
+		{
+			rules: "rule-providers:\n  ads:\n    behavior: foo\n    path: p.txt\n",
+			want:  `规则集 ads: 未知的 behavior "foo"`,
+		},
+		{
+			rules:   "rule-providers:\n  x:\n    behavior: classical\n    path: p.txt\n",
+			payload: "DOMAIN,a.test\nRULE-SET,x\n",
+			want:    "规则集 x 第 2 行第 1 列: 规则集中不能引用其他规则集",
+		},
+		{
+			rules:   "rule-providers:\n  x:\n    behavior: ipcidr\n    path: p.txt\n",
+			payload: "payload:\n  - 10.0.0.0/8\n  - 10.0.0/8\n",
+			want:    "规则集 x 第 3 行第 1 列: 无效的网段 10.0.0/8",
+		},
+	}
+	for _, tt := range tests {
+		path := writeRules(t, tt.rules)
+		if tt.payload != "" {
+			if err := os.WriteFile(filepath.Join(filepath.Dir(path), "p.txt"), []byte(tt.payload), 0o600); err != nil {
+				t.Fatal(err)
+			}
+		}
+		_, err := NewRouter(path)
+		if err == nil || !strings.Contains(err.Error(), tt.want) {
+			t.Errorf("NewRouter 错误 = %v, 期望包含 %q", err, tt.want)
+		}
+	}
+}
+
+func TestHTTPRuleProvider(t *testing.T) {
+	requests := 0
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		requests++
+		w.Write([]byte("payload:\n  - '+.ads.test'\n"))
+	}))
+	defer srv.Close()
+
+	rules := "rule-providers:\n  ads:\n    type: http\n    behavior: domain\n    url: " + srv.URL + "\nrules:\n  - RULE-SET,ads,REJECT\n"
+	path := writeRules(t, rules)
+	r, err := NewRouter(path)
+	if err != nil {
+		t.Fatalf("NewRouter 失败: %v", err)
+	}
+	if got := r.Evaluate("x.ads.test"); got.Action != ActionReject {
+		t.Errorf("Evaluate(x.ads.test) = %s, 期望 REJECT", got.Action)
+	}
+
+	// 已有缓存时直接使用缓存，不再下载
+	cache := filepath.Join(filepath.Dir(path), "providers", "ads.yaml")
+	if _, err := os.Stat(cache); err != nil {
+		t.Fatalf("缓存文件不存在: %v", err)
+	}
+	if err := r.Reload(); err != nil {
+		t.Fatalf("Reload 失败: %v", err)
+	}
+	if requests != 1 {
+		t.Errorf("下载了 %d 次, 期望 1 次", requests)
+	}
+}
+
+// TestHTTPRuleProviderBadUpdate 确认下载到无效内容时保留原有的缓存和规则
+func TestHTTPRuleProviderBadUpdate(t *testing.T) {
+	body := "payload:\n  - '+.ads.test'\n"
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Write([]byte(body))
+	}))
+	defer srv.Close()
+
+	rules := "rule-providers:\n  ads:\n    type: http\n    behavior: domain\n    url: " + srv.URL + "\nrules:\n  - RULE-SET,ads,REJECT\n"
+	path := writeRules(t, rules)
+	r, err := NewRouter(path)
+	if err != nil {
+		t.Fatalf("NewRouter 失败: %v", err)
+	}
+	cache := filepath.Join(filepath.Dir(path), "providers", "ads.yaml")
+	good, err := os.ReadFile(cache)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	p := r.set.Load().providers["ads"]
+	for _, bad := range []string{
+		"<html><body>502 Bad Gateway</body></html>\n",
+		"",
+	} {
+		body = bad
+		if err := p.update(); err == nil {
+			t.Errorf("下载到 %q 时 update 应失败", bad)
+		}
+		if data, _ := os.ReadFile(cache); string(data) != string(good) {
+			t.Errorf("下载到 %q 后缓存被替换为 %q", bad, data)
+		}
+		if _, err := os.Stat(cache + ".tmp"); !os.IsNotExist(err) {
+			t.Errorf("临时文件未删除: %v", err)
+		}
+		if got := r.Evaluate("x.ads.test"); got.Action != ActionReject {
+			t.Errorf("下载到 %q 后 Evaluate(x.ads.test) = %s, 期望 REJECT", bad, got.Action)
+		}
+	}
+
+	// 缓存完好，重新启动时仍能加载
+	if _, err := NewRouter(path); err != nil {
+		t.Fatalf("使用缓存重新加载失败: %v", err)
+	}
+}
+
+// TestProviderGeoIPRefresh 在匹配的同时更新含 GEOIP 规则的规则集，用 -race 运行时检查数据竞争
+func TestProviderGeoIPRefresh(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "country.mmdb"), buildMMDB(t, []mmdbEntry{
+		{cidr: "1.2.0.0/16", field: "country", code: "CN"},
+	}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	list := filepath.Join(dir, "cn.txt")
+	if err := os.WriteFile(list, []byte("DOMAIN,a.test\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(dir, "rules.yaml")
+	rules := "geoip: country.mmdb\nrule-providers:\n  cn:\n    behavior: classical\n    path: cn.txt\nrules:\n  - RULE-SET,cn,DIRECT\n"
+	if err := os.WriteFile(path, []byte(rules), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	r, err := NewRouter(path)
+	if err != nil {
+		t.Fatalf("NewRouter 失败: %v", err)
+	}
+	p := r.set.Load().providers["cn"]
+
+	done := make(chan struct{})
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-done:
+					return
+				default:
+					r.Match("1.2.3.4")
+				}
+			}
+		}()
+	}
+	for i := 0; i < 20; i++ {
+		content := "GEOIP,CN\n"
+		if i%2 == 1 {
+			content = "DOMAIN,a.test\n"
+		}
+		if err := os.WriteFile(list, []byte(content), 0o600); err != nil {
+			t.Fatal(err)
+		}
+		if err := p.load(); err != nil {
+			t.Fatalf("重新加载规则集失败: %v", err)
+		}
+	}
+	close(done)
+	wg.Wait()
+
+	if got := r.Match("1.2.3.4"); got != ActionProxy {
+		t.Errorf("Match(1.2.3.4) = %s, 期望 PROXY", got)
+	}
+	os.WriteFile(list, []byte("GEOIP,CN\n"), 0o600)
+	if err := p.load(); err != nil {
+		t.Fatal(err)
+	}
+	if got := r.Match("1.2.3.4"); got != ActionDirect {
+		t.Errorf("Match(1.2.3.4) = %s, 期望 DIRECT", got)
+	}
+}
+
+// TestHTTPRuleProviderReloadWithoutCache 确认重新加载规则时不等待下载，规则集在后台下载后生效
+func TestHTTPRuleProviderReloadWithoutCache(t *testing.T) {
+	release := make(chan struct{})
+	blocking := atomic.Bool{}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if blocking.Load() {
+			<-release
+		}
+		w.Write([]byte("payload:\n  - '+.ads.test'\n"))
+	}))
+	defer srv.Close()
+	defer close(release)
+
+	rules := "rule-providers:\n  ads:\n    type: http\n    behavior: domain\n    url: " + srv.URL + "\nrules:\n  - RULE-SET,ads,REJECT\n"
+	path := writeRules(t, rules)
+	r, err := NewRouter(path)
+	if err != nil {
+		t.Fatalf("NewRouter 失败: %v", err)
+	}
+
+	// 删除缓存并让服务器不再响应
+	os.Remove(filepath.Join(filepath.Dir(path), "providers", "ads.yaml"))
+	blocking.Store(true)
+	start := time.Now()
+	if err := r.Reload(); err != nil {
+		t.Fatalf("Reload 失败: %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("Reload 用时 %v, 不应等待下载", elapsed)
+	}
+	if got := r.Evaluate("x.ads.test"); got.Action != ActionProxy {
+		t.Errorf("下载完成前 Evaluate(x.ads.test) = %s, 期望 PROXY", got.Action)
+	}
+
+	// 后台下载完成后生效
+	log := logger.NewLogger(false)
+	r.refreshProviders(log)
+	release <- struct{}{}
+	deadline := time.Now().Add(5 * time.Second)
+	for r.Evaluate("x.ads.test").Action != ActionReject {
+		if time.Now().After(deadline) {
+			t.Fatal("后台下载后规则集未生效")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
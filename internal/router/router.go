@@ -4,8 +4,14 @@ import (
 	"fmt"
 	"net"
 	"os"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"strconv"
 	"strings"
+	"sync/atomic"
 
+	"github.com/oschwald/maxminddb-golang"
 	"gopkg.in/yaml.v3"
 )
 
@@ -16,8 +22,15 @@ const (
 	ActionProxy  Action = "PROXY"  // 走代理
 	ActionDirect Action = "DIRECT" // 直连
 	ActionReject Action = "REJECT" // 拒绝
+	// 拒绝且不返回任何响应，直接关闭连接
+	ActionRejectDrop Action = "REJECT-DROP"
 )
 
+// IsReject 判断动作是否为拒绝 (REJECT 或 REJECT-DROP)
+func (a Action) IsReject() bool {
+	return a == ActionReject || a == ActionRejectDrop
+}
+
 // Mode定义全局路由的模式
 type Mode string
 
@@ -31,31 +44,126 @@ const (
 type RuleType string
 
 const (
-	DomainSuffix  RuleType = "DOMAIN-SUFFIX"  // 域名后缀匹配
-	DomainKeyword RuleType = "DOMAIN-KEYWORD" // 域名关键字匹配
-	Domain        RuleType = "DOMAIN"         // 完整域名匹配
-	IPCIDR        RuleType = "IP-CIDR"        // IP段匹配
-	IPCIDR6       RuleType = "IP-CIDR6"       // IPv6
-	Match         RuleType = "MATCH"          // 所有规则都没命中时的匹配
+	DomainSuffix   RuleType = "DOMAIN-SUFFIX"   // 域名后缀匹配
+	DomainKeyword  RuleType = "DOMAIN-KEYWORD"  // 域名关键字匹配
+	Domain         RuleType = "DOMAIN"          // 完整域名匹配
+	DomainRegex    RuleType = "DOMAIN-REGEX"    // 域名匹配正则表达式
+	DomainWildcard RuleType = "DOMAIN-WILDCARD" // 域名匹配通配符，* 匹配任意字符，? 匹配单个字符
+	IPCIDR         RuleType = "IP-CIDR"         // IP段匹配
+	IPCIDR6        RuleType = "IP-CIDR6"        // IPv6
+	GeoIP          RuleType = "GEOIP"           // 按 IP 所属国家匹配，需要 mmdb 数据库
+	GeoSite        RuleType = "GEOSITE"         // 按 geosite.dat 中的域名分类匹配
+	DstPort        RuleType = "DST-PORT"        // 目标端口，支持 8000-9000 形式的范围
+	SrcPort        RuleType = "SRC-PORT"        // 客户端端口
+	SrcIPCIDR      RuleType = "SRC-IP-CIDR"     // 客户端地址所在网段
+	Network        RuleType = "NETWORK"         // tcp 或 udp
+	InName         RuleType = "IN-NAME"         // 入站名称: http、socks5 或 tun
+	ProcessName    RuleType = "PROCESS-NAME"    // 客户端进程名，仅 Linux
+	ProcessPath    RuleType = "PROCESS-PATH"    // 客户端进程的完整路径，仅 Linux
+	RuleSet        RuleType = "RULE-SET"        // 引用 rule-providers 中定义的规则集
+	And            RuleType = "AND"             // 所有子规则都命中
+	Or             RuleType = "OR"              // 任一子规则命中
+	Not            RuleType = "NOT"             // 子规则不命中
+	Match          RuleType = "MATCH"           // 所有规则都没命中时的匹配
 )
 
+// valid 判断是否为支持的规则类型
+func (t RuleType) valid() bool {
+	switch t {
+	case DomainSuffix, DomainKeyword, Domain, DomainRegex, DomainWildcard, IPCIDR, IPCIDR6, GeoIP, GeoSite,
+		DstPort, SrcPort, SrcIPCIDR, Network, InName, ProcessName, ProcessPath, RuleSet, And, Or, Not, Match:
+		return true
+	}
+	return false
+}
+
+// logical 判断是否为 AND / OR / NOT 逻辑规则
+func (t RuleType) logical() bool {
+	return t == And || t == Or || t == Not
+}
+
 // Rule 代表一条路由规则
 type Rule struct {
+	Index   int // 在规则列表中的序号，从 1 开始
+	Line    int // 在规则文件中的行号
 	Type    RuleType
 	Payload string // ip或者域名（具体的待匹配值）
 	Target  Action // 动作
+	// 动作为命名出站或出站组时的名称，此时 Target 为 PROXY
+	Outbound string
+	// 目标为域名时不解析 IP，跳过 GEOIP 规则
+	NoResolve bool
+
+	cidr     *net.IPNet        // IP-CIDR / SRC-IP-CIDR 规则预先解析的网段
+	regex    *regexp.Regexp    // DOMAIN-REGEX / DOMAIN-WILDCARD 规则预先编译的表达式
+	ports    portRange         // DST-PORT / SRC-PORT 规则的端口范围
+	site     *geoSite          // GEOSITE 规则的域名列表
+	geoip    *maxminddb.Reader // GEOIP 规则使用的数据库，GEOIP,LAN 时为 nil
+	provider *ruleProvider     // RULE-SET 规则引用的规则集
+	sub      []Rule            // 逻辑规则的子规则，子规则没有 Target
+	col      int               // 在规则中的列号，用于错误信息
+}
+
+// String 返回规则在规则文件中的写法
+func (r Rule) String() string {
+	target := string(r.Target)
+	if r.Outbound != "" {
+		target = r.Outbound
+	}
+	if r.Type == Match {
+		return fmt.Sprintf("%s,%s", r.Type, target)
+	}
+	if r.NoResolve {
+		return fmt.Sprintf("%s,%s,%s,no-resolve", r.Type, r.Payload, target)
+	}
+	return fmt.Sprintf("%s,%s,%s", r.Type, r.Payload, target)
+}
+
+// condition 返回不含动作的规则条件，如 "DOMAIN-SUFFIX,corp.com"
+func (r *Rule) condition() string {
+	return fmt.Sprintf("%s,%s", r.Type, r.Payload)
 }
 
-// Router 路由的核心结构体
+// Router 路由的核心结构体。规则集可以在运行中通过 Reload 原子地替换
 type Router struct {
+	path string
+	set  atomic.Pointer[ruleSet]
+	dial atomic.Pointer[DialFunc] // dns.resolver 为 remote 时用于连接 DNS 服务器
+
+	// resolver 为 IP 类规则解析域名。dns 配置不变时重新加载规则继续使用原有的解析器，
+	// 已缓存的解析结果不会因规则变化而失效
+	resolver atomic.Pointer[resolver]
+}
+
+// ruleSet 是从规则文件中加载的一份完整配置
+type ruleSet struct {
 	mode  Mode
 	rules []Rule
+	index *ruleIndex // 为 nil 时按顺序检查所有规则
+
+	providers map[string]*ruleProvider // 按名称索引的规则集
+	outbounds map[string]*Outbound     // 按名称索引的命名出站和出站组
+	dns       dnsConfig                // 已校验的 dns 配置，解析器由 Router 创建
 }
 
-// routerConfig 用于解析路由yaml文件
+// routerConfig 用于解析路由yaml文件，保留节点以便在错误中给出行号
 type routerConfig struct {
-	Mode  Mode     `yaml:"mode"`
-	Rules []string `yaml:"rules"`
+	Mode  yaml.Node   `yaml:"mode"`
+	Rules []yaml.Node `yaml:"rules"`
+
+	// GEOIP / GEOSITE 使用的数据库路径，相对路径相对于规则文件所在目录
+	GeoIP   string `yaml:"geoip"`
+	GeoSite string `yaml:"geosite"`
+
+	// 外部规则集，规则中通过 RULE-SET,名称,动作 引用
+	RuleProviders map[string]providerConfig `yaml:"rule-providers"`
+
+	// 命名出站和出站组，规则的动作可以是它们的名称
+	Outbounds map[string]outboundConfig `yaml:"outbounds"`
+	Groups    map[string]groupConfig    `yaml:"proxy-groups"`
+
+	// IP 类规则解析域名时使用的解析器
+	DNS dnsConfig `yaml:"dns"`
 }
 
 // 从指定YAML文件路径中创建并初始化一个新的Router
@@ -64,6 +172,49 @@ func NewRouter(path string) (*Router, error) {
 		return nil, fmt.Errorf("规则不能路径为空")
 	}
 
+	set, err := loadRuleSet(path, true)
+	if err != nil {
+		return nil, err
+	}
+	router := &Router{path: path}
+	router.store(set)
+	return router, nil
+}
+
+// Reload 重新读取规则文件，解析成功后原子地替换当前规则，失败时保留原有规则
+func (r *Router) Reload() error {
+	set, err := loadRuleSet(r.path, false)
+	if err != nil {
+		return err
+	}
+	r.store(set)
+	return nil
+}
+
+// store 发布新的规则集，dns 配置变化时 (或第一次加载时) 重新创建解析器
+func (r *Router) store(set *ruleSet) {
+	if old := r.set.Load(); old == nil || !reflect.DeepEqual(old.dns, set.dns) {
+		res, _ := newResolver(set.dns) // 已在 loadRuleSet 中校验
+		res.dial = &r.dial
+		r.resolver.Store(res)
+	}
+	r.set.Store(set)
+}
+
+// SetRemoteDialer 设置 dns.resolver 为 remote 时连接 DNS 服务器的方式，通常为 SSH 客户端的 Dial。
+// 没有设置时在本机解析
+func (r *Router) SetRemoteDialer(dial DialFunc) {
+	r.dial.Store(&dial)
+}
+
+// Len 返回当前规则的条数
+func (r *Router) Len() int {
+	return len(r.set.Load().rules)
+}
+
+// loadRuleSet 读取并校验规则文件，错误信息中包含出错的行号。
+// fetch 为 false 时不下载没有缓存的远程规则集 (见 loadProviders)
+func loadRuleSet(path string, fetch bool) (*ruleSet, error) {
 	data, err := os.ReadFile(path)
 	if err != nil {
 		return nil, fmt.Errorf("读取规则文件失败: %w", err)
@@ -75,100 +226,432 @@ func NewRouter(path string) (*Router, error) {
 	}
 
 	// 默认模式为 rule
-	if cfg.Mode == "" {
-		cfg.Mode = ModeRule
-	}
-
-	router := &Router{
-		mode:  cfg.Mode,
+	set := &ruleSet{
+		mode:  ModeRule,
 		rules: make([]Rule, 0, len(cfg.Rules)),
 	}
-
-	for i, line := range cfg.Rules {
-		parts := strings.Split(line, ",")
-		if len(parts) < 2 {
-			continue
+	if cfg.Mode.Value != "" {
+		set.mode = Mode(strings.ToLower(cfg.Mode.Value))
+		switch set.mode {
+		case ModeRule, ModeGlobal, ModeDirect:
+		default:
+			return nil, fmt.Errorf("规则文件第 %d 行: 未知的模式 %s", cfg.Mode.Line, cfg.Mode.Value)
 		}
+	}
 
-		// 处理RuleType未匹配的情况
-		ruleType := RuleType(strings.ToUpper(parts[0]))
-		switch ruleType {
-		case DomainSuffix, DomainKeyword, Domain, IPCIDR, IPCIDR6, Match:
-			// 合法的 RuleType
-		default:
-			return nil, fmt.Errorf("规则文件第 %d 行存在未知的规则类型: %s", i+1, parts[0])
-		}
-
-		var target Action
-		if len(parts) > 2 {
-			// 如果是预期之外的类型统一视为 PROXY
-			switch strings.ToUpper(parts[2]) {
-			case "DIRECT":
-				target = ActionDirect
-			case "REJECT":
-				target = ActionReject
-			default:
-				target = ActionProxy
-			}
-		} else {
-			// 如果只有两部分，默认使用 PROXY
-			target = ActionProxy
+	if _, err := newResolver(cfg.DNS); err != nil {
+		return nil, err
+	}
+	set.dns = cfg.DNS
+	if set.outbounds, err = loadOutbounds(&cfg); err != nil {
+		return nil, err
+	}
+	b := &ruleBuilder{path: path, cfg: &cfg, set: set, fetch: fetch}
+	if set.providers, err = b.loadProviders(); err != nil {
+		return nil, err
+	}
+	for i, node := range cfg.Rules {
+		if node.Kind != yaml.ScalarNode {
+			return nil, fmt.Errorf("规则文件第 %d 行: 规则应为字符串", node.Line)
+		}
+		rule, err := parseRule(node.Value)
+		if err == nil {
+			err = b.compile(&rule)
 		}
-		rule := Rule{
-			Type:    ruleType,
-			Payload: parts[1],
-			Target:  target,
+		if err != nil {
+			return nil, ruleLineError(&node, err)
 		}
-		router.rules = append(router.rules, rule)
+		rule.Index = i + 1
+		rule.Line = node.Line
+		set.rules = append(set.rules, rule)
 	}
-	return router, nil
+	set.index = buildIndex(set.rules)
+	return set, nil
+}
+
+// ruleLineError 为规则错误加上在规则文件中的行号和列号
+func ruleLineError(node *yaml.Node, err error) error {
+	pe, ok := err.(*parseError)
+	if !ok {
+		return fmt.Errorf("规则文件第 %d 行: %w", node.Line, err)
+	}
+	col := node.Column + pe.col - 1
+	if node.Style&(yaml.DoubleQuotedStyle|yaml.SingleQuotedStyle) != 0 {
+		col++ // 跳过引号
+	}
+	return fmt.Errorf("规则文件第 %d 行第 %d 列: %s", node.Line, col, pe.msg)
+}
+
+// relativeTo 将相对路径解释为相对于规则文件所在目录
+func relativeTo(rulesPath, path string) string {
+	if filepath.IsAbs(path) {
+		return path
+	}
+	return filepath.Join(filepath.Dir(rulesPath), path)
+}
+
+// MatchResult 描述一次匹配的结果: 最终动作、命中的规则以及命中的原因
+type MatchResult struct {
+	Action   Action
+	Outbound string // 命中规则指定的命名出站，为空时按 Action 处理
+	Index    int    // 命中规则的序号 (从 1 开始)，0 表示没有规则命中
+	Type     RuleType
+	Payload  string
+	Reason   string
+}
+
+// Matched 判断是否有规则命中
+func (m MatchResult) Matched() bool {
+	return m.Index > 0
+}
+
+// Target 返回连接的去向: 命名出站的名称或动作
+func (m MatchResult) Target() string {
+	if m.Outbound != "" {
+		return m.Outbound
+	}
+	return string(m.Action)
+}
+
+// String 返回用于日志的简短描述，如 "#3 DOMAIN-SUFFIX,google.com"
+func (m MatchResult) String() string {
+	if !m.Matched() {
+		return m.Reason
+	}
+	if m.Type == Match {
+		return fmt.Sprintf("#%d %s", m.Index, m.Type)
+	}
+	return fmt.Sprintf("#%d %s,%s", m.Index, m.Type, m.Payload)
+}
+
+func (r *Rule) result(reason string) MatchResult {
+	return MatchResult{
+		Action:   r.Target,
+		Outbound: r.Outbound,
+		Index:    r.Index,
+		Type:     r.Type,
+		Payload:  r.Payload,
+		Reason:   reason,
+	}
+}
+
+// describeIP 返回 "域名 (IP)" 或 "IP" 形式的描述
+func describeIP(hostname string, ip net.IP) string {
+	if hostname == ip.String() {
+		return hostname
+	}
+	return fmt.Sprintf("%s (%s)", hostname, ip)
+}
+
+// Request 描述一个待路由的连接。只有目标主机是必需的，其余字段为空时相应的规则不会命中
+type Request struct {
+	Host    string // 目标域名或 IP，可以带端口
+	Port    int    // 目标端口，为 0 时从 Host 中获取
+	Source  string // 客户端地址 (ip:port)
+	Network string // "tcp" 或 "udp"，为空时视为 tcp
+	Inbound string // 入站名称: http、socks5 或 tun
+	Process string // 客户端进程的可执行文件路径，为空时按 Source 在本机查找 (仅 Linux)
 }
 
 // 根据主机名决定流量的走向
 func (r *Router) Match(host string) Action {
+	return r.Evaluate(host).Action
+}
+
+// Evaluate 与 Match 相同，但返回完整的匹配结果，用于日志和规则调试
+func (r *Router) Evaluate(host string) MatchResult {
+	return r.EvaluateRequest(Request{Host: host})
+}
+
+// EvaluateRequest 按完整的连接信息匹配规则，可以使用端口、来源地址等规则
+func (r *Router) EvaluateRequest(req Request) MatchResult {
+	set := r.set.Load()
+
 	// 1.处理全局模式
-	switch r.mode {
+	switch set.mode {
 	case ModeGlobal:
-		return ActionProxy
+		return MatchResult{Action: ActionProxy, Reason: "全局代理模式 (mode: global)"}
 	case ModeDirect:
-		return ActionDirect
+		return MatchResult{Action: ActionDirect, Reason: "全局直连模式 (mode: direct)"}
 	}
 
 	// 2.处理规则模式
-	hostname := host
-	if h, _, err := net.SplitHostPort(host); err == nil {
+	if rule, reason := set.first(newMatchContext(r.resolver.Load(), req)); rule != nil {
+		return rule.result(reason)
+	}
+
+	// 如果所有规则都未匹配，默认走代理
+	return MatchResult{Action: ActionProxy, Reason: "没有规则命中，默认走代理"}
+}
+
+// first 返回第一条命中的规则及原因。先从索引中找到命中的位置，
+// 再按顺序检查排在它之前的未索引规则。目标为域名时，
+// 只有检查到第一条需要解析的 IP 规则仍未命中时才解析域名
+func (s *ruleSet) first(c *matchContext) (*Rule, string) {
+	if s.index == nil {
+		for i := range s.rules {
+			if reason, ok := s.rules[i].match(c); ok {
+				return &s.rules[i], reason
+			}
+		}
+		return nil, ""
+	}
+
+	limit := s.index.first(c)
+	linear := s.index.linear
+	if c.ip == nil && s.index.firstResolve < limit {
+		var rule *Rule
+		var reason string
+		if rule, reason, linear = s.scan(c, linear, s.index.firstResolve); rule != nil {
+			return rule, reason
+		}
+		limit = min(limit, s.index.resolved(c.resolve()))
+	}
+	if rule, reason, _ := s.scan(c, linear, limit); rule != nil {
+		return rule, reason
+	}
+	if limit == noRule {
+		return nil, ""
+	}
+	rule := &s.rules[limit]
+	reason, _ := rule.match(c)
+	return rule, reason
+}
+
+// scan 按顺序检查 linear 中排在 limit 之前的规则，返回命中的规则和尚未检查的部分
+func (s *ruleSet) scan(c *matchContext, linear []int, limit int) (*Rule, string, []int) {
+	for i, pos := range linear {
+		if pos > limit {
+			return nil, "", linear[i:]
+		}
+		if reason, ok := s.rules[pos].match(c); ok {
+			return &s.rules[pos], reason, nil
+		}
+	}
+	return nil, "", nil
+}
+
+// matchContext 保存一次匹配中从请求解析出的信息
+type matchContext struct {
+	resolver *resolver
+	hostname string
+	ip       net.IP // 目标为 IP 时有效
+	port     int
+	srcIP    net.IP
+	srcPort  int
+	network  string
+	inbound  string
+
+	// 目标为域名时，只在第一次遇到需要解析的 IP 类规则时解析
+	resolved    []net.IP
+	resolveDone bool
+
+	// 客户端进程，只在第一次遇到进程规则时查找
+	process     string
+	processDone bool
+}
+
+func newMatchContext(res *resolver, req Request) *matchContext {
+	c := &matchContext{
+		resolver: res,
+		hostname: req.Host,
+		port:     req.Port,
+		network:  strings.ToLower(req.Network),
+		inbound:  strings.ToLower(req.Inbound),
+		process:  req.Process,
+	}
+	if h, p, err := net.SplitHostPort(req.Host); err == nil {
 		// 如果有端口就去掉端口
-		hostname = h
-	}
-
-	// IP形式的规则
-	ip := net.ParseIP(hostname)
-	for _, rule := range r.rules {
-		match := false
-		switch rule.Type {
-		case DomainSuffix:
-			match = strings.HasSuffix(hostname, rule.Payload)
-		case DomainKeyword:
-			match = strings.Contains(hostname, rule.Payload)
-		case Domain:
-			match = hostname == rule.Payload
-		case IPCIDR, IPCIDR6:
-			if ip != nil {
-				_, cidr, err := net.ParseCIDR(rule.Payload)
-				if err == nil && cidr.Contains(ip) {
-					match = true
+		c.hostname = h
+		if c.port == 0 {
+			c.port, _ = strconv.Atoi(p)
+		}
+	}
+	// 规则中的域名在加载时已转为小写
+	c.hostname = strings.ToLower(c.hostname)
+	c.ip = net.ParseIP(c.hostname)
+	if c.network == "" {
+		c.network = "tcp"
+	}
+	if h, p, err := net.SplitHostPort(req.Source); err == nil {
+		c.srcIP = net.ParseIP(h)
+		c.srcPort, _ = strconv.Atoi(p)
+	}
+	return c
+}
+
+// ipsOf 返回用于 IP 类规则的目标地址
+func (c *matchContext) ipsOf(rule *Rule) []net.IP {
+	if c.ip != nil {
+		return []net.IP{c.ip}
+	}
+	if rule.NoResolve {
+		return nil
+	}
+	return c.resolve()
+}
+
+// resolve 解析目标域名，结果在本次匹配中复用
+func (c *matchContext) resolve() []net.IP {
+	if !c.resolveDone {
+		if c.hostname != "" {
+			c.resolved = c.resolver.lookup(c.hostname)
+		}
+		c.resolveDone = true
+	}
+	return c.resolved
+}
+
+// lookupProcess 按客户端地址查找进程，测试中替换以统计查找次数
+var lookupProcess = findProcess
+
+// processPath 返回发起连接的客户端进程的路径，找不到时返回空字符串。
+// 只有检查到进程规则时才查找，结果由本次匹配中的所有规则 (包括规则集中的) 共用
+func (c *matchContext) processPath() string {
+	if !c.processDone {
+		if c.process == "" && c.srcIP != nil {
+			c.process, _ = lookupProcess(c.network, c.srcIP, c.srcPort)
+		}
+		c.processDone = true
+	}
+	return c.process
+}
+
+// match 判断规则是否命中，命中时返回原因
+func (r *Rule) match(c *matchContext) (string, bool) {
+	hostname := c.hostname
+	switch r.Type {
+	case DomainSuffix:
+		// 按标签匹配: google.com 匹配 google.com 和 www.google.com，不匹配 notgoogle.com
+		if hostname == r.Payload || strings.HasSuffix(hostname, "."+r.Payload) {
+			return fmt.Sprintf("%s 以 %s 结尾", hostname, r.Payload), true
+		}
+	case DomainKeyword:
+		if strings.Contains(hostname, r.Payload) {
+			return fmt.Sprintf("%s 包含关键字 %s", hostname, r.Payload), true
+		}
+	case Domain:
+		if hostname == r.Payload {
+			return fmt.Sprintf("%s 与域名完全相同", hostname), true
+		}
+	case DomainRegex:
+		if r.regex.MatchString(hostname) {
+			return fmt.Sprintf("%s 匹配正则表达式 %s", hostname, r.Payload), true
+		}
+	case DomainWildcard:
+		if r.regex.MatchString(hostname) {
+			return fmt.Sprintf("%s 匹配通配符 %s", hostname, r.Payload), true
+		}
+	case IPCIDR, IPCIDR6:
+		for _, addr := range c.ipsOf(r) {
+			if r.cidr.Contains(addr) {
+				return fmt.Sprintf("%s 属于网段 %s", describeIP(hostname, addr), r.Payload), true
+			}
+		}
+	case GeoIP:
+		for _, addr := range c.ipsOf(r) {
+			if r.Payload == "LAN" {
+				if isLAN(addr) {
+					return fmt.Sprintf("%s 是局域网地址", describeIP(hostname, addr)), true
 				}
+			} else if countryOf(r.geoip, addr) == r.Payload {
+				return fmt.Sprintf("%s 属于 %s", describeIP(hostname, addr), r.Payload), true
 			}
-		case Match:
-			// 最终匹配规则
-			match = true
 		}
-
-		if match {
-			return rule.Target
+	case GeoSite:
+		if c.ip == nil {
+			if entry, ok := r.site.match(hostname); ok {
+				return fmt.Sprintf("%s 属于 GeoSite 分类 %s (%s)", hostname, r.Payload, entry), true
+			}
+		}
+	case DstPort:
+		if r.ports.contains(c.port) {
+			return "目标端口" + r.ports.describe(c.port), true
+		}
+	case SrcPort:
+		if r.ports.contains(c.srcPort) {
+			return "来源端口" + r.ports.describe(c.srcPort), true
+		}
+	case SrcIPCIDR:
+		if c.srcIP != nil && r.cidr.Contains(c.srcIP) {
+			return fmt.Sprintf("来源地址 %s 属于网段 %s", c.srcIP, r.Payload), true
+		}
+	case ProcessName:
+		if path := c.processPath(); path != "" && filepath.Base(path) == r.Payload {
+			return fmt.Sprintf("客户端进程为 %s", path), true
+		}
+	case ProcessPath:
+		if c.processPath() == r.Payload {
+			return fmt.Sprintf("客户端进程为 %s", r.Payload), true
 		}
+	case Network:
+		if c.network == r.Payload {
+			return fmt.Sprintf("网络类型为 %s", c.network), true
+		}
+	case InName:
+		if c.inbound == r.Payload {
+			return fmt.Sprintf("来自 %s 入站", c.inbound), true
+		}
+	case And:
+		reasons := make([]string, 0, len(r.sub))
+		for i := range r.sub {
+			reason, ok := r.sub[i].match(c)
+			if !ok {
+				return "", false
+			}
+			reasons = append(reasons, reason)
+		}
+		return strings.Join(reasons, "，且"), true
+	case Or:
+		for i := range r.sub {
+			if reason, ok := r.sub[i].match(c); ok {
+				return reason, true
+			}
+		}
+	case RuleSet:
+		if rule, reason := r.provider.set.Load().first(c); rule != nil {
+			return fmt.Sprintf("规则集 %s 中的 %s: %s", r.Payload, rule.condition(), reason), true
+		}
+	case Not:
+		if _, ok := r.sub[0].match(c); !ok {
+			return fmt.Sprintf("不满足 %s", r.sub[0].condition()), true
+		}
+	case Match:
+		// 最终匹配规则
+		return "兜底规则，匹配所有请求", true
 	}
+	return "", false
+}
 
-	// 如果所有规则都未匹配，默认走代理
-	return ActionProxy
+// portRange 是端口规则的取值范围，单个端口时 lo == hi
+type portRange struct {
+	lo, hi int
+}
+
+func (p portRange) contains(port int) bool {
+	return port > 0 && port >= p.lo && port <= p.hi
+}
+
+func (p portRange) describe(port int) string {
+	if p.lo == p.hi {
+		return fmt.Sprintf("为 %d", port)
+	}
+	return fmt.Sprintf(" %d 在 %d-%d 范围内", port, p.lo, p.hi)
+}
+
+// parsePortRange 解析 "22" 或 "8000-9000" 形式的端口
+func parsePortRange(s string) (portRange, error) {
+	lo, hi, isRange := strings.Cut(s, "-")
+	var p portRange
+	var err error
+	if p.lo, err = strconv.Atoi(lo); err != nil || p.lo <= 0 || p.lo > 65535 {
+		return p, fmt.Errorf("无效的端口 %s", s)
+	}
+	p.hi = p.lo
+	if isRange {
+		if p.hi, err = strconv.Atoi(hi); err != nil || p.hi < p.lo || p.hi > 65535 {
+			return p, fmt.Errorf("无效的端口范围 %s", s)
+		}
+	}
+	return p, nil
 }
@@ -0,0 +1,281 @@
+package router
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// writeRules 将规则写入临时文件并返回路径
+func writeRules(t testing.TB, content string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "rules.yaml")
+	if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+// newTestRouter 将规则写入临时文件并加载。测试中不访问真实的 DNS，所有域名都解析失败
+func newTestRouter(t *testing.T, content string) *Router {
+	t.Helper()
+	r, err := NewRouter(writeRules(t, content))
+	if err != nil {
+		t.Fatalf("NewRouter 失败: %v", err)
+	}
+	stubResolve(r, nil)
+	return r
+}
+
+// stubResolve 让规则按 hosts 解析域名，返回实际查询的次数
+func stubResolve(r *Router, hosts map[string]string) *int {
+	calls := new(int)
+	r.resolver.Load().resolve = func(host string) ([]net.IP, time.Duration, error) {
+		*calls++
+		if ip := net.ParseIP(hosts[host]); ip != nil {
+			return []net.IP{ip}, time.Minute, nil
+		}
+		return nil, 0, fmt.Errorf("%s 没有解析结果", host)
+	}
+	return calls
+}
+
+func TestEvaluate(t *testing.T) {
+	r := newTestRouter(t, `
+rules:
+  - DOMAIN,ads.example.com,REJECT
+  - DOMAIN-SUFFIX,example.com,DIRECT
+  - DOMAIN-KEYWORD,google,PROXY
+  - IP-CIDR,10.0.0.0/8,DIRECT
+`)
+
+	tests := []struct {
+		host   string
+		action Action
+		index  int
+		rule   string
+	}{
+		{host: "ads.example.com", action: ActionReject, index: 1, rule: "#1 DOMAIN,ads.example.com"},
+		{host: "www.example.com:443", action: ActionDirect, index: 2, rule: "#2 DOMAIN-SUFFIX,example.com"},
+		{host: "ADS.Example.com:443", action: ActionReject, index: 1, rule: "#1 DOMAIN,ads.example.com"},
+		{host: "www.Example.COM:443", action: ActionDirect, index: 2, rule: "#2 DOMAIN-SUFFIX,example.com"},
+		{host: "WWW.Google.com:443", action: ActionProxy, index: 3, rule: "#3 DOMAIN-KEYWORD,google"},
+		{host: "www.google.com", action: ActionProxy, index: 3, rule: "#3 DOMAIN-KEYWORD,google"},
+		{host: "10.1.2.3:22", action: ActionDirect, index: 4, rule: "#4 IP-CIDR,10.0.0.0/8"},
+		{host: "github.com", action: ActionProxy, index: 0},
+	}
+	for _, tt := range tests {
+		got := r.Evaluate(tt.host)
+		if got.Action != tt.action || got.Index != tt.index {
+			t.Errorf("Evaluate(%q) = %s #%d, 期望 %s #%d", tt.host, got.Action, got.Index, tt.action, tt.index)
+		}
+		if tt.rule != "" && got.String() != tt.rule {
+			t.Errorf("Evaluate(%q).String() = %q, 期望 %q", tt.host, got.String(), tt.rule)
+		}
+		if got.Reason == "" {
+			t.Errorf("Evaluate(%q) 缺少命中原因", tt.host)
+		}
+	}
+}
+
+func TestEvaluateMode(t *testing.T) {
+	r := newTestRouter(t, "mode: direct\nrules:\n  - MATCH,PROXY\n")
+	if got := r.Evaluate("example.com"); got.Action != ActionDirect || got.Matched() {
+		t.Errorf("direct 模式下 Evaluate = %+v", got)
+	}
+}
+
+func TestReload(t *testing.T) {
+	r := newTestRouter(t, "rules:\n  - DOMAIN,a.test,REJECT\n")
+
+	write := func(content string) {
+		if err := os.WriteFile(r.path, []byte(content), 0o600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// 并发匹配期间替换规则
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 1000; i++ {
+			r.Match("a.test")
+		}
+	}()
+	write("rules:\n  - DOMAIN,a.test,DIRECT\n")
+	if err := r.Reload(); err != nil {
+		t.Fatalf("Reload 失败: %v", err)
+	}
+	<-done
+	if got := r.Match("a.test"); got != ActionDirect {
+		t.Fatalf("重新加载后 Match = %s, 期望 DIRECT", got)
+	}
+
+	// 新规则无效时保留原有规则，错误中给出行号
+	write("mode: rule\nrules:\n  - DOMAIN,a.test,PROXY\n  - IP-CIDR,10.0.0/8,DIRECT\n")
+	err := r.Reload()
+	if err == nil || !strings.Contains(err.Error(), "第 4 行") {
+		t.Fatalf("Reload 应返回第 4 行的错误, 得到 %v", err)
+	}
+	if got := r.Match("a.test"); got != ActionDirect {
+		t.Errorf("加载失败后 Match = %s, 应保留原有规则", got)
+	}
+}
+
+func TestGeoSite(t *testing.T) {
+	// 构造只包含 cn 分类的 geosite.dat: baidu.com (后缀)、qq.example (完整域名)、taobao (关键字)
+	field := func(num int, data []byte) []byte {
+		return append([]byte{byte(num<<3 | 2), byte(len(data))}, data...)
+	}
+	domain := func(typ byte, value string) []byte {
+		return field(2, append([]byte{1 << 3, typ}, field(2, []byte(value))...))
+	}
+	site := field(1, []byte("CN"))
+	site = append(site, domain(2, "baidu.com")...)
+	site = append(site, domain(3, "qq.example")...)
+	site = append(site, domain(0, "taobao")...)
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "geosite.dat"), field(1, site), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(dir, "rules.yaml")
+	rules := "geosite: geosite.dat\nrules:\n  - GEOSITE,cn,DIRECT\n  - GEOIP,LAN,REJECT,no-resolve\n"
+	if err := os.WriteFile(path, []byte(rules), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	r, err := NewRouter(path)
+	if err != nil {
+		t.Fatalf("NewRouter 失败: %v", err)
+	}
+
+	tests := []struct {
+		host   string
+		action Action
+	}{
+		{host: "www.baidu.com", action: ActionDirect},
+		{host: "notbaidu.com", action: ActionProxy},
+		{host: "qq.example", action: ActionDirect},
+		{host: "www.qq.example", action: ActionProxy},
+		{host: "img.taobao.net", action: ActionDirect},
+		{host: "10.0.0.1", action: ActionReject},
+		{host: "localhost", action: ActionProxy}, // no-resolve: 不解析域名
+	}
+	for _, tt := range tests {
+		if got := r.Match(tt.host); got != tt.action {
+			t.Errorf("Match(%q) = %s, 期望 %s", tt.host, got, tt.action)
+		}
+	}
+}
+
+func TestEvaluateRequest(t *testing.T) {
+	r := newTestRouter(t, `
+rules:
+  - DST-PORT,22,DIRECT
+  - SRC-IP-CIDR,172.17.0.0/16,PROXY
+  - SRC-PORT,50000-60000,REJECT
+  - NETWORK,udp,REJECT-DROP
+  - IN-NAME,socks5,DIRECT
+  - MATCH,PROXY
+`)
+
+	tests := []struct {
+		req   Request
+		index int
+	}{
+		{req: Request{Host: "example.com:22"}, index: 1},
+		{req: Request{Host: "example.com", Port: 22}, index: 1},
+		{req: Request{Host: "example.com:443", Source: "172.17.0.2:55000"}, index: 2},
+		{req: Request{Host: "example.com:443", Source: "10.0.0.2:55000"}, index: 3},
+		{req: Request{Host: "8.8.8.8:53", Network: "udp"}, index: 4},
+		{req: Request{Host: "example.com:443", Inbound: "socks5"}, index: 5},
+		{req: Request{Host: "example.com"}, index: 6}, // 只有主机名时端口和来源规则都不命中
+	}
+	for _, tt := range tests {
+		if got := r.EvaluateRequest(tt.req); got.Index != tt.index {
+			t.Errorf("EvaluateRequest(%+v) 命中 #%d, 期望 #%d (%s)", tt.req, got.Index, tt.index, got.Reason)
+		}
+	}
+}
+
+// TestProcessLookupOnce 确认每次匹配最多查找一次客户端进程，没有检查到进程规则时不查找
+func TestProcessLookupOnce(t *testing.T) {
+	calls := 0
+	orig := lookupProcess
+	lookupProcess = func(network string, ip net.IP, port int) (string, error) {
+		calls++
+		return "/usr/bin/curl", nil
+	}
+	defer func() { lookupProcess = orig }()
+
+	r := newTestRouter(t, `
+rules:
+  - DOMAIN,direct.test,DIRECT
+  - PROCESS-NAME,git,DIRECT
+  - AND,((PROCESS-PATH,/usr/bin/wget),(DST-PORT,443)),REJECT
+  - NOT,((PROCESS-NAME,curl)),REJECT
+  - PROCESS-PATH,/usr/bin/curl,PROXY
+`)
+	req := Request{Host: "a.test:443", Source: "127.0.0.1:40000"}
+	if got := r.EvaluateRequest(req); got.Index != 5 {
+		t.Fatalf("命中 #%d, 期望 #5 (%s)", got.Index, got.Reason)
+	}
+	if calls != 1 {
+		t.Errorf("一次匹配查找了 %d 次进程, 期望 1 次", calls)
+	}
+
+	calls = 0
+	r.EvaluateRequest(Request{Host: "direct.test:443", Source: "127.0.0.1:40000"})
+	if calls != 0 {
+		t.Errorf("在进程规则之前命中时查找了 %d 次进程", calls)
+	}
+
+	plain := newTestRouter(t, "rules:\n  - DOMAIN-SUFFIX,corp.test,DIRECT\n  - DST-PORT,22,DIRECT\n")
+	plain.EvaluateRequest(Request{Host: "a.test:443", Source: "127.0.0.1:40000"})
+	if calls != 0 {
+		t.Errorf("没有进程规则时查找了 %d 次进程", calls)
+	}
+}
+
+func TestDomainPatterns(t *testing.T) {
+	r := newTestRouter(t, `
+rules:
+  - DOMAIN-REGEX,^ad[0-9]+\.,REJECT
+  - DOMAIN-WILDCARD,*.cdn-??.example.com,DIRECT
+  - PROCESS-NAME,git,DIRECT
+  - AND,((PROCESS-PATH,/usr/bin/curl),(DST-PORT,443)),PROXY
+  - MATCH,REJECT
+`)
+
+	tests := []struct {
+		req    Request
+		index  int
+		reason string
+	}{
+		{req: Request{Host: "ad12.tracker.test"}, index: 1, reason: "ad12.tracker.test 匹配正则表达式 ^ad[0-9]+\\."},
+		{req: Request{Host: "bad12.tracker.test"}, index: 5},
+		{req: Request{Host: "img.cdn-eu.example.com"}, index: 2, reason: "img.cdn-eu.example.com 匹配通配符 *.cdn-??.example.com"},
+		{req: Request{Host: "a.b.CDN-US.example.com"}, index: 2},
+		{req: Request{Host: "cdn-us.example.com"}, index: 5},
+		{req: Request{Host: "github.com:22", Process: "/usr/bin/git"}, index: 3, reason: "客户端进程为 /usr/bin/git"},
+		{req: Request{Host: "example.com:443", Process: "/usr/bin/curl"}, index: 4},
+		{req: Request{Host: "example.com:443", Process: "/usr/local/bin/curl"}, index: 5},
+	}
+	for _, tt := range tests {
+		got := r.EvaluateRequest(tt.req)
+		if got.Index != tt.index {
+			t.Errorf("EvaluateRequest(%+v) 命中 #%d, 期望 #%d (%s)", tt.req, got.Index, tt.index, got.Reason)
+		}
+		if tt.reason != "" && got.Reason != tt.reason {
+			t.Errorf("EvaluateRequest(%+v) 原因 = %q, 期望 %q", tt.req, got.Reason, tt.reason)
+		}
+	}
+
+	_, err := NewRouter(writeRules(t, "rules:\n  - DOMAIN-REGEX,(ads,REJECT\n"))
+	if err == nil || !strings.Contains(err.Error(), "无效的正则表达式 (ads") {
+		t.Errorf("NewRouter 错误 = %v, 期望无效的正则表达式", err)
+	}
+}
@@ -0,0 +1,71 @@
+package router
+
+import (
+	"os"
+	"time"
+
+	"github.com/Sesame2/gotun/internal/logger"
+)
+
+// Watch 每隔 interval 检查一次规则文件，文件被修改或从 reload 收到信号 (SIGHUP) 时
+// 重新加载规则。新文件解析失败时保留当前规则并记录错误，之后每次检查都重试，
+// 以免文件写到一半时加载失败、写完后修改时间和大小未变而不再加载。同时检查 rule-providers，
+// 本地规则集变化时单独重新加载，远程规则集按 interval 更新。done 关闭后返回
+func (r *Router) Watch(log *logger.Logger, interval time.Duration, reload <-chan os.Signal, done <-chan struct{}) {
+	last, _ := os.Stat(r.path) // 最近一次成功加载的文件
+	var failed os.FileInfo     // 最近一次加载失败的文件，成功后清空
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		var info os.FileInfo
+		retry := false
+		select {
+		case <-done:
+			return
+		case sig := <-reload:
+			log.Infof("收到 %v 信号, 重新加载规则文件", sig)
+			info, _ = os.Stat(r.path)
+		case <-ticker.C:
+			r.refreshProviders(log)
+			var err error
+			info, err = os.Stat(r.path)
+			if err != nil {
+				// 编辑器保存时可能先删除再重建文件，等下次检查
+				log.Debugf("检查规则文件失败: %v", err)
+				continue
+			}
+			if failed == nil && sameFile(info, last) {
+				continue
+			}
+			// 同一版本的文件重试失败时不重复输出错误
+			retry = sameFile(info, failed)
+			if !retry {
+				log.Infof("检测到规则文件变化: %s", r.path)
+			}
+		}
+
+		if err := r.Reload(); err != nil {
+			if retry {
+				log.Debugf("重新加载规则仍然失败: %v", err)
+			} else {
+				log.Errorf("重新加载规则失败，继续使用原有规则: %v", err)
+			}
+			if failed = info; failed == nil {
+				// 文件暂时不存在，下次检查时仍需重试
+				failed = last
+			}
+			continue
+		}
+		last, failed = info, nil
+		log.Infof("规则已重新加载: %s (%d 条规则)", r.path, r.Len())
+	}
+}
+
+// sameFile 按修改时间和大小判断两次检查之间文件是否变化
+func sameFile(a, b os.FileInfo) bool {
+	if a == nil || b == nil {
+		return false
+	}
+	return a.ModTime().Equal(b.ModTime()) && a.Size() == b.Size()
+}
@@ -0,0 +1,52 @@
+package router
+
+import (
+	"testing"
+	"time"
+
+	"github.com/Sesame2/gotun/internal/logger"
+)
+
+// TestWatchRetryAfterFailure 确认文件写到一半时加载失败，写完后即使修改时间和大小
+// 都没有变化也会重新加载
+func TestWatchRetryAfterFailure(t *testing.T) {
+	path := writeRules(t, "rules:\n  - MATCH,DIRECT\n")
+	r, err := NewRouter(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	good := "rules:\n  - MATCH,REJECT\n"
+	partial := "rules:\n  - [MATCH,REJEC\n"
+	if len(partial) != len(good) {
+		t.Fatal("两个版本的文件大小应相同")
+	}
+	done := make(chan struct{})
+	stopped := make(chan struct{})
+	go func() {
+		r.Watch(logger.NewLogger(false), 10*time.Millisecond, nil, done)
+		close(stopped)
+	}()
+	defer func() {
+		close(done)
+		<-stopped
+	}()
+
+	// 等 Watch 记录下原有文件的状态
+	time.Sleep(50 * time.Millisecond)
+	modTime := time.Now().Add(-time.Hour)
+	writeFileAt(t, path, []byte(partial), modTime)
+	time.Sleep(50 * time.Millisecond)
+	if got := r.Match("a.test"); got != ActionDirect {
+		t.Fatalf("解析失败后 Match = %s, 期望继续使用原有规则", got)
+	}
+
+	writeFileAt(t, path, []byte(good), modTime)
+	deadline := time.Now().Add(2 * time.Second)
+	for r.Match("a.test") != ActionReject {
+		if time.Now().After(deadline) {
+			t.Fatal("文件写完后未重新加载")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
@@ -0,0 +1,296 @@
+package sshconfig
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"os/user"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Sesame2/gotun/internal/utils"
+)
+
+// Include 的最大嵌套深度，与 OpenSSH 保持一致
+const maxIncludeDepth = 16
+
+// Config 表示解析后的 ssh_config 文件，按出现顺序保存所有 Host 块
+type Config struct {
+	blocks []*block
+}
+
+// block 对应一个 Host (或 Match) 块
+type block struct {
+	patterns []string
+	skip     bool // Match 块不支持，整个块被忽略
+	params   []param
+}
+
+type param struct {
+	key   string // 小写
+	value string
+}
+
+// Host 是某个主机别名查找得到的最终配置
+type Host struct {
+	Alias               string
+	HostName            string
+	User                string
+	Port                string
+	IdentityFiles       []string
+	CertificateFiles    []string
+	IdentitiesOnly      bool
+	ProxyJump           string
+	ProxyCommand        string
+	ServerAliveInterval time.Duration
+	ServerAliveCountMax int
+}
+
+// LoadDefault 加载用户配置 ~/.ssh/config 和系统配置 /etc/ssh/ssh_config，
+// 前者优先。文件不存在时返回空配置
+func LoadDefault() (*Config, error) {
+	cfg := &Config{}
+	if home, err := os.UserHomeDir(); err == nil {
+		if err := cfg.loadFile(filepath.Join(home, ".ssh", "config"), filepath.Join(home, ".ssh"), 0); err != nil {
+			return nil, err
+		}
+	}
+	if err := cfg.loadFile("/etc/ssh/ssh_config", "/etc/ssh", 0); err != nil {
+		return nil, err
+	}
+	return cfg, nil
+}
+
+// Load 加载指定的配置文件，文件不存在时返回空配置
+func Load(file string) (*Config, error) {
+	cfg := &Config{}
+	file = utils.ExpandHome(file)
+	if err := cfg.loadFile(file, filepath.Dir(file), 0); err != nil {
+		return nil, err
+	}
+	return cfg, nil
+}
+
+// loadFile 解析单个文件，Include 的相对路径以 baseDir 为基准
+func (c *Config) loadFile(file, baseDir string, depth int) error {
+	f, err := os.Open(file)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return fmt.Errorf("读取 SSH 配置文件失败: %w", err)
+	}
+	defer f.Close()
+
+	// 文件开头、Host 之前的参数属于隐式的 "Host *"；被 Include 的文件则沿用当前块
+	if depth == 0 {
+		c.blocks = append(c.blocks, &block{patterns: []string{"*"}})
+	}
+
+	scanner := bufio.NewScanner(f)
+	lineNum := 0
+	for scanner.Scan() {
+		lineNum++
+		key, value, err := splitLine(scanner.Text())
+		if err != nil {
+			return fmt.Errorf("%s:%d: %v", file, lineNum, err)
+		}
+		if key == "" {
+			continue
+		}
+
+		switch key {
+		case "host":
+			c.blocks = append(c.blocks, &block{patterns: strings.Fields(strings.ToLower(value))})
+		case "match":
+			c.blocks = append(c.blocks, &block{skip: true})
+		case "include":
+			if depth >= maxIncludeDepth {
+				return fmt.Errorf("%s:%d: Include 嵌套过深", file, lineNum)
+			}
+			parent := c.blocks[len(c.blocks)-1]
+			for _, pattern := range strings.Fields(value) {
+				pattern = utils.ExpandHome(pattern)
+				if !filepath.IsAbs(pattern) {
+					pattern = filepath.Join(baseDir, pattern)
+				}
+				matches, err := filepath.Glob(pattern)
+				if err != nil {
+					return fmt.Errorf("%s:%d: 无效的 Include 路径: %v", file, lineNum, err)
+				}
+				for _, m := range matches {
+					if err := c.loadFile(m, baseDir, depth+1); err != nil {
+						return err
+					}
+				}
+			}
+			// 被包含的文件中出现了新的 Host 块时，其后的参数仍属于原来的块
+			if c.blocks[len(c.blocks)-1] != parent {
+				c.blocks = append(c.blocks, &block{patterns: parent.patterns, skip: parent.skip})
+			}
+		default:
+			cur := c.blocks[len(c.blocks)-1]
+			cur.params = append(cur.params, param{key: key, value: value})
+		}
+	}
+	return scanner.Err()
+}
+
+// splitLine 解析 "Key value" 或 "Key=value" 格式的一行，空行和注释返回空 key
+func splitLine(line string) (string, string, error) {
+	line = strings.TrimSpace(line)
+	if line == "" || strings.HasPrefix(line, "#") {
+		return "", "", nil
+	}
+
+	idx := strings.IndexAny(line, " \t=")
+	if idx < 0 {
+		return "", "", fmt.Errorf("缺少参数值: %s", line)
+	}
+	key := strings.ToLower(line[:idx])
+	value := strings.TrimSpace(line[idx:])
+	value = strings.TrimSpace(strings.TrimPrefix(value, "="))
+
+	if strings.HasPrefix(value, `"`) {
+		end := strings.Index(value[1:], `"`)
+		if end < 0 {
+			return "", "", fmt.Errorf("引号未闭合: %s", line)
+		}
+		value = value[1 : end+1]
+	}
+	return key, value, nil
+}
+
+// matches 判断主机别名是否匹配该块的 Host 模式
+func (b *block) matches(alias string) bool {
+	if b.skip {
+		return false
+	}
+	matched := false
+	for _, p := range b.patterns {
+		negate := strings.HasPrefix(p, "!")
+		if negate {
+			p = p[1:]
+		}
+		if ok, _ := path.Match(p, alias); ok {
+			if negate {
+				return false
+			}
+			matched = true
+		}
+	}
+	return matched
+}
+
+// Lookup 查找主机别名对应的配置。与 OpenSSH 相同，每个参数以第一次出现的值为准，
+// IdentityFile 和 CertificateFile 则会累加
+func (c *Config) Lookup(alias string) *Host {
+	h := &Host{Alias: alias}
+	if c == nil {
+		return h
+	}
+
+	seen := make(map[string]bool)
+	lower := strings.ToLower(alias)
+	for _, b := range c.blocks {
+		if !b.matches(lower) {
+			continue
+		}
+		for _, p := range b.params {
+			switch p.key {
+			case "identityfile":
+				h.IdentityFiles = append(h.IdentityFiles, p.value)
+				continue
+			case "certificatefile":
+				h.CertificateFiles = append(h.CertificateFiles, p.value)
+				continue
+			}
+			if seen[p.key] {
+				continue
+			}
+			seen[p.key] = true
+
+			switch p.key {
+			case "hostname":
+				h.HostName = p.value
+			case "user":
+				h.User = p.value
+			case "port":
+				h.Port = p.value
+			case "identitiesonly":
+				h.IdentitiesOnly = strings.EqualFold(p.value, "yes")
+			case "proxyjump":
+				h.ProxyJump = p.value
+			case "proxycommand":
+				if !strings.EqualFold(p.value, "none") {
+					h.ProxyCommand = p.value
+				}
+			case "serveraliveinterval":
+				if n, err := strconv.Atoi(p.value); err == nil {
+					h.ServerAliveInterval = time.Duration(n) * time.Second
+				}
+			case "serveralivecountmax":
+				if n, err := strconv.Atoi(p.value); err == nil {
+					h.ServerAliveCountMax = n
+				}
+			}
+		}
+	}
+
+	// HostName 中的 %h 代表别名本身
+	if h.HostName != "" {
+		h.HostName = strings.ReplaceAll(h.HostName, "%h", alias)
+	}
+	return h
+}
+
+// ExpandTokens 展开 IdentityFile 等参数中的 ~ 和 %d %u %h %r %p %% 占位符，
+// host 应为解析后的真实主机名
+func (h *Host) ExpandTokens(value, host, user, port string) string {
+	var b strings.Builder
+	for i := 0; i < len(value); i++ {
+		if value[i] != '%' || i == len(value)-1 {
+			b.WriteByte(value[i])
+			continue
+		}
+		i++
+		switch value[i] {
+		case '%':
+			b.WriteByte('%')
+		case 'd':
+			home, _ := os.UserHomeDir()
+			b.WriteString(home)
+		case 'u':
+			b.WriteString(LocalUser())
+		case 'h':
+			b.WriteString(host)
+		case 'n':
+			b.WriteString(h.Alias)
+		case 'r':
+			b.WriteString(user)
+		case 'p':
+			b.WriteString(port)
+		default:
+			b.WriteByte('%')
+			b.WriteByte(value[i])
+		}
+	}
+	return utils.ExpandHome(b.String())
+}
+
+// LocalUser 返回当前本地用户名，作为未指定 User 时的默认值
+func LocalUser() string {
+	u, err := user.Current()
+	if err != nil {
+		return os.Getenv("USER")
+	}
+	name := u.Username
+	// Windows 下用户名形如 DOMAIN\user
+	if i := strings.LastIndex(name, `\`); i >= 0 {
+		name = name[i+1:]
+	}
+	return name
+}
@@ -0,0 +1,192 @@
+package sshconfig
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func writeFile(t *testing.T, dir, name, content string) string {
+	t.Helper()
+	p := filepath.Join(dir, name)
+	if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(p, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return p
+}
+
+func TestLookup(t *testing.T) {
+	dir := t.TempDir()
+	writeFile(t, dir, "conf.d/lab", `
+Host lab-*
+  User labuser
+  ProxyJump prod-bastion
+`)
+	file := writeFile(t, dir, "config", `
+# 全局默认
+ServerAliveInterval 30
+
+Host prod-bastion
+  HostName bastion.%h.example.com
+  User admin
+  Port 2222
+  IdentityFile ~/.ssh/bastion
+  ProxyCommand cloudflared access ssh --hostname %h
+
+Match host foo
+  User ignored
+
+Include conf.d/*
+
+Host *.internal !secret.internal
+  User=internal
+  IdentitiesOnly yes
+  ProxyCommand none
+
+Host *
+  User fallback
+  ProxyCommand nc %h %p
+  Port 22
+  IdentityFile ~/.ssh/id_ed25519
+  ServerAliveInterval 60
+  ServerAliveCountMax 5
+`)
+
+	cfg, err := Load(file)
+	if err != nil {
+		t.Fatalf("Load 失败: %v", err)
+	}
+
+	tests := []struct {
+		alias string
+		want  Host
+	}{
+		{
+			alias: "prod-bastion",
+			want: Host{
+				Alias:               "prod-bastion",
+				HostName:            "bastion.prod-bastion.example.com",
+				User:                "admin",
+				Port:                "2222",
+				IdentityFiles:       []string{"~/.ssh/bastion", "~/.ssh/id_ed25519"},
+				ProxyCommand:        "cloudflared access ssh --hostname %h",
+				ServerAliveInterval: 30 * time.Second,
+				ServerAliveCountMax: 5,
+			},
+		},
+		{
+			alias: "lab-db",
+			want: Host{
+				Alias:               "lab-db",
+				ProxyCommand:        "nc %h %p",
+				User:                "labuser",
+				Port:                "22",
+				ProxyJump:           "prod-bastion",
+				IdentityFiles:       []string{"~/.ssh/id_ed25519"},
+				ServerAliveInterval: 30 * time.Second,
+				ServerAliveCountMax: 5,
+			},
+		},
+		{
+			alias: "web.internal",
+			want: Host{
+				Alias:               "web.internal",
+				User:                "internal",
+				Port:                "22",
+				IdentitiesOnly:      true,
+				IdentityFiles:       []string{"~/.ssh/id_ed25519"},
+				ServerAliveInterval: 30 * time.Second,
+				ServerAliveCountMax: 5,
+			},
+		},
+		{
+			alias: "secret.internal",
+			want: Host{
+				Alias:               "secret.internal",
+				ProxyCommand:        "nc %h %p",
+				User:                "fallback",
+				Port:                "22",
+				IdentityFiles:       []string{"~/.ssh/id_ed25519"},
+				ServerAliveInterval: 30 * time.Second,
+				ServerAliveCountMax: 5,
+			},
+		},
+		{
+			alias: "foo",
+			want: Host{
+				Alias:               "foo",
+				ProxyCommand:        "nc %h %p",
+				User:                "fallback",
+				Port:                "22",
+				IdentityFiles:       []string{"~/.ssh/id_ed25519"},
+				ServerAliveInterval: 30 * time.Second,
+				ServerAliveCountMax: 5,
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.alias, func(t *testing.T) {
+			got := cfg.Lookup(tt.alias)
+			if !reflect.DeepEqual(*got, tt.want) {
+				t.Errorf("Lookup(%q) = %+v, 期望 %+v", tt.alias, *got, tt.want)
+			}
+		})
+	}
+}
+
+func TestIncludeInsideHost(t *testing.T) {
+	dir := t.TempDir()
+	writeFile(t, dir, "extra", `
+Port 2200
+Host other
+  User other
+`)
+	file := writeFile(t, dir, "config", `
+Host box
+  Include extra
+  User boxuser
+`)
+
+	cfg, err := Load(file)
+	if err != nil {
+		t.Fatalf("Load 失败: %v", err)
+	}
+	got := cfg.Lookup("box")
+	if got.Port != "2200" || got.User != "boxuser" {
+		t.Errorf("Include 之后的参数应属于原 Host 块, 得到 %+v", *got)
+	}
+	if other := cfg.Lookup("other"); other.User != "other" || other.Port != "" {
+		t.Errorf("Lookup(other) = %+v", *other)
+	}
+}
+
+func TestSplitLine(t *testing.T) {
+	tests := []struct {
+		line, key, value string
+		wantErr          bool
+	}{
+		{line: "  # comment"},
+		{line: "HostName example.com", key: "hostname", value: "example.com"},
+		{line: "Port=2222", key: "port", value: "2222"},
+		{line: "Port = 2222", key: "port", value: "2222"},
+		{line: `IdentityFile "~/my keys/id"`, key: "identityfile", value: "~/my keys/id"},
+		{line: `IdentityFile "~/broken`, wantErr: true},
+		{line: "Lonely", wantErr: true},
+	}
+	for _, tt := range tests {
+		key, value, err := splitLine(tt.line)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("splitLine(%q) err = %v, wantErr %v", tt.line, err, tt.wantErr)
+			continue
+		}
+		if key != tt.key || value != tt.value {
+			t.Errorf("splitLine(%q) = (%q, %q), 期望 (%q, %q)", tt.line, key, value, tt.key, tt.value)
+		}
+	}
+}
@@ -7,6 +7,7 @@ import (
 	"net"
 	"os/exec"
 	"runtime"
+	"strconv"
 	"strings"
 	"sync"
 
@@ -14,6 +15,7 @@ import (
 	"github.com/Sesame2/gotun/internal/config"
 	"github.com/Sesame2/gotun/internal/logger"
 	"github.com/Sesame2/gotun/internal/proxy"
+	"github.com/Sesame2/gotun/internal/router"
 
 	"golang.zx2c4.com/wireguard/tun"
 
@@ -33,7 +35,8 @@ import (
 type TunService struct {
 	cfg      *config.Config
 	logger   *logger.Logger
-	ssh      *proxy.SSHClient
+	ssh      proxy.Dialer
+	router   *router.Router // 可选，仅用于记录命中的规则和执行 REJECT
 	dev      tun.Device
 	stack    *stack.Stack
 	endpoint *channel.Endpoint
@@ -48,8 +51,8 @@ type TunService struct {
 	closeOnce sync.Once
 }
 
-// NewTunService 创建 TUN 服务
-func NewTunService(cfg *config.Config, log *logger.Logger, sshClient *proxy.SSHClient) (*TunService, error) {
+// NewTunService 创建 TUN 服务，r 为 nil 时不做规则匹配
+func NewTunService(cfg *config.Config, log *logger.Logger, sshClient proxy.Dialer, r *router.Router) (*TunService, error) {
 	// 解析 CIDR
 	ip, ipNet, err := net.ParseCIDR(cfg.TunCIDR)
 	if err != nil {
@@ -72,6 +75,7 @@ func NewTunService(cfg *config.Config, log *logger.Logger, sshClient *proxy.SSHC
 		cfg:     cfg,
 		logger:  log,
 		ssh:     sshClient,
+		router:  r,
 		tunIP:   tunIP.String(),
 		tunMask: mask, // 内部仍使用 mask 字符串
 		peerIP:  peerIP.String(),
@@ -261,6 +265,12 @@ func (t *TunService) initNetstack() {
 		// ------------------------
 
 		t.logger.Infof("[TUN] 收到 TCP 连接请求 -> %s (原始目标: %s:%d)", targetAddr, destIP, destPort)
+
+		if action := t.route(targetAddr, id, "tcp"); action.IsReject() {
+			// REJECT 回复 RST，REJECT-DROP 不作响应
+			r.Complete(action == router.ActionReject)
+			return
+		}
 		var wq waiter.Queue
 		ep, err := r.CreateEndpoint(&wq)
 		if err != nil {
@@ -280,6 +290,11 @@ func (t *TunService) initNetstack() {
 		if id.LocalPort != 53 {
 			return false
 		}
+		targetAddr := net.JoinHostPort(id.LocalAddress.String(), strconv.Itoa(int(id.LocalPort)))
+		if action := t.route(targetAddr, id, "udp"); action.IsReject() {
+			// 丢弃 DNS 查询
+			return true
+		}
 
 		var wq waiter.Queue
 		ep, err := r.CreateEndpoint(&wq)
@@ -297,6 +312,26 @@ func (t *TunService) initNetstack() {
 	t.stack = s
 }
 
+// route 按规则检查 TUN 中的连接并记录命中的规则，没有规则时返回 PROXY。
+// 进入 TUN 的流量已被路由到隧道，无法再直连，DIRECT 规则仍走代理
+func (t *TunService) route(targetAddr string, id stack.TransportEndpointID, network string) router.Action {
+	if t.router == nil {
+		return router.ActionProxy
+	}
+	result := t.router.EvaluateRequest(router.Request{
+		Host:    targetAddr,
+		Source:  net.JoinHostPort(id.RemoteAddress.String(), strconv.Itoa(int(id.RemotePort))),
+		Network: network,
+		Inbound: "tun",
+	})
+	if result.Action == router.ActionDirect {
+		t.logger.Infof("[TUN] 规则匹配: %s -> DIRECT (%s)，TUN 模式下无法直连，仍经 SSH 转发", targetAddr, result)
+		return router.ActionProxy
+	}
+	t.logger.Infof("[TUN] 规则匹配: %s -> %s (%s)", targetAddr, result.Action, result)
+	return result.Action
+}
+
 // handleUDPForward (DNS)
 func (t *TunService) handleUDPForward(conn *gonet.UDPConn, targetIP string, targetPort uint16) {
 	defer conn.Close()
@@ -504,23 +539,21 @@ func (t *TunService) setupGlobalRoutes(devName string) error {
 	}
 	t.logger.Infof("[TUN] 检测到默认网关: %s", gateway)
 
-	sshHost := t.cfg.SSHServer
-	if host, _, err := net.SplitHostPort(sshHost); err == nil {
-		sshHost = host
-	}
-
-	sshIPs, err := net.LookupIP(sshHost)
-	if err != nil {
-		return fmt.Errorf("无法解析 SSH 服务器 IP: %v", err)
-	}
-	if len(sshIPs) == 0 {
-		return fmt.Errorf("SSH 服务器 IP 解析为空")
-	}
-	targetSSH_IP := sshIPs[0].String()
-	t.logger.Infof("[TUN] 为 SSH 服务器 %s (%s) 添加绕过路由 via %s", sshHost, targetSSH_IP, gateway)
+	// 每个 SSH 上游都需要绕过路由
+	for _, sshHost := range t.cfg.SSHServerHosts() {
+		sshIPs, err := net.LookupIP(sshHost)
+		if err != nil {
+			return fmt.Errorf("无法解析 SSH 服务器 IP: %v", err)
+		}
+		if len(sshIPs) == 0 {
+			return fmt.Errorf("SSH 服务器 IP 解析为空")
+		}
+		targetSSH_IP := sshIPs[0].String()
+		t.logger.Infof("[TUN] 为 SSH 服务器 %s (%s) 添加绕过路由 via %s", sshHost, targetSSH_IP, gateway)
 
-	if err := t.addRoute(targetSSH_IP, gateway, ""); err != nil {
-		return fmt.Errorf("添加 SSH 绕过路由失败: %v", err)
+		if err := t.addRoute(targetSSH_IP, gateway, ""); err != nil {
+			return fmt.Errorf("添加 SSH 绕过路由失败: %v", err)
+		}
 	}
 
 	t.logger.Info("[TUN] 添加全局覆盖路由 (0.0.0.0/1, 128.0.0.0/1)...")
@@ -655,11 +688,11 @@ func (t *TunService) checkRouteConflicts() {
 		return
 	}
 
-	sshHost := t.cfg.SSHServer
-	if host, _, err := net.SplitHostPort(sshHost); err == nil {
-		sshHost = host
+	var sshIPs []net.IP
+	for _, sshHost := range t.cfg.SSHServerHosts() {
+		ips, _ := net.LookupIP(sshHost)
+		sshIPs = append(sshIPs, ips...)
 	}
-	sshIPs, _ := net.LookupIP(sshHost)
 
 	// check conflict with t.routes & SubnetAliases
 	checkConflict := func(targetCIDR string, targetName string) {
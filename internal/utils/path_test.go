@@ -0,0 +1,29 @@
+package utils
+
+import (
+	"path/filepath"
+	"testing"
+)
+
+func TestExpandHome(t *testing.T) {
+	home := t.TempDir()
+	t.Setenv("HOME", home)
+	t.Setenv("USERPROFILE", home)
+
+	tests := []struct {
+		path string
+		want string
+	}{
+		{path: "~", want: home},
+		{path: "~/.ssh/id_ed25519", want: filepath.Join(home, ".ssh", "id_ed25519")},
+		{path: "~other/file", want: "~other/file"},
+		{path: "/etc/ssh/ssh_config", want: "/etc/ssh/ssh_config"},
+		{path: "keys/~/id", want: "keys/~/id"},
+		{path: "", want: ""},
+	}
+	for _, tt := range tests {
+		if got := ExpandHome(tt.path); got != tt.want {
+			t.Errorf("ExpandHome(%q) = %q, 期望 %q", tt.path, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,53 @@
+package utils
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"syscall"
+
+	"golang.org/x/term"
+)
+
+var (
+	stdinReader     *bufio.Reader
+	stdinReaderOnce sync.Once
+)
+
+// IsTerminal 判断标准输入是否为交互式终端
+func IsTerminal() bool {
+	return term.IsTerminal(int(syscall.Stdin))
+}
+
+// 从终端读取一行输入(回显)
+func ReadLineFromTerminal(prompt string) (string, error) {
+	fmt.Print(prompt)
+
+	stdinReaderOnce.Do(func() {
+		stdinReader = bufio.NewReader(os.Stdin)
+	})
+	line, err := stdinReader.ReadString('\n')
+	if err != nil && line == "" {
+		return "", fmt.Errorf("读取输入失败： %v", err)
+	}
+	return strings.TrimRight(line, "\r\n"), nil
+}
+
+// 询问用户是否继续，只有输入 yes 才视为同意
+func Confirm(prompt string) (bool, error) {
+	for {
+		answer, err := ReadLineFromTerminal(prompt)
+		if err != nil {
+			return false, err
+		}
+		switch strings.ToLower(strings.TrimSpace(answer)) {
+		case "yes":
+			return true, nil
+		case "no", "":
+			return false, nil
+		}
+		prompt = "请输入 'yes' 或 'no': "
+	}
+}